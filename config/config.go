@@ -31,6 +31,57 @@ type Config struct {
 	// It can specify a local file or a remote URL.
 	PolicyFileName string
 
+	// ShadowPolicyFileName is the name of a candidate policy file, evaluated for every request in parallel
+	// with the active policy, to detect the differences before activating it. It can be a local file or a remote URL.
+	// Its decisions never affect the responses.
+	ShadowPolicyFileName string
+
+	// PolicyTrustedKeysFile is the name of a JWKS file with the public keys trusted to sign the policies.
+	// If specified, the policy file and the modules it loads must have a valid signature to be used.
+	PolicyTrustedKeysFile string
+
+	// DecisionCacheSize is the maximum number of authorization decisions kept in the decision cache.
+	// The cache is disabled if it is zero.
+	DecisionCacheSize int
+
+	// DecisionCacheTTL is the time an authorization decision is kept in the decision cache.
+	DecisionCacheTTL time.Duration
+
+	// PIPCallBudget is the maximum number of lookups of TMF objects that a policy can perform
+	// when taking a single decision. A default is used if it is zero.
+	PIPCallBudget int
+
+	// PolicyMaxSteps is the maximum number of Starlark execution steps for a single evaluation of the policies.
+	// A default is used if it is zero.
+	PolicyMaxSteps uint64
+
+	// PolicyTimeout is the maximum time for a single evaluation of the policies.
+	// A default is used if it is zero.
+	PolicyTimeout time.Duration
+
+	// AuthZENSecretFile is the name of the file with the shared secret that the callers of the AuthZEN API
+	// must present as a Bearer token. The AuthZEN API trusts the subject sent by its callers, so it is not
+	// available if it is empty.
+	AuthZENSecretFile string
+
+	// AuditLog records all the authorization decisions in the audit log, in the database of the environment.
+	AuditLog bool
+
+	// AuditInputs keeps in the audit log the input of each decision, with the personal data in the Access Token
+	// redacted, to load it in the REPL by request ID. Only the digest of the input is kept otherwise.
+	AuditInputs bool
+
+	// AuditRetention is the time the authorization decisions are kept in the audit log.
+	// They are kept forever if it is zero.
+	AuditRetention time.Duration
+
+	// RecordDecisionsFile is the file where the full inputs of the authorization decisions are recorded
+	// as JSON Lines, to replay them offline. They are not recorded if it is empty.
+	RecordDecisionsFile string
+
+	// LogEntryPoints adds to the logs of each authorization decision the policy function which took it.
+	LogEntryPoints bool
+
 	// PDPAddress is the address of the PDP server.
 	PDPAddress string
 
@@ -68,6 +119,28 @@ type Config struct {
 	// VerifierServer is the URL of the verifier server, which is used to verify the access tokens.
 	VerifierServer string
 
+	// TokenIssuers are the accepted issuers of the Access Tokens, which are the URLs of the trusted Verifiers.
+	// If empty, the VerifierServer is the only trusted issuer.
+	TokenIssuers []string
+
+	// TokenAudiences are the expected audiences of the Access Tokens. The audience is not checked if it is empty.
+	TokenAudiences []string
+
+	// TokenAlgorithms are the signing algorithms accepted for the Access Tokens. A default is used if it is empty.
+	TokenAlgorithms []string
+
+	// TokenClockSkew is the tolerance for the differences between the clocks of the Verifier and the PDP
+	// when checking the validity period of the Access Tokens.
+	TokenClockSkew time.Duration
+
+	// JWKSRefreshInterval is the maximum time the keys of the Verifier are used before retrieving them again.
+	// The caching headers of the Verifier can make it shorter. A default is used if it is zero.
+	JWKSRefreshInterval time.Duration
+
+	// JWKSMinRefreshInterval is the minimum time between two retrievals of the keys of the Verifier,
+	// including those caused by Access Tokens signed with an unknown key. A default is used if it is zero.
+	JWKSMinRefreshInterval time.Duration
+
 	// Dbname is the name of the database file where the TMForum cahed data is stored
 	// It is used to store the data in a local SQLite database, the best SQL database for this purpose.
 	Dbname string
@@ -111,6 +184,9 @@ const ISBE_dbname = "./tmf-isbe.db"
 
 const DefaultClonePeriod = 10 * time.Minute
 
+// DefaultTokenClockSkew is the tolerance for the validity period of the Access Tokens in all environments.
+const DefaultTokenClockSkew = 1 * time.Minute
+
 var proConfig = &Config{
 	Environment:       DOME_PRO,
 	PolicyFileName:    "auth_policies.star",
@@ -120,6 +196,9 @@ var proConfig = &Config{
 	VerifierServer:    "https://verifier.dome-marketplace.eu",
 	Dbname:            PRO_dbname,
 	ClonePeriod:       DefaultClonePeriod,
+	TokenIssuers:      []string{"https://verifier.dome-marketplace.eu"},
+	TokenAlgorithms:   []string{"ES256"},
+	TokenClockSkew:    DefaultTokenClockSkew,
 }
 
 var dev2Config = &Config{
@@ -131,6 +210,9 @@ var dev2Config = &Config{
 	VerifierServer:    "https://verifier.dome-marketplace-dev2.org",
 	Dbname:            DEV2_dbname,
 	ClonePeriod:       DefaultClonePeriod,
+	TokenIssuers:      []string{"https://verifier.dome-marketplace-dev2.org"},
+	TokenAlgorithms:   []string{"ES256"},
+	TokenClockSkew:    DefaultTokenClockSkew,
 }
 
 var sbxConfig = &Config{
@@ -142,6 +224,9 @@ var sbxConfig = &Config{
 	VerifierServer:    "https://verifier.dome-marketplace-sbx.org",
 	Dbname:            SBX_dbname,
 	ClonePeriod:       DefaultClonePeriod,
+	TokenIssuers:      []string{"https://verifier.dome-marketplace-sbx.org"},
+	TokenAlgorithms:   []string{"ES256"},
+	TokenClockSkew:    DefaultTokenClockSkew,
 }
 
 var lclConfig = &Config{
@@ -153,6 +238,9 @@ var lclConfig = &Config{
 	VerifierServer:    "https://verifier.dome-marketplace-lcl.org",
 	Dbname:            LCL_dbname,
 	ClonePeriod:       DefaultClonePeriod,
+	TokenIssuers:      []string{"https://verifier.dome-marketplace-lcl.org"},
+	TokenAlgorithms:   []string{"ES256"},
+	TokenClockSkew:    DefaultTokenClockSkew,
 }
 
 var isbeConfig = &Config{
@@ -164,6 +252,9 @@ var isbeConfig = &Config{
 	VerifierServer:    "https://verifier.dome-marketplace.eu",
 	Dbname:            ISBE_dbname,
 	ClonePeriod:       DefaultClonePeriod,
+	TokenIssuers:      []string{"https://verifier.dome-marketplace.eu"},
+	TokenAlgorithms:   []string{"ES256"},
+	TokenClockSkew:    DefaultTokenClockSkew,
 }
 
 func DefaultConfig(where Environment, internal bool, usingBAEProxy bool) *Config {
@@ -31,7 +31,7 @@ require (
 )
 
 require (
-	github.com/chzyer/readline v1.5.1 // indirect
+	github.com/chzyer/readline v1.5.1
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/fatih/color v1.18.0
 	github.com/goccy/go-yaml v1.18.0
@@ -229,15 +229,23 @@ func AddContextAttributes(ctx context.Context, attr slog.Attr) {
 
 // The standard HTTP error response for TMF APIs
 type errorTMFObject struct {
-	Code   string `json:"code"`
-	Reason string `json:"reason"`
+	Code    string `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
 }
 
 // ErrorTMF sends back an HTTP error response using the TMForum standard format
 func ErrorTMF(w http.ResponseWriter, statusCode int, code string, reason string) {
+	ErrorTMFWithMessage(w, statusCode, code, reason, "")
+}
+
+// ErrorTMFWithMessage is like ErrorTMF, but sets also the optional 'message' field
+// with more details about the error.
+func ErrorTMFWithMessage(w http.ResponseWriter, statusCode int, code string, reason string, message string) {
 	errtmf := &errorTMFObject{
-		Code:   code,
-		Reason: reason,
+		Code:    code,
+		Reason:  reason,
+		Message: message,
 	}
 
 	h := w.Header()
@@ -21,6 +21,7 @@ import (
 	"github.com/hesusruiz/domeproxy/internal/errl"
 	"github.com/hesusruiz/domeproxy/internal/run"
 	"github.com/hesusruiz/domeproxy/mitm"
+	"github.com/hesusruiz/domeproxy/pdp"
 	"github.com/hesusruiz/domeproxy/tmfcache"
 	"github.com/peterbourgon/ff/v4"
 	"github.com/peterbourgon/ff/v4/ffhelp"
@@ -53,6 +54,25 @@ func startServices(args []string) {
 	runtimeenv := rootFlags.StringEnum('r', "run", "runtime environment [isbe,lcl, sbx, dev2 or pro]", "isbe", "sbx", "lcl", "dev2", "pro")
 	backgroundSync := rootFlags.BoolDefault('s', "backgroundsync", false, "enable background synchronization of the TMForum resources")
 	nocolor := rootFlags.Bool('n', "nocolor", "disable color output for the logs to stdout")
+	policyKeys := rootFlags.StringLong("policy_keys", "", "JWKS file with the public keys trusted to sign the policies (if set, policies must be signed)")
+	decisionCacheSize := rootFlags.IntLong("decision_cache_size", 0, "maximum number of authorization decisions in the decision cache (0 disables the cache)")
+	decisionCacheTTL := rootFlags.DurationLong("decision_cache_ttl", pdp.DefaultDecisionCacheTTL, "time an authorization decision is kept in the decision cache")
+	pipBudget := rootFlags.IntLong("pip_budget", pdp.DefaultPIPCallBudget, "maximum number of lookups of TMF objects by the policies for a single decision")
+	policyMaxSteps := rootFlags.Uint64Long("policy_max_steps", pdp.DefaultPolicyMaxSteps, "maximum number of execution steps for a single evaluation of the policies")
+	policyTimeout := rootFlags.DurationLong("policy_timeout", pdp.DefaultPolicyTimeout, "maximum time for a single evaluation of the policies")
+	shadowPolicy := rootFlags.StringLong("shadow_policy", "", "candidate policy file evaluated in shadow mode, to compare its decisions with the active policy")
+	logEntryPoints := rootFlags.BoolLong("log_entry_points", "log the policy function which took each authorization decision")
+	authzenSecret := rootFlags.StringLong("authzen_secret", "", "file with the shared secret the callers of the AuthZEN API must present as Bearer token (the API is disabled if not set)")
+	auditLog := rootFlags.BoolLong("audit", "record the authorization decisions in the audit log of the database")
+	auditInputs := rootFlags.BoolLong("audit_inputs", "keep the redacted input of each decision in the audit log, to load it in the REPL by request ID")
+	auditRetention := rootFlags.DurationLong("audit_retention", pdp.DefaultAuditRetention, "time the authorization decisions are kept in the audit log (0 keeps them forever)")
+	recordDecisions := rootFlags.StringLong("record_decisions", "", "file where the inputs of the authorization decisions are recorded as JSON Lines, to replay them offline")
+	jwksRefresh := rootFlags.DurationLong("jwks_refresh", pdp.DefaultJWKSRefreshInterval, "maximum time the keys of the Verifier are used before retrieving them again")
+	jwksMinRefresh := rootFlags.DurationLong("jwks_min_refresh", pdp.DefaultJWKSMinRefreshInterval, "minimum time between two retrievals of the keys of the Verifier")
+	tokenIssuers := rootFlags.StringListLong("token_issuer", "trusted issuer of the Access Tokens, replacing the Verifier of the environment (repeatable)")
+	tokenAudiences := rootFlags.StringListLong("token_audience", "expected audience of the Access Tokens (repeatable, not checked if not set)")
+	tokenAlgorithms := rootFlags.StringListLong("token_algorithm", "signing algorithm accepted for the Access Tokens, replacing the ones of the environment (repeatable)")
+	tokenClockSkew := rootFlags.DurationLong("token_clock_skew", config.DefaultTokenClockSkew, "tolerance for the validity period of the Access Tokens")
 	var delete = rootFlags.BoolLong("delete", "delete the database before performing a new synchronization")
 
 	// Man-In-The-Middle proxy flags
@@ -85,6 +105,31 @@ func startServices(args []string) {
 			}
 
 			tmfConfig.BackgroudSync = *backgroundSync
+			tmfConfig.PolicyTrustedKeysFile = *policyKeys
+			tmfConfig.ShadowPolicyFileName = *shadowPolicy
+			tmfConfig.DecisionCacheSize = *decisionCacheSize
+			tmfConfig.DecisionCacheTTL = *decisionCacheTTL
+			tmfConfig.PIPCallBudget = *pipBudget
+			tmfConfig.PolicyMaxSteps = *policyMaxSteps
+			tmfConfig.PolicyTimeout = *policyTimeout
+			tmfConfig.LogEntryPoints = *logEntryPoints
+			tmfConfig.AuditLog = *auditLog
+			tmfConfig.AuditInputs = *auditInputs
+			tmfConfig.AuditRetention = *auditRetention
+			tmfConfig.AuthZENSecretFile = *authzenSecret
+			tmfConfig.RecordDecisionsFile = *recordDecisions
+			tmfConfig.JWKSRefreshInterval = *jwksRefresh
+			tmfConfig.JWKSMinRefreshInterval = *jwksMinRefresh
+			tmfConfig.TokenClockSkew = *tokenClockSkew
+			if len(*tokenIssuers) > 0 {
+				tmfConfig.TokenIssuers = *tokenIssuers
+			}
+			if len(*tokenAudiences) > 0 {
+				tmfConfig.TokenAudiences = *tokenAudiences
+			}
+			if len(*tokenAlgorithms) > 0 {
+				tmfConfig.TokenAlgorithms = *tokenAlgorithms
+			}
 
 			// For testing
 			tmfConfig.FakeClaims = true
@@ -460,6 +505,161 @@ func startServices(args []string) {
 	}
 	rootCmd.Subcommands = append(rootCmd.Subcommands, dumpCmd)
 
+	// *************************************************************************************************
+	// policy command, with subcommands to work with the policy files offline
+	// *************************************************************************************************
+
+	policyFlags := ff.NewFlagSet("policy").SetParent(rootFlags)
+
+	var policyFile = policyFlags.StringLong("policy", "auth_policies.star", "file with the policy rules")
+
+	policyCmd := &ff.Command{
+		Name:      "policy",
+		Usage:     "domepdp policy SUBCOMMAND [flags]",
+		ShortHelp: "manage and test the policy rules offline",
+		Flags:     policyFlags,
+	}
+	rootCmd.Subcommands = append(rootCmd.Subcommands, policyCmd)
+
+	policyTestFlags := ff.NewFlagSet("test").SetParent(policyFlags)
+
+	policyTestCmd := &ff.Command{
+		Name:      "test",
+		Usage:     "domepdp policy test [--policy FILE] FIXTURE [FIXTURE...]",
+		ShortHelp: "evaluate the policy against the test cases in the YAML or JSON fixture files",
+		Flags:     policyTestFlags,
+		Exec: func(ctx context.Context, args []string) error {
+
+			if len(args) == 0 {
+				return errl.Errorf("no fixture files specified")
+			}
+
+			logger := config.SetLogger(*debug, *nocolor)
+			defer logger.Close()
+
+			report, err := pdp.RunPolicyTests(*policyFile, args)
+			if err != nil {
+				return err
+			}
+
+			report.Print(os.Stdout)
+
+			if !report.OK() {
+				return fmt.Errorf("%d policy tests failed", report.Failed)
+			}
+
+			return nil
+		},
+	}
+	policyCmd.Subcommands = append(policyCmd.Subcommands, policyTestCmd)
+
+	policySignFlags := ff.NewFlagSet("sign").SetParent(policyFlags)
+
+	var signingKey = policySignFlags.StringLong("key", "secrets/policy-key.pem", "private key to sign the policy, as a JWK or a PEM file")
+	var signingKid = policySignFlags.StringLong("kid", "", "key identifier to include in the signature")
+
+	policySignCmd := &ff.Command{
+		Name:      "sign",
+		Usage:     "domepdp policy sign [--key FILE] [--kid ID] [FILE...]",
+		ShortHelp: "sign the policy file (or the given files) with a local key, creating a detached JWS in FILE.sig",
+		Flags:     policySignFlags,
+		Exec: func(ctx context.Context, args []string) error {
+
+			files := args
+			if len(files) == 0 {
+				files = []string{*policyFile}
+			}
+
+			for _, f := range files {
+				sigFile, err := pdp.SignPolicyFile(f, *signingKey, *signingKid)
+				if err != nil {
+					return errl.Errorf("signing %s: %w", f, err)
+				}
+				fmt.Printf("%s signed in %s\n", f, sigFile)
+			}
+
+			return nil
+		},
+	}
+	policyCmd.Subcommands = append(policyCmd.Subcommands, policySignCmd)
+
+	policyReplFlags := ff.NewFlagSet("repl").SetParent(policyFlags)
+
+	var replInput = policyReplFlags.StringLong("input", "", "JSON file with the input object, captured inputs as JSON Lines, or a test fixture")
+	var replSelect = policyReplFlags.StringLong("select", "", "line of the captured inputs or decision of the request (default the last one), or name of the test case (default the first one)")
+	var replRequestID = policyReplFlags.StringLong("reqid", "", "request ID of a decision in the audit log of the environment, used as input instead of a file")
+
+	policyReplCmd := &ff.Command{
+		Name:      "repl",
+		Usage:     "domepdp policy repl [--policy FILE] [--input FILE | --reqid ID] [--select LINE|NAME]",
+		ShortHelp: "evaluate Starlark expressions interactively with the globals of the policy and a given input",
+		Flags:     policyReplFlags,
+		Exec: func(ctx context.Context, args []string) error {
+
+			logger := config.SetLogger(*debug, *nocolor)
+			defer logger.Close()
+
+			input := pdp.StarTMFMap{}
+			switch {
+			case *replInput != "" && *replRequestID != "":
+				return errl.Errorf("an input file and a request ID can not be specified at the same time")
+			case *replInput != "":
+				var err error
+				input, err = pdp.LoadDecisionInput(*replInput, *replSelect)
+				if err != nil {
+					return err
+				}
+			case *replRequestID != "":
+				tmfConfig, err := config.LoadConfig(*runtimeenv, *pdpAddress, *internal, *usingBAEProxy, *debug, logger)
+				if err != nil {
+					return errl.Error(err)
+				}
+				input, err = pdp.LoadAuditInput(tmfConfig.Dbname, *replRequestID, *replSelect)
+				if err != nil {
+					return err
+				}
+			}
+
+			m, err := pdp.NewOfflinePDP(*policyFile)
+			if err != nil {
+				return err
+			}
+
+			return m.PolicyREPL(input)
+		},
+	}
+	policyCmd.Subcommands = append(policyCmd.Subcommands, policyReplCmd)
+
+	policyReplayFlags := ff.NewFlagSet("replay").SetParent(policyFlags)
+
+	var compareFile = policyReplayFlags.StringLong("compare", "", "candidate policy file to compare the decisions with")
+
+	policyReplayCmd := &ff.Command{
+		Name:      "replay",
+		Usage:     "domepdp policy replay [--policy FILE] [--compare FILE] INPUTS",
+		ShortHelp: "evaluate the recorded inputs of the decisions against the policy, and report the decisions changed by another one",
+		Flags:     policyReplayFlags,
+		Exec: func(ctx context.Context, args []string) error {
+
+			if len(args) != 1 {
+				return errl.Errorf("a single file with the recorded inputs must be specified")
+			}
+
+			logger := config.SetLogger(*debug, *nocolor)
+			defer logger.Close()
+
+			report, err := pdp.ReplayDecisions(*policyFile, *compareFile, args[0])
+			if err != nil {
+				return err
+			}
+
+			report.Print(os.Stdout)
+
+			return nil
+		},
+	}
+	policyCmd.Subcommands = append(policyCmd.Subcommands, policyReplayCmd)
+
 	// Parse the arguments and flags and select the proper command to execute
 	if err := rootCmd.Parse(args, ff.WithEnvVarPrefix("PDP")); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Command(rootCmd))
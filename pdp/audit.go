@@ -0,0 +1,534 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/hesusruiz/domeproxy/internal/errl"
+	"github.com/hesusruiz/domeproxy/internal/jpath"
+	"github.com/hesusruiz/domeproxy/internal/middleware"
+	"gitlab.com/greyxor/slogor"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// DefaultAuditRetention is the time the records of the decision audit log are kept, if not configured.
+const DefaultAuditRetention = 365 * 24 * time.Hour
+
+// The maximum number of records returned by a single query to the audit log
+const maxAuditQueryLimit = 1000
+
+// The number of records waiting to be written. When the writer falls behind and the queue is full,
+// new records are dropped, so writing the audit log never slows down the authorization of the requests.
+const auditQueueSize = 1024
+
+// How often the records older than the retention period are deleted
+const auditPurgeInterval = time.Hour
+
+// decisionaudit Table Schema
+//
+// The `decisionaudit` table keeps a record of every authorization decision taken by the PDP,
+// to prove who was allowed to do what. It is independent of the rotating log files.
+//
+// # Columns
+//
+// `created` `INTEGER` `NOT NULL`: The time of the decision, in Unix milliseconds.
+// `reqid` `TEXT`: The identifier of the HTTP request which triggered the decision.
+// `organization` `TEXT`: The organizationIdentifier of the mandator in the Access Token, if any.
+// `mandatee` `TEXT`: The id of the mandatee in the Access Token, if any.
+// `action` `TEXT`: The action requested (LIST, READ, CREATE, UPDATE or DELETE).
+// `resource` `TEXT`: The TMForum resource type of the object.
+// `tmfid` `TEXT`: The id of the TMForum object.
+// `policyhash` `TEXT`: The hex encoded SHA256 hash of the policy file which took the decision.
+// `allow` `INTEGER` `NOT NULL`: 1 if the request was allowed, 0 otherwise.
+// `reason` `TEXT`: The reason of the decision given by the policy, or the error evaluating it.
+// `rule` `TEXT`: The identifier of the rule which took the decision, if given by the policy.
+// `inputdigest` `TEXT` `NOT NULL`: The hex encoded SHA256 hash of the full input of the policy.
+// `input` `TEXT`: The input of the policy as JSON, with the personal data in the Access Token redacted.
+// It is only stored if the capture of the inputs is enabled, because it is much bigger than the rest of the record.
+const createDecisionAuditTableSQL = `
+CREATE TABLE IF NOT EXISTS decisionaudit (
+	"created" INTEGER NOT NULL,
+	"reqid" TEXT,
+	"organization" TEXT,
+	"mandatee" TEXT,
+	"action" TEXT,
+	"resource" TEXT,
+	"tmfid" TEXT,
+	"policyhash" TEXT,
+	"allow" INTEGER NOT NULL,
+	"reason" TEXT,
+	"rule" TEXT,
+	"inputdigest" TEXT NOT NULL,
+	"input" TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_decisionaudit_created ON decisionaudit (created);
+CREATE INDEX IF NOT EXISTS idx_decisionaudit_organization ON decisionaudit (organization, created);
+CREATE INDEX IF NOT EXISTS idx_decisionaudit_tmfid ON decisionaudit (tmfid, created);
+CREATE INDEX IF NOT EXISTS idx_decisionaudit_reqid ON decisionaudit (reqid);
+PRAGMA journal_mode = WAL;
+`
+
+const insertDecisionAuditSQL = `INSERT INTO decisionaudit (created, reqid, organization, mandatee, action, resource, tmfid, policyhash, allow, reason, rule, inputdigest, input) VALUES (:created, :reqid, :organization, :mandatee, :action, :resource, :tmfid, :policyhash, :allow, :reason, :rule, :inputdigest, NULLIF(:input, ''));`
+
+// AuditRecord is an authorization decision in the audit log.
+type AuditRecord struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Organization string    `json:"organization,omitempty"`
+	Mandatee     string    `json:"mandatee,omitempty"`
+	Action       string    `json:"action"`
+	Resource     string    `json:"resource"`
+	ObjectID     string    `json:"tmfid,omitempty"`
+	PolicyHash   string    `json:"policy_hash,omitempty"`
+	Allow        bool      `json:"allow"`
+	Reason       string    `json:"reason,omitempty"`
+	RuleID       string    `json:"rule_id,omitempty"`
+	InputDigest  string    `json:"input_digest"`
+
+	// The redacted input of the policy as JSON, which is only written if the capture of the inputs is enabled
+	input string
+}
+
+// AuditQuery are the criteria to select records from the audit log. Empty fields do not filter.
+type AuditQuery struct {
+	Organization string
+	ObjectID     string
+	From         time.Time
+	To           time.Time
+
+	// "allow" or "deny"
+	Outcome string
+
+	Limit  int
+	Offset int
+}
+
+// auditItem is a record to be written, or a request to be notified when the previous records are written.
+type auditItem struct {
+	record  *AuditRecord
+	flushed chan struct{}
+}
+
+// AuditLog is the persistent log of the authorization decisions, in SQLite.
+// Records are written in the background, in batches, to avoid slowing down the requests.
+type AuditLog struct {
+	dbpool    *sqlitex.Pool
+	retention time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan auditItem
+	done   chan struct{}
+
+	// The records not written because the queue was full
+	dropped atomic.Uint64
+
+	// Keep the redacted input of each decision, besides its digest
+	captureInputs bool
+}
+
+// NewAuditLog opens the audit log in the database file, creating the table if needed.
+// Records older than retention are deleted periodically, unless retention is zero.
+func NewAuditLog(dbname string, retention time.Duration) (*AuditLog, error) {
+
+	dbpool, err := sqlitex.NewPool(dbname, sqlitex.PoolOptions{
+		PoolSize: 4,
+	})
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+
+	conn, err := dbpool.Take(context.Background())
+	if err != nil {
+		dbpool.Close()
+		return nil, errl.Error(err)
+	}
+	err = sqlitex.ExecuteScript(conn, createDecisionAuditTableSQL, nil)
+	if err == nil {
+		err = addAuditInputColumn(conn)
+	}
+	dbpool.Put(conn)
+	if err != nil {
+		dbpool.Close()
+		return nil, errl.Errorf("creating audit log: %w", err)
+	}
+
+	a := &AuditLog{
+		dbpool:    dbpool,
+		retention: retention,
+		queue:     make(chan auditItem, auditQueueSize),
+		done:      make(chan struct{}),
+	}
+
+	go a.writer()
+
+	return a, nil
+}
+
+// addAuditInputColumn adds the column with the input to the tables created before it existed.
+func addAuditInputColumn(conn *sqlite.Conn) error {
+	found := false
+	err := sqlitex.Execute(conn, `SELECT name FROM pragma_table_info('decisionaudit') WHERE name = 'input';`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			found = true
+			return nil
+		},
+	})
+	if err != nil || found {
+		return err
+	}
+	return sqlitex.Execute(conn, `ALTER TABLE decisionaudit ADD COLUMN "input" TEXT;`, nil)
+}
+
+// Close writes the pending records and closes the database.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mu.Unlock()
+
+	<-a.done
+	return a.dbpool.Close()
+}
+
+// Flush waits until the records added before are written to the database.
+func (a *AuditLog) Flush() {
+	flushed := make(chan struct{})
+
+	a.mu.RLock()
+	if a.closed {
+		a.mu.RUnlock()
+		return
+	}
+	a.queue <- auditItem{flushed: flushed}
+	a.mu.RUnlock()
+
+	<-flushed
+}
+
+// add queues the record to be written. If the writer is behind and the queue is full, the record is dropped
+// and counted, instead of making the request wait.
+func (a *AuditLog) add(record *AuditRecord) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		slog.Error("PDP: decision not audited because the audit log is closed", "tmfid", record.ObjectID)
+		return
+	}
+
+	select {
+	case a.queue <- auditItem{record: record}:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// SetCaptureInputs enables keeping the redacted input of each decision, to load it later in the REPL.
+// It must be called before recording any decision.
+func (a *AuditLog) SetCaptureInputs(capture bool) {
+	a.captureInputs = capture
+}
+
+// Dropped returns the number of records which were not written because the writer was behind.
+func (a *AuditLog) Dropped() uint64 {
+	return a.dropped.Load()
+}
+
+// writer writes the queued records until the queue is closed, and purges the old records periodically.
+func (a *AuditLog) writer() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(auditPurgeInterval)
+	defer ticker.Stop()
+
+	a.purge()
+
+	// The records dropped since the last warning
+	var reportedDrops uint64
+
+	for {
+		select {
+		case item, ok := <-a.queue:
+			if !ok {
+				return
+			}
+
+			// Write together all the records already waiting
+			batch := []auditItem{item}
+		drain:
+			for len(batch) < auditQueueSize {
+				select {
+				case item, ok := <-a.queue:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, item)
+				default:
+					break drain
+				}
+			}
+
+			if err := a.write(batch); err != nil {
+				slog.Error("PDP: writing the decision audit log", slogor.Err(err), "records", len(batch))
+			}
+			if dropped := a.dropped.Load(); dropped > reportedDrops {
+				slog.Warn("PDP: decisions not audited because the audit log was behind", "records", dropped-reportedDrops, "total", dropped)
+				reportedDrops = dropped
+			}
+			for _, item := range batch {
+				if item.flushed != nil {
+					close(item.flushed)
+				}
+			}
+
+		case <-ticker.C:
+			a.purge()
+		}
+	}
+}
+
+func (a *AuditLog) write(batch []auditItem) (err error) {
+
+	conn, err := a.dbpool.Take(context.Background())
+	if err != nil {
+		return errl.Error(err)
+	}
+	defer a.dbpool.Put(conn)
+
+	release := sqlitex.Save(conn)
+	defer release(&err)
+
+	for _, item := range batch {
+		r := item.record
+		if r == nil {
+			continue
+		}
+		err = sqlitex.Execute(conn, insertDecisionAuditSQL, &sqlitex.ExecOptions{
+			Named: map[string]any{
+				":created":      r.Time.UnixMilli(),
+				":reqid":        r.RequestID,
+				":organization": r.Organization,
+				":mandatee":     r.Mandatee,
+				":action":       r.Action,
+				":resource":     r.Resource,
+				":tmfid":        r.ObjectID,
+				":policyhash":   r.PolicyHash,
+				":allow":        r.Allow,
+				":reason":       r.Reason,
+				":rule":         r.RuleID,
+				":inputdigest":  r.InputDigest,
+				":input":        r.input,
+			},
+		})
+		if err != nil {
+			return errl.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// purge deletes the records older than the retention period.
+func (a *AuditLog) purge() {
+	if a.retention <= 0 {
+		return
+	}
+
+	conn, err := a.dbpool.Take(context.Background())
+	if err != nil {
+		slog.Error("PDP: purging the decision audit log", slogor.Err(err))
+		return
+	}
+	defer a.dbpool.Put(conn)
+
+	limit := time.Now().Add(-a.retention).UnixMilli()
+	err = sqlitex.Execute(conn, `DELETE FROM decisionaudit WHERE created < ?;`, &sqlitex.ExecOptions{
+		Args: []any{limit},
+	})
+	if err != nil {
+		slog.Error("PDP: purging the decision audit log", slogor.Err(err))
+		return
+	}
+
+	if n := conn.Changes(); n > 0 {
+		slog.Info("PDP: old records deleted from the decision audit log", "records", n, "retention", a.retention)
+	}
+}
+
+// Query returns the records which satisfy the criteria, the most recent first.
+func (a *AuditLog) Query(q AuditQuery) ([]AuditRecord, error) {
+
+	var where []string
+	var args []any
+
+	if q.Organization != "" {
+		where = append(where, "organization = ?")
+		args = append(args, q.Organization)
+	}
+	if q.ObjectID != "" {
+		where = append(where, "tmfid = ?")
+		args = append(args, q.ObjectID)
+	}
+	if !q.From.IsZero() {
+		where = append(where, "created >= ?")
+		args = append(args, q.From.UnixMilli())
+	}
+	if !q.To.IsZero() {
+		where = append(where, "created < ?")
+		args = append(args, q.To.UnixMilli())
+	}
+	switch q.Outcome {
+	case "":
+	case "allow":
+		where = append(where, "allow = 1")
+	case "deny":
+		where = append(where, "allow = 0")
+	default:
+		return nil, errl.Errorf("invalid outcome '%s', must be 'allow' or 'deny'", q.Outcome)
+	}
+
+	limit := q.Limit
+	if limit <= 0 || limit > maxAuditQueryLimit {
+		limit = maxAuditQueryLimit
+	}
+
+	sql := `SELECT created, reqid, organization, mandatee, action, resource, tmfid, policyhash, allow, reason, rule, inputdigest FROM decisionaudit`
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+	sql += " ORDER BY created DESC LIMIT ? OFFSET ?;"
+	args = append(args, limit, max(q.Offset, 0))
+
+	conn, err := a.dbpool.Take(context.Background())
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+	defer a.dbpool.Put(conn)
+
+	var records []AuditRecord
+	err = sqlitex.Execute(conn, sql, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			records = append(records, AuditRecord{
+				Time:         time.UnixMilli(stmt.GetInt64("created")),
+				RequestID:    stmt.GetText("reqid"),
+				Organization: stmt.GetText("organization"),
+				Mandatee:     stmt.GetText("mandatee"),
+				Action:       stmt.GetText("action"),
+				Resource:     stmt.GetText("resource"),
+				ObjectID:     stmt.GetText("tmfid"),
+				PolicyHash:   stmt.GetText("policyhash"),
+				Allow:        stmt.GetInt64("allow") == 1,
+				Reason:       stmt.GetText("reason"),
+				RuleID:       stmt.GetText("rule"),
+				InputDigest:  stmt.GetText("inputdigest"),
+			})
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+
+	return records, nil
+}
+
+// Inputs returns the inputs of the decisions taken for the request with the given identifier, in the order
+// they were taken. LIST requests take a decision for each object. The personal data in the Access Token is redacted.
+func (a *AuditLog) Inputs(requestID string) ([]DecisionInput, error) {
+
+	conn, err := a.dbpool.Take(context.Background())
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+	defer a.dbpool.Put(conn)
+
+	var inputs []DecisionInput
+	err = sqlitex.Execute(conn, `SELECT input FROM decisionaudit WHERE reqid = ? AND input IS NOT NULL ORDER BY created, rowid;`, &sqlitex.ExecOptions{
+		Args: []any{requestID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			var in DecisionInput
+			if err := json.Unmarshal([]byte(stmt.GetText("input")), &in); err != nil {
+				return err
+			}
+			inputs = append(inputs, in)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+
+	return inputs, nil
+}
+
+// SetAuditLog sets the log where all the authorization decisions are recorded.
+func (m *PDP) SetAuditLog(audit *AuditLog) {
+	m.auditLog = audit
+}
+
+// AuditLog returns the log of authorization decisions, or nil if it is not configured.
+func (m *PDP) AuditLog() *AuditLog {
+	return m.auditLog
+}
+
+// audit records the decision in the audit log, if configured. The digest and the redacted copy of the input
+// are calculated before returning, because the caller may modify the input afterwards.
+func (m *PDP) audit(ctx context.Context, input StarTMFMap, decision *PolicyDecision) {
+	if m.auditLog == nil {
+		return
+	}
+
+	request, _ := input["request"].(StarTMFMap)
+	tmf, _ := input["tmf"].(StarTMFMap)
+	user, _ := input["user"].(StarTMFMap)
+	token, _ := input["token"].(StarTMFMap)
+
+	record := &AuditRecord{
+		Time:       time.Now(),
+		RequestID:  middleware.GetRequestIDFromContext(ctx),
+		Mandatee:   jpath.GetString(map[string]any(token), "vc.credentialSubject.mandate.mandatee.id"),
+		PolicyHash: decision.PolicyHash,
+		Allow:      decision.Allow,
+		Reason:     decision.Reason,
+		RuleID:     decision.RuleID,
+	}
+	record.Organization, _ = user["organizationIdentifier"].(string)
+	record.Action, _ = request["action"].(string)
+	record.Resource, _ = request["resource"].(string)
+	record.ObjectID, _ = tmf["id"].(string)
+
+	b, err := json.Marshal(input)
+	if err != nil {
+		slog.Warn("PDP: calculating the digest of the input for the audit log", slogor.Err(err))
+	} else {
+		digest := sha256.Sum256(b)
+		record.InputDigest = hex.EncodeToString(digest[:])
+	}
+
+	// If enabled, the input is kept to debug the decision later, without the personal data in the Access Token
+	if m.auditLog.captureInputs {
+		if b, err := json.Marshal(redactedDecisionInput(input)); err != nil {
+			slog.Warn("PDP: encoding the input for the audit log", slogor.Err(err))
+		} else {
+			record.input = string(b)
+		}
+	}
+
+	m.auditLog.add(record)
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+	policy := "def authorize():\n    return struct(allow=input.user.country == \"ES\", rule_id=\"country\")\n"
+	if err := os.WriteFile(policyFile, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	auditLog, err := NewAuditLog(filepath.Join(dir, "audit.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetAuditLog(auditLog)
+
+	request := StarTMFMap{"resource": "productOffering", "action": "READ"}
+	token := StarTMFMap{"vc": map[string]any{"credentialSubject": map[string]any{"mandate": map[string]any{
+		"mandatee": map[string]any{"id": "did:key:mandatee"},
+	}}}}
+
+	decide := func(org string, country string, id string) {
+		t.Helper()
+		user := StarTMFMap{"organizationIdentifier": org, "country": country}
+		tmfObject := StarTMFMap{"id": id}
+		takeDecision(context.Background(), m, request, token, tmfObject, user, nil)
+	}
+
+	decide("VATES-1", "ES", "urn:ngsi-ld:product-offering:1")
+	decide("VATES-1", "ES", "urn:ngsi-ld:product-offering:2")
+	decide("VATFR-2", "FR", "urn:ngsi-ld:product-offering:1")
+	auditLog.Flush()
+
+	records, err := auditLog.Query(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+	r := records[0]
+	if r.Organization != "VATFR-2" || r.Allow || r.RuleID != "country" || r.Mandatee != "did:key:mandatee" ||
+		r.Action != "READ" || r.Resource != "productOffering" || r.PolicyHash != fileDigest([]byte(policy)) || len(r.InputDigest) != 64 {
+		t.Errorf("unexpected record %+v", r)
+	}
+
+	tests := []struct {
+		query AuditQuery
+		want  int
+	}{
+		{AuditQuery{Organization: "VATES-1"}, 2},
+		{AuditQuery{ObjectID: "urn:ngsi-ld:product-offering:1"}, 2},
+		{AuditQuery{Outcome: "deny"}, 1},
+		{AuditQuery{Organization: "VATES-1", Outcome: "deny"}, 0},
+		{AuditQuery{From: time.Now().Add(time.Hour)}, 0},
+		{AuditQuery{To: time.Now().Add(time.Hour), Limit: 1}, 1},
+	}
+	for _, tt := range tests {
+		records, err := auditLog.Query(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != tt.want {
+			t.Errorf("query %+v: expected %d records, got %d", tt.query, tt.want, len(records))
+		}
+	}
+
+	if _, err := auditLog.Query(AuditQuery{Outcome: "maybe"}); err == nil {
+		t.Errorf("expected an error with an invalid outcome")
+	}
+
+	// Records older than the retention period are deleted
+	auditLog.add(&AuditRecord{Time: time.Now().Add(-48 * time.Hour), InputDigest: "old"})
+	auditLog.Flush()
+	auditLog.retention = 24 * time.Hour
+	auditLog.purge()
+
+	records, err = auditLog.Query(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Errorf("expected 3 records after purging, got %d", len(records))
+	}
+}
+
+func TestAuditLogDropsWhenBehind(t *testing.T) {
+
+	// A log whose writer is not running, so the queue is never emptied
+	a := &AuditLog{queue: make(chan auditItem, 2)}
+
+	for i := range 5 {
+		a.add(&AuditRecord{ObjectID: fmt.Sprint(i)})
+	}
+
+	if len(a.queue) != 2 {
+		t.Errorf("expected 2 queued records, got %d", len(a.queue))
+	}
+	if dropped := a.Dropped(); dropped != 3 {
+		t.Errorf("expected 3 dropped records, got %d", dropped)
+	}
+}
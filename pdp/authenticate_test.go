@@ -0,0 +1,73 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+
+	// Without an 'authenticate' function all callers are accepted
+	if err := os.WriteFile(policyFile, []byte("def authorize():\n    return True\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The policy receives the original request, not the request to the PDP
+	r := httptest.NewRequest("GET", "/authorize", nil)
+	r.Header.Set("X-Original-URI", "/catalog/productOffering")
+	r.Header.Set("X-Original-Method", "GET")
+	request, err := parseHTTPRequest(slog.Default(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := StarTMFMap{"iss": "did:web:untrusted.example"}
+	user := StarTMFMap{"isAuthenticated": true, "country": "ES"}
+
+	if err := m.authenticateCaller(context.Background(), request, token, user); err != nil {
+		t.Fatalf("caller rejected without an authenticate function: %v", err)
+	}
+
+	policy := `
+def authenticate():
+    if input.token.iss != "did:web:verifier.example":
+        return struct(allow=False, reason="untrusted issuer", rule_id="authn-01")
+    return input.request.path[0] == "catalog"
+
+def authorize():
+    return True
+`
+	if err := m.PutFile(policyFile, []byte(policy)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.authenticateCaller(context.Background(), request, token, user)
+	var denied *DeniedError
+	if !errors.As(err, &denied) {
+		t.Fatalf("expected the caller to be denied, got %v", err)
+	}
+	if denied.Decision.RuleID != "authn-01" || denied.Decision.Reason != "untrusted issuer" {
+		t.Errorf("unexpected decision %v", denied.Decision)
+	}
+
+	token["iss"] = "did:web:verifier.example"
+	if err := m.authenticateCaller(context.Background(), request, token, user); err != nil {
+		t.Errorf("trusted caller rejected: %v", err)
+	}
+}
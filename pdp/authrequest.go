@@ -0,0 +1,257 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hesusruiz/domeproxy/internal/errl"
+	"github.com/hesusruiz/domeproxy/tmfcache"
+	"gitlab.com/greyxor/slogor"
+)
+
+// ErrNotAuthenticated is returned when the operation requires an Access Token and the request does not
+// have one, or it is not valid.
+var ErrNotAuthenticated = errors.New("not authenticated")
+
+// The headers of the responses in the external authorization mode, which the PEP can forward upstream.
+// In NGINX they can be retrieved with 'auth_request_set $user_org $upstream_http_x_user_org;'
+const (
+	HeaderDecision       = "X-Decision"
+	HeaderDecisionReason = "X-Decision-Reason"
+	HeaderDecisionRule   = "X-Decision-Rule"
+	HeaderUserOrg        = "X-User-Org"
+	HeaderUserCountry    = "X-User-Country"
+)
+
+// originalTarget is the TMF operation requested in the original request received by the PEP.
+type originalTarget struct {
+	api      string
+	resource string
+	id       string
+	action   string
+	method   string
+}
+
+// parseOriginalTarget determines the TMF API, resource, id and action of the original request, using the
+// X-Original-URI and X-Original-Method headers. The paths can have the standard TMForum structure
+// "/tmf-api/{api}/{version}/{resource}/{id}" or the short DOME one "/{api}/{resource}/{id}".
+func parseOriginalTarget(r *http.Request) (*originalTarget, error) {
+
+	requestURI := r.Header.Get("X-Original-URI")
+	if len(requestURI) == 0 {
+		return nil, errl.Errorf("X-Original-URI missing")
+	}
+	reqURL, err := url.ParseRequestURI(requestURI)
+	if err != nil {
+		return nil, errl.Errorf("X-Original-URI (%s) invalid: %w", requestURI, err)
+	}
+
+	method := strings.ToUpper(r.Header.Get("X-Original-Method"))
+	if len(method) == 0 {
+		return nil, errl.Errorf("X-Original-Method missing")
+	}
+
+	parts := strings.Split(strings.Trim(reqURL.Path, "/"), "/")
+
+	target := &originalTarget{method: method}
+	switch {
+	case parts[0] == "tmf-api" && len(parts) >= 4 && len(parts) <= 5:
+		target.api, target.resource = parts[1], parts[3]
+		if len(parts) == 5 {
+			target.id = parts[4]
+		}
+	case parts[0] != "tmf-api" && len(parts) >= 2 && len(parts) <= 3:
+		target.api, target.resource = parts[0], parts[1]
+		if len(parts) == 3 {
+			target.id = parts[2]
+		}
+	default:
+		return nil, errl.Errorf("X-Original-URI is not a TMForum API path: %s", requestURI)
+	}
+
+	switch {
+	case method == "GET" && target.id == "":
+		target.action = "LIST"
+	case method == "GET":
+		target.action = "READ"
+	case method == "POST" && target.id == "":
+		target.action = "CREATE"
+	case (method == "PATCH" || method == "PUT") && target.id != "":
+		target.action = "UPDATE"
+	case method == "DELETE" && target.id != "":
+		target.action = "DELETE"
+	default:
+		return nil, errl.Errorf("method %s not supported for %s", method, reqURL.Path)
+	}
+
+	return target, nil
+}
+
+// AuthorizeExternal takes the authorization decision for the original request received by an external PEP,
+// like NGINX with the auth_request module, which sends to the PDP only the headers of the original request.
+//
+// As the body of the original request is not available, CREATE is decided without the new object, and
+// UPDATE and DELETE with the object stored in the local cache. LIST is decided without any object, because
+// the objects returned by the upstream server can not be filtered.
+//
+// The returned user is never nil, so the caller can send its info upstream. An error wrapping
+// ErrNotAuthenticated is returned when the operation requires a valid Access Token.
+func AuthorizeExternal(
+	logger *slog.Logger, tmf *tmfcache.TMFCache, ruleEngine *PDP, r *http.Request,
+) (decision *PolicyDecision, user StarTMFMap, err error) {
+
+	user = StarTMFMap{}
+
+	target, err := parseOriginalTarget(r)
+	if err != nil {
+		return nil, user, err
+	}
+
+	// The operation is always derived from the original URI and method
+	r.Header.Set("X-Original-Operation", target.action)
+
+	requestArgument, err := parseHTTPRequest(logger, r)
+	if err != nil {
+		return nil, user, errl.Error(err)
+	}
+	requestArgument["api"] = target.api
+	requestArgument["resource"] = target.resource
+	requestArgument["id"] = target.id
+
+	tokString, tokenArgument, userArgument, err := extractCallerInfo(logger, tmf, ruleEngine, r, requestArgument)
+	if err != nil {
+		// A caller with a valid token rejected by the 'authenticate' function of the policy is forbidden
+		var denied *DeniedError
+		if errors.As(err, &denied) && denied.Decision != nil {
+			return denied.Decision, StarTMFMap{"isAuthenticated": true}, nil
+		}
+		return nil, user, errl.Errorf("%w: %w", ErrNotAuthenticated, err)
+	}
+	user = userArgument
+
+	// We do not allow modifications without authorization info
+	if len(tokString) == 0 && target.action != "LIST" && target.action != "READ" {
+		return nil, user, errl.Error(ErrNotAuthenticated)
+	}
+
+	var tmfObjectArgument StarTMFMap
+	var objectHash []byte
+
+	switch target.action {
+	case "LIST", "CREATE":
+		tmfObjectArgument = StarTMFMap{"resource": target.resource}
+
+	case "READ":
+		ro, _, err := tmf.RetrieveOrUpdateObject(nil, target.id, target.resource, "", "", "", tmfcache.LocalOrRemote)
+		if err != nil {
+			return nil, user, errl.Errorf("retrieving %s: %w", target.id, err)
+		}
+		tmfObject, _ := ro.(*tmfcache.TMFGeneralObject)
+
+		objectHash = tmfObject.Hash()
+		tmfObjectArgument = readObjectArguments(tmfObject, userArgument)
+
+	case "UPDATE", "DELETE":
+		ro, found, err := tmf.LocalRetrieveTMFObject(nil, target.id, target.resource, "")
+		if err != nil {
+			return nil, user, errl.Errorf("retrieving from cache %s: %w", target.id, err)
+		}
+		if !found {
+			return nil, user, errl.Errorf("object not found in local database: %s", target.id)
+		}
+		tmfObject, _ := ro.(*tmfcache.TMFGeneralObject)
+
+		userOrgId, _ := userArgument["organizationIdentifier"].(string)
+		if !isObjectOwner(userOrgId, tmfObject) {
+			return &PolicyDecision{Allow: false, Reason: "the user is not the owner of the object"}, user, nil
+		}
+
+		tmfObjectArgument = readObjectArguments(tmfObject, userArgument)
+	}
+
+	decision = takeDecision(r.Context(), ruleEngine, requestArgument, tokenArgument, tmfObjectArgument, userArgument, objectHash)
+
+	return decision, user, nil
+}
+
+// HandleGETAuthorization returns an [http.Handler] which asks for an authorization decision from the PDP
+// by evaluation of the proper policy rules, for an external PEP like NGINX with the auth_request module.
+// The original request is described by the X-Original-URI and X-Original-Method headers, and
+// the Access Token is in the Authorization header as in the original request.
+//
+// The reply is 200 if the request is authorized, 401 if the caller is not authenticated (or was denied
+// without being authenticated) and 403 if the caller was denied. The decision and the user info are
+// sent in response headers, so the PEP can forward them upstream.
+// The parameter tmf should be an already instantiated [TMFCache] database manager.
+// It also expects in ruleEngine an instance of a policy engine.
+func HandleGETAuthorization(
+	logger *slog.Logger,
+	tmf *tmfcache.TMFCache,
+	ruleEngine *PDP,
+) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		decision, user, err := AuthorizeExternal(logger, tmf, ruleEngine, r)
+		if err != nil {
+			slog.Error("forbidden", slogor.Err(err), "URI", r.Header.Get("X-Original-URI"))
+		}
+
+		status := setDecisionHeaders(w, decision, user, err)
+
+		// The user is granted access to the object if the status is 200
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write([]byte(http.StatusText(status)))
+	}
+}
+
+// setDecisionHeaders sets the response headers with the decision and the user info, so the PEP can
+// forward them upstream, and returns the HTTP status for the decision: 200 if the request is authorized,
+// 401 if the caller is not authenticated (or was denied without being authenticated) and 403 otherwise.
+func setDecisionHeaders(w http.ResponseWriter, decision *PolicyDecision, user StarTMFMap, err error) int {
+
+	if org, _ := user["organizationIdentifier"].(string); org != "" {
+		w.Header().Set(HeaderUserOrg, org)
+	}
+	if country, _ := user["country"].(string); country != "" {
+		w.Header().Set(HeaderUserCountry, country)
+	}
+	authenticated, _ := user["isAuthenticated"].(bool)
+
+	status := http.StatusOK
+	switch {
+	case err != nil:
+		w.Header().Set(HeaderDecision, "deny")
+		w.Header().Set(HeaderDecisionReason, err.Error())
+		status = http.StatusForbidden
+		if errors.Is(err, ErrNotAuthenticated) {
+			status = http.StatusUnauthorized
+		}
+
+	default:
+		w.Header().Set(HeaderDecisionReason, decision.Reason)
+		w.Header().Set(HeaderDecisionRule, decision.RuleID)
+		if decision.Allow {
+			w.Header().Set(HeaderDecision, "allow")
+			break
+		}
+		w.Header().Set(HeaderDecision, "deny")
+		status = http.StatusForbidden
+		if !authenticated {
+			status = http.StatusUnauthorized
+		}
+	}
+
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+
+	return status
+}
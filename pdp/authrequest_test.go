@@ -0,0 +1,213 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+	conf "github.com/hesusruiz/domeproxy/config"
+	"github.com/hesusruiz/domeproxy/tmfcache"
+)
+
+// nginxSubrequestHeaders reads the sample NGINX configuration and returns the headers that NGINX sets
+// in the auth_request subrequest to the PDP, with the names of the NGINX variables for their values.
+func nginxSubrequestHeaders(t *testing.T, fileName string) map[string]string {
+	t.Helper()
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	headers := map[string]string{}
+	inAuthLocation := false
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";"))
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "location":
+			inAuthLocation = fields[len(fields)-2] == "/_pdp_authz"
+		case inAuthLocation && fields[0] == "proxy_set_header" && len(fields) == 3 && strings.HasPrefix(fields[2], "$"):
+			headers[fields[1]] = fields[2]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return headers
+}
+
+// newExternalAuthzFixture returns a PDP and a TMF cache with some product offerings, and a valid Access Token
+// of an organization which owns some of them, for testing the external authorization modes.
+func newExternalAuthzFixture(t *testing.T) (m *PDP, tmf *tmfcache.TMFCache, tokString string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+	policy := `
+def authorize():
+    action = input.request.action
+    if action == "LIST":
+        return True
+    if action == "READ":
+        return struct(allow=input.tmf.lifecycleStatus == "Launched", reason="only launched objects are public", rule_id="read")
+    if action == "CREATE":
+        return struct(allow=input.user.isLEAR, reason="only LEARs can create objects", rule_id="create")
+    return input.user.isOwner
+`
+	if err := os.WriteFile(policyFile, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verificationKey := func(config *conf.Config) (*jose.JSONWebKey, error) {
+		return &jose.JSONWebKey{Key: &privateKey.PublicKey, Algorithm: "ES256"}, nil
+	}
+
+	m, err = NewPDP(&conf.Config{PolicyFileName: policyFile}, nil, verificationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmf, err = tmfcache.NewTMFCache(&conf.Config{Dbname: filepath.Join(dir, "tmf.db")}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tmf.Close)
+
+	// All objects are served from the local cache, without accessing the upstream server
+	tmf.Maxfreshness = math.MaxInt
+
+	for i, status := range []string{"Launched", "Retired", "Launched"} {
+		id := fmt.Sprintf("urn:ngsi-ld:product-offering:%04d", i)
+		seller := "did:elsi:VATES-1"
+		if i == 2 {
+			seller = "did:elsi:VATFR-2"
+		}
+		content := fmt.Sprintf(`{"id": %q, "href": %q, "@type": "productOffering", "lifecycleStatus": %q,
+			"lastUpdate": "2025-01-01T00:00:00Z", "relatedParty": [{"role": "Seller", "partyOrPartyRole": {"@type": "PartyRef", "id": %q, "name": %q}}]}`,
+			id, id, status, seller, seller)
+		o, err := tmfcache.TMFObjectFromBytes([]byte(content), "productOffering")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tmf.LocalUpsertTMFObject(nil, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claims := jwt.MapClaims{"vc": map[string]any{"credentialSubject": map[string]any{"mandate": map[string]any{
+		"mandator": map[string]any{"organizationIdentifier": "did:elsi:VATES-1", "country": "ES", "organization": "Seller"},
+		"mandatee": map[string]any{"id": "did:key:mandatee"},
+	}}}}
+	tokString, err = jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The organization of the caller is already known, so it is not created in the upstream server
+	org, err := tmfcache.TMFOrganizationFromToken(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tmf.LocalUpsertTMFObject(nil, org); err != nil {
+		t.Fatal(err)
+	}
+
+	return m, tmf, tokString
+}
+
+func TestHandleGETAuthorization(t *testing.T) {
+
+	m, tmf, tokString := newExternalAuthzFixture(t)
+
+	handler := HandleGETAuthorization(slog.Default(), tmf, m)
+	headers := nginxSubrequestHeaders(t, filepath.Join("testdata", "nginx_auth_request.conf"))
+	if len(headers) == 0 {
+		t.Fatal("no headers for the auth_request subrequest in the NGINX configuration")
+	}
+
+	const prefix = "/tmf-api/productCatalogManagement/v4/productOffering"
+
+	tests := []struct {
+		name          string
+		method        string
+		uri           string
+		authorization string
+		status        int
+		userOrg       string
+		reason        string
+	}{
+		{"anonymous list", "GET", prefix + "?lifecycleStatus=Launched", "", http.StatusOK, "", ""},
+		{"anonymous read launched", "GET", prefix + "/urn:ngsi-ld:product-offering:0000", "", http.StatusOK, "", ""},
+		{"anonymous read retired", "GET", prefix + "/urn:ngsi-ld:product-offering:0001", "", http.StatusUnauthorized, "", "only launched objects are public"},
+		{"anonymous update", "PATCH", prefix + "/urn:ngsi-ld:product-offering:0000", "", http.StatusUnauthorized, "", "not authenticated"},
+		{"invalid token", "GET", prefix, "Bearer invalid", http.StatusUnauthorized, "", ""},
+		{"create without powers", "POST", prefix, "Bearer " + tokString, http.StatusForbidden, "did:elsi:VATES-1", "only LEARs can create objects"},
+		{"update own object", "PATCH", prefix + "/urn:ngsi-ld:product-offering:0000", "Bearer " + tokString, http.StatusOK, "did:elsi:VATES-1", ""},
+		{"update other object", "PATCH", prefix + "/urn:ngsi-ld:product-offering:0002", "Bearer " + tokString, http.StatusForbidden, "did:elsi:VATES-1", "the user is not the owner of the object"},
+		{"delete own object", "DELETE", prefix + "/urn:ngsi-ld:product-offering:0000", "Bearer " + tokString, http.StatusOK, "did:elsi:VATES-1", ""},
+		{"not a TMF path", "GET", "/index.html", "", http.StatusForbidden, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// The variables available to NGINX when it receives the original request
+			variables := map[string]string{
+				"$request_uri":        tt.uri,
+				"$request_method":     tt.method,
+				"$host":               "dome-marketplace.example",
+				"$remote_addr":        "192.0.2.1",
+				"$http_authorization": tt.authorization,
+			}
+
+			// The subrequest keeps the method of the original request, but it does not have a body
+			r := httptest.NewRequest(tt.method, "/authorize/v1/policies/authz", nil)
+			for name, variable := range headers {
+				if value := variables[variable]; value != "" {
+					r.Header.Set(name, value)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d (reason: %s)", tt.status, w.Code, w.Header().Get(HeaderDecisionReason))
+			}
+			if got := w.Header().Get(HeaderUserOrg); got != tt.userOrg {
+				t.Errorf("expected %s '%s', got '%s'", HeaderUserOrg, tt.userOrg, got)
+			}
+			if tt.reason != "" && !strings.Contains(w.Header().Get(HeaderDecisionReason), tt.reason) {
+				t.Errorf("expected %s '%s', got '%s'", HeaderDecisionReason, tt.reason, w.Header().Get(HeaderDecisionReason))
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("missing WWW-Authenticate header")
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	conf "github.com/hesusruiz/domeproxy/config"
+	"github.com/hesusruiz/domeproxy/internal/errl"
+	"github.com/hesusruiz/domeproxy/tmfcache"
+)
+
+// The paths of the OpenID AuthZEN Authorization API endpoints.
+const (
+	AuthZENEvaluationPath  = "/access/v1/evaluation"
+	AuthZENEvaluationsPath = "/access/v1/evaluations"
+	AuthZENMetadataPath    = "/.well-known/authzen-configuration"
+)
+
+// ErrAuthZENCaller is returned when the caller of the AuthZEN API does not present the shared secret.
+var ErrAuthZENCaller = fmt.Errorf("caller of the AuthZEN API not authenticated")
+
+// The semantics of a request with several evaluations, as defined by AuthZEN.
+const (
+	authzenExecuteAll          = "execute_all"
+	authzenDenyOnFirstDeny     = "deny_on_first_deny"
+	authzenPermitOnFirstPermit = "permit_on_first_permit"
+)
+
+// AuthZENSubject is the subject of an AuthZEN evaluation. In DOME the subject is an organization, identified
+// by its DID (e.g. 'did:elsi:VATES-12345678'). The properties can include the 'country' of the organization and
+// the 'powers' of the LEARCredential of the caller, with the same structure as in the credential.
+// An empty id represents an anonymous caller.
+type AuthZENSubject struct {
+	Type       string         `json:"type"`
+	ID         string         `json:"id"`
+	Properties map[string]any `json:"properties,omitempty"`
+}
+
+// AuthZENAction is the action of an AuthZEN evaluation. The name is one of the TMF actions ('READ', 'LIST',
+// 'CREATE', 'UPDATE' or 'DELETE'), in any case and optionally with the 'can_' prefix used by AuthZEN.
+type AuthZENAction struct {
+	Name       string         `json:"name"`
+	Properties map[string]any `json:"properties,omitempty"`
+}
+
+// AuthZENResource is the resource of an AuthZEN evaluation: the TMF resource type (e.g. 'productOffering')
+// and the id of the object. The type is derived from the id if not specified.
+type AuthZENResource struct {
+	Type       string         `json:"type"`
+	ID         string         `json:"id,omitempty"`
+	Properties map[string]any `json:"properties,omitempty"`
+}
+
+// AuthZENEvaluation is an access evaluation request. The 'host' and 'remote_addr' members of the
+// context are passed to the policy in the request object.
+type AuthZENEvaluation struct {
+	Subject  *AuthZENSubject  `json:"subject,omitempty"`
+	Action   *AuthZENAction   `json:"action,omitempty"`
+	Resource *AuthZENResource `json:"resource,omitempty"`
+	Context  map[string]any   `json:"context,omitempty"`
+}
+
+// AuthZENEvaluations is a request with several access evaluations. The subject, action, resource and context
+// of the request are the defaults for the evaluations which do not specify them.
+type AuthZENEvaluations struct {
+	AuthZENEvaluation
+	Evaluations []AuthZENEvaluation `json:"evaluations"`
+	Options     map[string]any      `json:"options,omitempty"`
+}
+
+// AuthZENDecision is the response to an access evaluation. The context has the id of the rule
+// which took the decision and the reason for the decision.
+type AuthZENDecision struct {
+	Decision bool           `json:"decision"`
+	Context  map[string]any `json:"context,omitempty"`
+}
+
+// ReadAuthZENSecret reads the shared secret of the callers of the AuthZEN API from a file.
+func ReadAuthZENSecret(fileName string) (string, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return "", errl.Errorf("reading AuthZEN secret file: %w", err)
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", errl.Errorf("empty AuthZEN secret file: %s", fileName)
+	}
+	return secret, nil
+}
+
+// AuthenticateAuthZENCaller checks that the caller of the AuthZEN API presents the shared secret
+// as a Bearer token in the Authorization header.
+func AuthenticateAuthZENCaller(r *http.Request, secret string) error {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || secret == "" || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(secret)) != 1 {
+		return ErrAuthZENCaller
+	}
+	return nil
+}
+
+// AuthZENMetadata returns the AuthZEN PDP metadata document, for a PDP served at baseURL.
+func AuthZENMetadata(baseURL string) map[string]any {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	return map[string]any{
+		"policy_decision_point":       baseURL,
+		"access_evaluation_endpoint":  baseURL + AuthZENEvaluationPath,
+		"access_evaluations_endpoint": baseURL + AuthZENEvaluationsPath,
+	}
+}
+
+// EvaluateAccess takes the authorization decision for an AuthZEN access evaluation request.
+//
+// The subject is not authenticated by the PDP, so this API is intended for trusted DOME components which have
+// already authenticated the caller, and which authenticate themselves with [AuthenticateAuthZENCaller]. The subject is presented to the policy as if it came in an Access Token,
+// and the arguments to the policy are built in the same way as for the rest of authorization requests.
+func EvaluateAccess(ctx context.Context, tmf *tmfcache.TMFCache, ruleEngine *PDP, evaluation AuthZENEvaluation) AuthZENDecision {
+	retrieve := func(action string, resource string, id string) (*tmfcache.TMFGeneralObject, error) {
+		return retrieveObject(tmf, action, resource, id)
+	}
+	return evaluateAuthZEN(ctx, ruleEngine, evaluation, retrieve)
+}
+
+// EvaluateAccessBatch takes the decisions for the evaluations of an AuthZEN request, which are returned
+// in the same order. Depending on the 'evaluations_semantic' option, the evaluation stops at the first
+// deny or permit decision, and the response only includes the decisions taken.
+func EvaluateAccessBatch(ctx context.Context, tmf *tmfcache.TMFCache, ruleEngine *PDP, request AuthZENEvaluations) ([]AuthZENDecision, error) {
+
+	if len(request.Evaluations) > MaxBatchItems {
+		return nil, errl.Errorf("too many evaluations: %d (maximum is %d)", len(request.Evaluations), MaxBatchItems)
+	}
+
+	semantic := authzenExecuteAll
+	if s, ok := request.Options["evaluations_semantic"].(string); ok {
+		semantic = s
+	}
+	if semantic != authzenExecuteAll && semantic != authzenDenyOnFirstDeny && semantic != authzenPermitOnFirstPermit {
+		return nil, errl.Errorf("invalid evaluations_semantic: %s", semantic)
+	}
+
+	// A request without evaluations is a single evaluation
+	if len(request.Evaluations) == 0 {
+		return []AuthZENDecision{EvaluateAccess(ctx, tmf, ruleEngine, request.AuthZENEvaluation)}, nil
+	}
+
+	decisions := make([]AuthZENDecision, 0, len(request.Evaluations))
+	for _, evaluation := range request.Evaluations {
+
+		// Use the defaults of the request for the missing elements
+		if evaluation.Subject == nil {
+			evaluation.Subject = request.Subject
+		}
+		if evaluation.Action == nil {
+			evaluation.Action = request.Action
+		}
+		if evaluation.Resource == nil {
+			evaluation.Resource = request.Resource
+		}
+		if evaluation.Context == nil {
+			evaluation.Context = request.Context
+		}
+
+		decision := EvaluateAccess(ctx, tmf, ruleEngine, evaluation)
+		decisions = append(decisions, decision)
+
+		if (semantic == authzenDenyOnFirstDeny && !decision.Decision) ||
+			(semantic == authzenPermitOnFirstPermit && decision.Decision) {
+			break
+		}
+	}
+
+	return decisions, nil
+}
+
+// authzenDeny returns a deny decision with the reason in the context.
+func authzenDeny(ruleID string, reason string) AuthZENDecision {
+	decision := AuthZENDecision{Context: map[string]any{"reason_admin": map[string]any{"en": reason}}}
+	if ruleID != "" {
+		decision.Context["id"] = ruleID
+	}
+	return decision
+}
+
+// authzenAction returns the TMF action and the equivalent HTTP method of an AuthZEN action name.
+func authzenAction(name string) (action string, method string, err error) {
+
+	action = strings.ToUpper(strings.TrimPrefix(strings.ToLower(name), "can_"))
+	switch action {
+	case "READ", "LIST":
+		return action, "GET", nil
+	case "CREATE":
+		return action, "POST", nil
+	case "UPDATE":
+		return action, "PATCH", nil
+	case "DELETE":
+		return action, "DELETE", nil
+	default:
+		return "", "", fmt.Errorf("invalid action '%s'", name)
+	}
+}
+
+// authzenCaller builds the token and user arguments to the policy from an AuthZEN subject. The token has
+// the same structure as the one of an Access Token with a LEARCredential, so the policies do not need to
+// distinguish between both cases.
+func authzenCaller(subject *AuthZENSubject) (tokenArgument StarTMFMap, userArgument StarTMFMap) {
+
+	userArgument = StarTMFMap{
+		"isAuthenticated":        false,
+		"isLEAR":                 false,
+		"isOwner":                false,
+		"country":                "",
+		"organizationIdentifier": "",
+	}
+
+	if subject == nil || subject.ID == "" {
+		return StarTMFMap{}, userArgument
+	}
+
+	country, _ := subject.Properties["country"].(string)
+	powers, _ := subject.Properties["powers"].([]any)
+	if powers == nil {
+		powers = []any{}
+	}
+
+	userArgument["isAuthenticated"] = true
+	userArgument["organizationIdentifier"] = subject.ID
+	userArgument["country"] = country
+	for _, p := range powers {
+		if isLEARPower(p) {
+			userArgument["isLEAR"] = true
+		}
+	}
+
+	mandate := map[string]any{
+		"mandator": map[string]any{
+			"organizationIdentifier": subject.ID,
+			"country":                country,
+		},
+		"power": powers,
+	}
+	if mandatee, ok := subject.Properties["mandatee"].(map[string]any); ok {
+		mandate["mandatee"] = mandatee
+	}
+
+	tokenArgument = StarTMFMap{
+		"vc": map[string]any{
+			"credentialSubject": map[string]any{
+				"mandate": mandate,
+			},
+		},
+	}
+
+	return tokenArgument, userArgument
+}
+
+func evaluateAuthZEN(
+	ctx context.Context,
+	ruleEngine *PDP,
+	evaluation AuthZENEvaluation,
+	retrieve func(action string, resource string, id string) (*tmfcache.TMFGeneralObject, error),
+) AuthZENDecision {
+
+	if evaluation.Action == nil || evaluation.Resource == nil {
+		return authzenDeny("", "missing action or resource")
+	}
+
+	action, method, err := authzenAction(evaluation.Action.Name)
+	if err != nil {
+		return authzenDeny("", err.Error())
+	}
+
+	resource := evaluation.Resource.Type
+	id := evaluation.Resource.ID
+	if resource == "" && id != "" {
+		resource, err = conf.FromIdToResourceType(id)
+		if err != nil {
+			return authzenDeny("", err.Error())
+		}
+	}
+	if resource == "" {
+		return authzenDeny("", "missing resource type")
+	}
+
+	tokenArgument, userArgument := authzenCaller(evaluation.Subject)
+
+	host, _ := evaluation.Context["host"].(string)
+	remoteAddr, _ := evaluation.Context["remote_addr"].(string)
+
+	requestArgument := StarTMFMap{
+		"action":      action,
+		"method":      method,
+		"host":        host,
+		"remote_addr": remoteAddr,
+		"query":       StarTMFMap{},
+		"resource":    resource,
+		"id":          id,
+	}
+
+	var tmfObjectArgument StarTMFMap
+	var objectHash []byte
+
+	switch action {
+	case "LIST", "CREATE":
+		tmfObjectArgument = StarTMFMap{"resource": resource}
+
+	default:
+		if id == "" {
+			return authzenDeny("", "missing resource id")
+		}
+
+		// We do not allow modifications without authorization info
+		if action != "READ" && (evaluation.Subject == nil || evaluation.Subject.ID == "") {
+			return authzenDeny("", "not authenticated")
+		}
+
+		tmfObject, err := retrieve(action, resource, id)
+		if err != nil {
+			return authzenDeny("", fmt.Sprintf("retrieving %s: %s", id, err))
+		}
+
+		userOrgId, _ := userArgument["organizationIdentifier"].(string)
+		if action != "READ" && !isObjectOwner(userOrgId, tmfObject) {
+			return authzenDeny("", "the user is not the owner of the object")
+		}
+
+		// Only the decisions for reading the stored object can be cached
+		if action == "READ" {
+			objectHash = tmfObject.Hash()
+		}
+
+		tmfObjectArgument = readObjectArguments(tmfObject, userArgument)
+	}
+
+	decision := takeDecision(ctx, ruleEngine, requestArgument, tokenArgument, tmfObjectArgument, userArgument, objectHash)
+	if !decision.Allow {
+		return authzenDeny(decision.RuleID, decision.Reason)
+	}
+
+	result := AuthZENDecision{Decision: true}
+	if decision.RuleID != "" {
+		result.Context = map[string]any{"id": decision.RuleID}
+	}
+	return result
+}
@@ -0,0 +1,143 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEvaluateAccess(t *testing.T) {
+
+	m, tmf, _ := newExternalAuthzFixture(t)
+	ctx := context.Background()
+
+	seller := &AuthZENSubject{Type: "organization", ID: "did:elsi:VATES-1", Properties: map[string]any{"country": "ES"}}
+	lear := &AuthZENSubject{Type: "organization", ID: "did:elsi:VATES-1", Properties: map[string]any{
+		"country": "ES",
+		"powers":  []any{map[string]any{"type": "Domain", "domain": "DOME", "function": "Onboarding", "action": "Execute"}},
+	}}
+
+	tests := []struct {
+		name     string
+		subject  *AuthZENSubject
+		action   string
+		resource AuthZENResource
+		want     bool
+		ruleID   string
+	}{
+		{"anonymous list", nil, "can_list", AuthZENResource{Type: "productOffering"}, true, ""},
+		{"anonymous read launched", nil, "can_read", AuthZENResource{ID: "urn:ngsi-ld:product-offering:0000"}, true, "read"},
+		{"anonymous read retired", nil, "READ", AuthZENResource{Type: "productOffering", ID: "urn:ngsi-ld:product-offering:0001"}, false, "read"},
+		{"create without powers", seller, "can_create", AuthZENResource{Type: "productOffering"}, false, "create"},
+		{"create as LEAR", lear, "can_create", AuthZENResource{Type: "productOffering"}, true, "create"},
+		{"anonymous update", nil, "can_update", AuthZENResource{ID: "urn:ngsi-ld:product-offering:0000"}, false, ""},
+		{"update own object", seller, "can_update", AuthZENResource{ID: "urn:ngsi-ld:product-offering:0000"}, true, ""},
+		{"update other object", seller, "can_update", AuthZENResource{ID: "urn:ngsi-ld:product-offering:0002"}, false, ""},
+		{"invalid action", seller, "can_fly", AuthZENResource{Type: "productOffering"}, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evaluation := AuthZENEvaluation{
+				Subject:  tt.subject,
+				Action:   &AuthZENAction{Name: tt.action},
+				Resource: &tt.resource,
+			}
+
+			decision := EvaluateAccess(ctx, tmf, m, evaluation)
+			if decision.Decision != tt.want {
+				t.Fatalf("expected decision %v, got %v (context: %v)", tt.want, decision.Decision, decision.Context)
+			}
+			if id, _ := decision.Context["id"].(string); id != tt.ruleID {
+				t.Errorf("expected rule '%s', got '%s'", tt.ruleID, id)
+			}
+			if !decision.Decision && decision.Context["reason_admin"] == nil {
+				t.Errorf("deny decision without reason")
+			}
+		})
+	}
+
+	// The evaluations inherit the subject, action and resource of the request
+	request := AuthZENEvaluations{
+		AuthZENEvaluation: AuthZENEvaluation{
+			Subject: seller,
+			Action:  &AuthZENAction{Name: "can_update"},
+		},
+		Evaluations: []AuthZENEvaluation{
+			{Resource: &AuthZENResource{ID: "urn:ngsi-ld:product-offering:0000"}},
+			{Resource: &AuthZENResource{ID: "urn:ngsi-ld:product-offering:0002"}},
+			{Resource: &AuthZENResource{ID: "urn:ngsi-ld:product-offering:0000"}, Action: &AuthZENAction{Name: "can_read"}},
+		},
+	}
+
+	semantics := []struct {
+		semantic string
+		want     []bool
+	}{
+		{"", []bool{true, false, true}},
+		{"execute_all", []bool{true, false, true}},
+		{"deny_on_first_deny", []bool{true, false}},
+		{"permit_on_first_permit", []bool{true}},
+	}
+	for _, s := range semantics {
+		request.Options = nil
+		if s.semantic != "" {
+			request.Options = map[string]any{"evaluations_semantic": s.semantic}
+		}
+
+		decisions, err := EvaluateAccessBatch(ctx, tmf, m, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decisions) != len(s.want) {
+			t.Fatalf("%s: expected %d decisions, got %d", s.semantic, len(s.want), len(decisions))
+		}
+		for i, d := range decisions {
+			if d.Decision != s.want[i] {
+				t.Errorf("%s: decision %d: expected %v, got %v", s.semantic, i, s.want[i], d.Decision)
+			}
+		}
+	}
+
+	request.Options = map[string]any{"evaluations_semantic": "whatever"}
+	if _, err := EvaluateAccessBatch(ctx, tmf, m, request); err == nil {
+		t.Errorf("expected an error with an invalid evaluations_semantic")
+	}
+
+	metadata := AuthZENMetadata("https://pdp.dome-marketplace.eu/")
+	if metadata["access_evaluation_endpoint"] != "https://pdp.dome-marketplace.eu/access/v1/evaluation" {
+		t.Errorf("unexpected metadata %v", metadata)
+	}
+}
+
+func TestAuthenticateAuthZENCaller(t *testing.T) {
+
+	const secret = "s3cr3t"
+
+	tests := []struct {
+		authorization string
+		secret        string
+		want          error
+	}{
+		{"Bearer s3cr3t", secret, nil},
+		{"Bearer other", secret, ErrAuthZENCaller},
+		{"Basic s3cr3t", secret, ErrAuthZENCaller},
+		{"", secret, ErrAuthZENCaller},
+		{"Bearer ", "", ErrAuthZENCaller},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", AuthZENEvaluationPath, nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		if err := AuthenticateAuthZENCaller(r, tt.secret); !errors.Is(err, tt.want) {
+			t.Errorf("%q: expected %v, got %v", tt.authorization, tt.want, err)
+		}
+	}
+}
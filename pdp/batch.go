@@ -0,0 +1,258 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sync"
+
+	conf "github.com/hesusruiz/domeproxy/config"
+	"github.com/hesusruiz/domeproxy/internal/errl"
+	"github.com/hesusruiz/domeproxy/tmfcache"
+)
+
+// MaxBatchItems is the maximum number of items in a single batch authorization request.
+const MaxBatchItems = 100
+
+// The maximum number of items of a batch request evaluated concurrently. Each evaluation uses
+// its own Starlark thread from the pool of the PDP.
+const batchConcurrency = 8
+
+// BatchItem is an operation on a TMF object for which an authorization decision is requested.
+type BatchItem struct {
+	// One of 'READ' or 'UPDATE'
+	Action string `json:"action"`
+
+	// The TMF resource type, which is derived from the id if not specified
+	Resource string `json:"resource,omitempty"`
+
+	ID string `json:"id"`
+}
+
+// BatchRequest asks for the authorization decisions of a caller on several TMF objects.
+// If Token is empty, the Access Token in the Authorization header of the request is used.
+type BatchRequest struct {
+	Token string      `json:"token,omitempty"`
+	Items []BatchItem `json:"items"`
+}
+
+// BatchDecision is the authorization decision for an item of a batch request.
+type BatchDecision struct {
+	Action   string `json:"action"`
+	Resource string `json:"resource"`
+	ID       string `json:"id"`
+	Allow    bool   `json:"allow"`
+	Reason   string `json:"reason,omitempty"`
+	RuleID   string `json:"rule_id,omitempty"`
+
+	// An error retrieving the object or evaluating the policy, in which case the item is denied
+	Error string `json:"error,omitempty"`
+}
+
+// AuthorizeBatch takes the authorization decisions of the caller for all the items in the batch, so
+// applications rendering lists of objects can ask for all of them in a single round trip.
+//
+// The arguments to the policies are built in the same way as for AuthorizeREAD and AuthorizeUPDATE, but
+// the request object only has the "action", "method", "host", "remote_addr", "resource", "id" and "query" fields.
+// Objects are not modified, and no obligations are applied. UPDATE items are evaluated with the stored object.
+func AuthorizeBatch(
+	logger *slog.Logger, tmf *tmfcache.TMFCache, ruleEngine *PDP, r *http.Request,
+	batch BatchRequest,
+) ([]BatchDecision, error) {
+
+	if len(batch.Items) > MaxBatchItems {
+		return nil, errl.Errorf("too many items in the batch: %d (maximum is %d)", len(batch.Items), MaxBatchItems)
+	}
+
+	// The caller is identified and authenticated only once for all the items
+	if batch.Token != "" {
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", "Bearer "+batch.Token)
+	}
+
+	// The original host and address of the caller, if the batch was forwarded by a reverse proxy
+	host := cmp.Or(r.Header.Get("X-Original-Host"), r.Host)
+	remoteAddr := cmp.Or(r.Header.Get("X-Original-Remote-Addr"), r.RemoteAddr)
+
+	// There is no single original request, so the caller is authenticated with the data common to all the items
+	requestArgument := StarTMFMap{
+		"host":        host,
+		"remote_addr": remoteAddr,
+	}
+
+	tokString, tokenArgument, userArgument, err := extractCallerInfo(logger, tmf, ruleEngine, r, requestArgument)
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+
+	retrieve := func(item BatchItem) (*tmfcache.TMFGeneralObject, error) {
+		return retrieveObject(tmf, item.Action, item.Resource, item.ID)
+	}
+
+	caller := batchCaller{
+		authenticated: len(tokString) > 0,
+		host:          host,
+		remoteAddr:    remoteAddr,
+		token:         tokenArgument,
+		user:          userArgument,
+	}
+
+	return evaluateBatch(r.Context(), ruleEngine, caller, batch.Items, retrieve), nil
+}
+
+// batchCaller is the information about the caller shared by all the items of a batch.
+type batchCaller struct {
+	authenticated bool
+	host          string
+	remoteAddr    string
+	token         StarTMFMap
+	user          StarTMFMap
+}
+
+// evaluateBatch takes the decisions for the items concurrently, and returns them in the same order.
+func evaluateBatch(
+	ctx context.Context,
+	ruleEngine *PDP,
+	caller batchCaller,
+	items []BatchItem,
+	retrieve func(item BatchItem) (*tmfcache.TMFGeneralObject, error),
+) []BatchDecision {
+
+	decisions := make([]BatchDecision, len(items))
+	slots := make(chan struct{}, batchConcurrency)
+
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			decisions[i] = evaluateBatchItem(ctx, ruleEngine, caller, item, retrieve)
+		}()
+	}
+	wg.Wait()
+
+	return decisions
+}
+
+func evaluateBatchItem(
+	ctx context.Context,
+	ruleEngine *PDP,
+	caller batchCaller,
+	item BatchItem,
+	retrieve func(item BatchItem) (*tmfcache.TMFGeneralObject, error),
+) BatchDecision {
+
+	result := BatchDecision{Action: item.Action, Resource: item.Resource, ID: item.ID}
+
+	var method string
+	switch item.Action {
+	case "READ":
+		method = "GET"
+	case "UPDATE":
+		method = "PATCH"
+		// We do not allow a UPDATE request to come without authorization info
+		if !caller.authenticated {
+			result.Reason = "not authenticated"
+			return result
+		}
+	default:
+		result.Error = fmt.Sprintf("invalid action '%s', must be 'READ' or 'UPDATE'", item.Action)
+		return result
+	}
+
+	if item.ID == "" {
+		result.Error = "missing id"
+		return result
+	}
+
+	if item.Resource == "" {
+		resource, err := conf.FromIdToResourceType(item.ID)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		item.Resource = resource
+		result.Resource = resource
+	}
+
+	tmfObject, err := retrieve(item)
+	if err != nil {
+		result.Error = fmt.Sprintf("retrieving %s: %s", item.ID, err)
+		return result
+	}
+
+	// Each item is evaluated concurrently, so it needs its own copy of the user object
+	userArgument := maps.Clone(caller.user)
+
+	if item.Action == "UPDATE" {
+		userOrgId, _ := userArgument["organizationIdentifier"].(string)
+		if !isObjectOwner(userOrgId, tmfObject) {
+			result.Reason = "the user is not the owner of the object"
+			return result
+		}
+	}
+
+	requestArgument := StarTMFMap{
+		"action":      item.Action,
+		"method":      method,
+		"host":        caller.host,
+		"remote_addr": caller.remoteAddr,
+		"query":       StarTMFMap{},
+		"resource":    item.Resource,
+		"id":          item.ID,
+	}
+
+	// Only the decisions for reading the stored object can be cached
+	var objectHash []byte
+	if item.Action == "READ" {
+		objectHash = tmfObject.Hash()
+	}
+
+	tmfObjectArgument := readObjectArguments(tmfObject, userArgument)
+
+	decision := takeDecision(ctx, ruleEngine, requestArgument, caller.token, tmfObjectArgument, userArgument, objectHash)
+
+	result.Allow = decision.Allow
+	result.Reason = decision.Reason
+	result.RuleID = decision.RuleID
+
+	return result
+}
+
+// retrieveObject retrieves the object for deciding on an action on it. Objects are retrieved from the upstream
+// server if they are not in the local cache, except for UPDATE and DELETE, which are only allowed for objects
+// in the local cache.
+func retrieveObject(tmf *tmfcache.TMFCache, action string, resource string, id string) (*tmfcache.TMFGeneralObject, error) {
+
+	var ro tmfcache.TMFObject
+	var err error
+	if action == "UPDATE" || action == "DELETE" {
+		var found bool
+		ro, found, err = tmf.LocalRetrieveTMFObject(nil, id, resource, "")
+		if err == nil && !found {
+			err = fmt.Errorf("object not found in local database: %s", id)
+		}
+	} else {
+		ro, _, err = tmf.RetrieveOrUpdateObject(nil, id, resource, "", "", "", tmfcache.LocalOrRemote)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tmfObject, ok := ro.(*tmfcache.TMFGeneralObject)
+	if !ok {
+		return nil, fmt.Errorf("invalid object type %T", ro)
+	}
+	return tmfObject, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hesusruiz/domeproxy/tmfcache"
+)
+
+func TestEvaluateBatch(t *testing.T) {
+
+	m := newTestPDP(t, `
+def authorize():
+    if input.request.action == "UPDATE":
+        return struct(allow=input.user.isOwner, rule_id="update")
+    return struct(allow=input.tmf.lifecycleStatus == "Launched", rule_id="read")
+`)
+
+	objects := map[string]*tmfcache.TMFGeneralObject{}
+	for i, status := range []string{"Launched", "Retired", "Launched"} {
+		id := fmt.Sprintf("urn:ngsi-ld:product-offering:%04d", i)
+		seller := "did:elsi:VATES-1"
+		if i == 2 {
+			seller = "did:elsi:VATFR-2"
+		}
+		content := fmt.Sprintf(`{"id": %q, "href": %q, "@type": "productOffering", "lifecycleStatus": %q,
+			"lastUpdate": "2025-01-01T00:00:00Z", "relatedParty": [{"id": %q, "role": "Seller"}]}`, id, id, status, seller)
+		o, err := tmfcache.TMFObjectFromBytes([]byte(content), "productOffering")
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects[id] = o.(*tmfcache.TMFGeneralObject)
+	}
+
+	retrieve := func(item BatchItem) (*tmfcache.TMFGeneralObject, error) {
+		o, ok := objects[item.ID]
+		if !ok {
+			return nil, tmfcache.ErrorNotFound
+		}
+		return o, nil
+	}
+
+	caller := batchCaller{
+		authenticated: true,
+		token:         StarTMFMap{},
+		user:          StarTMFMap{"isAuthenticated": true, "organizationIdentifier": "VATES-1", "country": "ES"},
+	}
+
+	items := []BatchItem{
+		{Action: "READ", ID: "urn:ngsi-ld:product-offering:0000"},
+		{Action: "READ", ID: "urn:ngsi-ld:product-offering:0001"},
+		{Action: "UPDATE", ID: "urn:ngsi-ld:product-offering:0002"},
+		{Action: "READ", ID: "urn:ngsi-ld:product-offering:9999"},
+		{Action: "DELETE", ID: "urn:ngsi-ld:product-offering:0000"},
+	}
+
+	decisions := evaluateBatch(context.Background(), m, caller, items, retrieve)
+
+	want := []struct {
+		allow    bool
+		hasError bool
+	}{
+		{true, false},
+		{false, false},
+		{false, false},
+		{false, true},
+		{false, true},
+	}
+
+	if len(decisions) != len(items) {
+		t.Fatalf("expected %d decisions, got %d", len(items), len(decisions))
+	}
+	for i, d := range decisions {
+		if d.ID != items[i].ID || d.Resource != "productOffering" && !want[i].hasError {
+			t.Errorf("item %d: decision for the wrong object %+v", i, d)
+		}
+		if d.Allow != want[i].allow || (d.Error != "") != want[i].hasError {
+			t.Errorf("item %d: unexpected decision %+v", i, d)
+		}
+	}
+	if decisions[2].Reason != "the user is not the owner of the object" {
+		t.Errorf("unexpected reason for the update of another organization: %+v", decisions[2])
+	}
+}
+
+// newTestPDP returns an offline PDP with the policy, which is stored in a temporary file.
+func newTestPDP(t *testing.T, policy string) *PDP {
+	t.Helper()
+
+	policyFile := filepath.Join(t.TempDir(), "policy.star")
+	if err := os.WriteFile(policyFile, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
@@ -0,0 +1,225 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"fmt"
+
+	st "go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// PolicyDecision is the result of evaluating the policy rules for a request.
+//
+// The 'authorize' function in the policy can return either a simple boolean or a struct/dict
+// with the following fields, where only 'allow' is compulsory:
+//
+//	return struct(allow=False, reason="country not allowed", rule_id="R-003")
+//	return {"allow": True, "obligations": [...]}
+type PolicyDecision struct {
+	Allow       bool   `json:"allow"`
+	Reason      string `json:"reason,omitempty"`
+	RuleID      string `json:"rule_id,omitempty"`
+	Obligations []any  `json:"obligations,omitempty"`
+
+	// The policy function which took the decision, like 'authorize' or 'authorize_productOffering_READ'
+	EntryPoint string `json:"entry_point,omitempty"`
+
+	// The hex encoded SHA256 hash of the policy file which took the decision
+	PolicyHash string `json:"policy_hash,omitempty"`
+}
+
+// String returns a short human readable description of the decision, for logs and error messages.
+func (d *PolicyDecision) String() string {
+	s := "denied"
+	if d.Allow {
+		s = "allowed"
+	}
+	if d.RuleID != "" {
+		s = s + " by rule " + d.RuleID
+	}
+	if d.Reason != "" {
+		s = s + ": " + d.Reason
+	}
+	return s
+}
+
+// DeniedError is returned by the Authorize functions when the policy rejected the request,
+// so the caller can report to the user the reason given by the policy.
+type DeniedError struct {
+	Decision *PolicyDecision
+}
+
+func (e *DeniedError) Error() string {
+	msg := "not authorized"
+	if e.Decision == nil {
+		return msg
+	}
+	if e.Decision.Reason != "" {
+		msg = msg + ": " + e.Decision.Reason
+	}
+	if e.Decision.RuleID != "" {
+		msg = msg + " (rule " + e.Decision.RuleID + ")"
+	}
+	return msg
+}
+
+// decisionFromStarlark converts the value returned by the policy function into a PolicyDecision.
+// Booleans are accepted for compatibility with existing policies.
+func decisionFromStarlark(result st.Value) (*PolicyDecision, error) {
+
+	var fields st.HasAttrs
+
+	switch v := result.(type) {
+	case st.Bool:
+		return &PolicyDecision{Allow: bool(v)}, nil
+	case *starlarkstruct.Struct:
+		fields = v
+	case *st.Dict:
+		fields = dictAttrs{v}
+	default:
+		return nil, fmt.Errorf("function returned wrong type: %v", result.Type())
+	}
+
+	d := &PolicyDecision{}
+
+	// The 'allow' field is compulsory and must be a boolean
+	allow, err := fields.Attr("allow")
+	if err != nil || allow == nil {
+		return nil, fmt.Errorf("decision without 'allow' field")
+	}
+	allowBool, ok := allow.(st.Bool)
+	if !ok {
+		return nil, fmt.Errorf("decision field 'allow' must be a bool, got %v", allow.Type())
+	}
+	d.Allow = bool(allowBool)
+
+	if d.Reason, err = optionalStringAttr(fields, "reason"); err != nil {
+		return nil, err
+	}
+	if d.RuleID, err = optionalStringAttr(fields, "rule_id"); err != nil {
+		return nil, err
+	}
+
+	obligations, _ := fields.Attr("obligations")
+	if obligations != nil && obligations != st.None {
+		list, ok := obligations.(st.Indexable)
+		if !ok {
+			return nil, fmt.Errorf("decision field 'obligations' must be a list, got %v", obligations.Type())
+		}
+		d.Obligations, err = starlarkListToGo(list)
+		if err != nil {
+			return nil, fmt.Errorf("decision field 'obligations': %w", err)
+		}
+	}
+
+	return d, nil
+}
+
+func optionalStringAttr(fields st.HasAttrs, name string) (string, error) {
+	v, _ := fields.Attr(name)
+	if v == nil || v == st.None {
+		return "", nil
+	}
+	s, ok := st.AsString(v)
+	if !ok {
+		return "", fmt.Errorf("decision field '%s' must be a string, got %v", name, v.Type())
+	}
+	return s, nil
+}
+
+// dictAttrs allows accessing the keys of a Starlark dict as if they were attributes of a struct.
+type dictAttrs struct {
+	*st.Dict
+}
+
+func (d dictAttrs) Attr(name string) (st.Value, error) {
+	v, found, err := d.Dict.Get(st.String(name))
+	if err != nil || !found {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (d dictAttrs) AttrNames() []string {
+	var names []string
+	for _, k := range d.Dict.Keys() {
+		if s, ok := st.AsString(k); ok {
+			names = append(names, s)
+		}
+	}
+	return names
+}
+
+// starlarkToGo converts a Starlark value into the plain Go representation used for JSON objects,
+// so it can be processed outside of the rules engine.
+func starlarkToGo(v st.Value) (any, error) {
+	switch v := v.(type) {
+	case st.NoneType:
+		return nil, nil
+	case st.Bool:
+		return bool(v), nil
+	case st.String:
+		return string(v), nil
+	case st.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("integer out of range: %v", v)
+		}
+		return float64(i), nil
+	case st.Float:
+		return float64(v), nil
+	case StarTMFMap:
+		return map[string]any(v), nil
+	case StarTMFList:
+		return starlarkListToGo(v)
+	case *st.List:
+		return starlarkListToGo(v)
+	case st.Tuple:
+		return starlarkListToGo(v)
+	case *st.Dict:
+		m := map[string]any{}
+		for _, item := range v.Items() {
+			k, ok := st.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("dict key must be a string, got %v", item[0].Type())
+			}
+			e, err := starlarkToGo(item[1])
+			if err != nil {
+				return nil, err
+			}
+			m[k] = e
+		}
+		return m, nil
+	case *starlarkstruct.Struct:
+		m := map[string]any{}
+		for _, name := range v.AttrNames() {
+			attr, err := v.Attr(name)
+			if err != nil {
+				return nil, err
+			}
+			e, err := starlarkToGo(attr)
+			if err != nil {
+				return nil, err
+			}
+			m[name] = e
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unsupported type: %v", v.Type())
+	}
+}
+
+func starlarkListToGo(list st.Indexable) ([]any, error) {
+	out := make([]any, 0, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		e, err := starlarkToGo(list.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"hash/maphash"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The query parameters used for pagination, which do not participate in the key of the decision cache,
+// so the same user paging through a list of objects reuses the decisions already taken.
+// Policies should not depend on these parameters when the decision cache is enabled.
+var paginationParameters = []string{"offset", "limit"}
+
+// DefaultDecisionCacheTTL is the time that a decision is kept in the cache if not configured.
+const DefaultDecisionCacheTTL = 1 * time.Minute
+
+// decisionCacheKey identifies a decision taken by a given version of the policies, for a given
+// version of a TMF object, and for the same user, token and request.
+type decisionCacheKey struct {
+	policy uint64
+	object [sha256.Size]byte
+	args   [sha256.Size]byte
+}
+
+type decisionCacheEntry struct {
+	key      decisionCacheKey
+	decision *PolicyDecision
+	expires  time.Time
+}
+
+// DecisionCacheStats are the counters of the decision cache.
+type DecisionCacheStats struct {
+	Enabled   bool   `json:"enabled"`
+	Size      int    `json:"size"`
+	MaxSize   int    `json:"maxSize"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// decisionCache is a bounded LRU cache of authorization decisions with a TTL for each entry.
+// All the entries are discarded when a new version of the policies is used.
+type decisionCache struct {
+	mu      sync.Mutex
+	maxSize int
+	ttl     time.Duration
+
+	// The version of the policies of the entries in the cache
+	policy uint64
+
+	// The most recently used entries are at the front of the list
+	lru     *list.List
+	entries map[decisionCacheKey]*list.Element
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// newDecisionCache creates a decision cache with at most maxSize entries, which expire after ttl.
+// It returns nil (a disabled cache) if maxSize is not positive.
+func newDecisionCache(maxSize int, ttl time.Duration) *decisionCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	if ttl <= 0 {
+		ttl = DefaultDecisionCacheTTL
+	}
+	return &decisionCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[decisionCacheKey]*list.Element),
+	}
+}
+
+// checkPolicy discards all the entries if the version of the policies changed. It must be called with the lock held.
+func (c *decisionCache) checkPolicy(policy uint64) {
+	if c.policy == policy {
+		return
+	}
+	if c.lru.Len() > 0 {
+		slog.Info("decision cache invalidated because the policies changed", "entries", c.lru.Len())
+	}
+	c.policy = policy
+	c.lru.Init()
+	clear(c.entries)
+}
+
+// get returns the decision in the cache, if it exists and is not expired.
+// The decision returned is shared and must not be modified.
+func (c *decisionCache) get(key decisionCacheKey) (*PolicyDecision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checkPolicy(key.policy)
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	entry := elem.Value.(*decisionCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	c.hits.Add(1)
+	return entry.decision, true
+}
+
+// put stores the decision in the cache, evicting the least recently used entry if the cache is full.
+func (c *decisionCache) put(key decisionCacheKey, decision *PolicyDecision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checkPolicy(key.policy)
+
+	expires := time.Now().Add(c.ttl)
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*decisionCacheEntry)
+		entry.decision = decision
+		entry.expires = expires
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	for c.lru.Len() >= c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*decisionCacheEntry).key)
+		c.evictions.Add(1)
+	}
+
+	entry := &decisionCacheEntry{key: key, decision: decision, expires: expires}
+	c.entries[key] = c.lru.PushFront(entry)
+}
+
+func (c *decisionCache) stats() DecisionCacheStats {
+	if c == nil {
+		return DecisionCacheStats{}
+	}
+
+	c.mu.Lock()
+	size := c.lru.Len()
+	c.mu.Unlock()
+
+	return DecisionCacheStats{
+		Enabled:   true,
+		Size:      size,
+		MaxSize:   c.maxSize,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// DecisionCacheStats returns the counters of the decision cache of the PDP.
+func (m *PDP) DecisionCacheStats() DecisionCacheStats {
+	return m.decisionCache.stats()
+}
+
+// policyVersion combines the hash of the policy file with the hashes of the modules it loads,
+// so a change in any of them is a new version of the policies.
+func policyVersion(scriptHash uint64, dependencies map[string]uint64) uint64 {
+	if len(dependencies) == 0 {
+		return scriptHash
+	}
+
+	var h maphash.Hash
+	h.SetSeed(policyVersionSeed)
+	maphash.WriteComparable(&h, scriptHash)
+	for _, name := range slices.Sorted(maps.Keys(dependencies)) {
+		h.WriteString(name)
+		maphash.WriteComparable(&h, dependencies[name])
+	}
+	return h.Sum64()
+}
+
+var policyVersionSeed = maphash.MakeSeed()
+
+// decisionArgsDigest calculates a canonical digest of the arguments of the policy, except the TMF object,
+// which is identified by its own hash. The claims of the token are included, because the policies can
+// check them (eg, the powers of the mandate), so callers with the same user data do not share decisions.
+// The JSON encoder sorts the keys of the maps, so the same data always produces the same digest.
+// The pagination parameters of the query are not included.
+func decisionArgsDigest(input StarTMFMap) ([sha256.Size]byte, error) {
+
+	args := make(map[string]any, len(input))
+	for k, v := range input {
+		if k != "tmf" {
+			args[k] = v
+		}
+	}
+
+	request, _ := input["request"].(StarTMFMap)
+	if query, ok := request["query"].(StarTMFMap); ok {
+		query = maps.Clone(query)
+		for _, p := range paginationParameters {
+			delete(query, p)
+		}
+		request = maps.Clone(request)
+		request["query"] = query
+		args["request"] = request
+	}
+
+	b, err := json.Marshal(args)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	return sha256.Sum256(b), nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDecisionCache(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+	if err := os.WriteFile(policyFile, []byte("def authorize():\n    return input.user.country == \"ES\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.decisionCache = newDecisionCache(10, time.Minute)
+
+	objectHash := sha256.Sum256([]byte("object"))
+
+	decide := func(country string, offset string) bool {
+		t.Helper()
+		input := StarTMFMap{
+			"user":    StarTMFMap{"country": country},
+			"request": StarTMFMap{"method": "GET", "query": StarTMFMap{"offset": offset}},
+			"tmf":     StarTMFMap{},
+		}
+		decision, err := m.takeAuthnDecision(context.Background(), Authorize, input, objectHash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decision.Allow
+	}
+
+	checkStats := func(hits, misses uint64) {
+		t.Helper()
+		stats := m.DecisionCacheStats()
+		if stats.Hits != hits || stats.Misses != misses {
+			t.Fatalf("got %d hits and %d misses, want %d and %d", stats.Hits, stats.Misses, hits, misses)
+		}
+	}
+
+	if !decide("ES", "0") {
+		t.Fatal("ES should be allowed")
+	}
+	checkStats(0, 1)
+
+	// The pagination parameters are not part of the key
+	if !decide("ES", "10") {
+		t.Fatal("ES should be allowed")
+	}
+	checkStats(1, 1)
+
+	// A different user is a different key
+	if decide("FR", "0") {
+		t.Fatal("FR should not be allowed")
+	}
+	checkStats(1, 2)
+
+	// A new version of the policy invalidates the cached decisions
+	if err := m.PutFile(policyFile, []byte("def authorize():\n    return False\n")); err != nil {
+		t.Fatal(err)
+	}
+	if decide("ES", "0") {
+		t.Fatal("the cached decision was used with the new policy")
+	}
+	checkStats(1, 3)
+	if size := m.DecisionCacheStats().Size; size != 1 {
+		t.Fatalf("expected only the decision of the new policy in the cache, got %d entries", size)
+	}
+}
+
+func TestDecisionCacheToken(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+	policy := `
+def authorize():
+    return "Create" in input.token.mandate.power.action
+`
+	if err := os.WriteFile(policyFile, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.decisionCache = newDecisionCache(10, time.Minute)
+
+	objectHash := sha256.Sum256([]byte("object"))
+
+	// The callers have the same user data, and tokens which only differ in the powers of the mandate
+	decide := func(actions ...any) bool {
+		t.Helper()
+		input := StarTMFMap{
+			"user":    StarTMFMap{"country": "ES"},
+			"request": StarTMFMap{"method": "POST"},
+			"token":   StarTMFMap{"mandate": map[string]any{"power": map[string]any{"action": actions}}},
+			"tmf":     StarTMFMap{},
+		}
+		decision, err := m.takeAuthnDecision(context.Background(), Authorize, input, objectHash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decision.Allow
+	}
+
+	if !decide("Create", "Update") {
+		t.Fatal("the caller with the power to create should be allowed")
+	}
+	if decide("Update") {
+		t.Fatal("the decision of a caller with other powers was used")
+	}
+	if stats := m.DecisionCacheStats(); stats.Hits != 0 || stats.Misses != 2 {
+		t.Fatalf("expected two misses, got %+v", stats)
+	}
+}
+
+func TestDecisionCacheLimits(t *testing.T) {
+
+	c := newDecisionCache(2, time.Minute)
+
+	key := func(i byte) decisionCacheKey {
+		return decisionCacheKey{policy: 1, object: [sha256.Size]byte{i}}
+	}
+
+	c.put(key(1), &PolicyDecision{Allow: true})
+	c.put(key(2), &PolicyDecision{Allow: true})
+
+	// Use the first one, so the second is the least recently used
+	if _, found := c.get(key(1)); !found {
+		t.Fatal("entry 1 not found")
+	}
+	c.put(key(3), &PolicyDecision{Allow: true})
+
+	if _, found := c.get(key(2)); found {
+		t.Error("entry 2 should have been evicted")
+	}
+	if _, found := c.get(key(1)); !found {
+		t.Error("entry 1 should still be in the cache")
+	}
+	if stats := c.stats(); stats.Evictions != 1 || stats.Size != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Expired entries are not returned
+	c.ttl = -time.Second
+	c.put(key(4), &PolicyDecision{Allow: true})
+	if _, found := c.get(key(4)); found {
+		t.Error("expired entry returned")
+	}
+
+	// A disabled cache reports no data
+	if stats := newDecisionCache(0, time.Minute).stats(); stats.Enabled {
+		t.Error("cache with size zero should be disabled")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"reflect"
+	"testing"
+
+	st "go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+func TestDecisionFromStarlark(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		expr    string
+		want    *PolicyDecision
+		wantErr bool
+	}{
+		{
+			name: "plain bool",
+			expr: `True`,
+			want: &PolicyDecision{Allow: true},
+		},
+		{
+			name: "struct with reason",
+			expr: `struct(allow=False, reason="country forbidden", rule_id="country-01")`,
+			want: &PolicyDecision{Allow: false, Reason: "country forbidden", RuleID: "country-01"},
+		},
+		{
+			name: "dict with obligations",
+			expr: `{"allow": True, "obligations": [{"redact": ["a.b"]}]}`,
+			want: &PolicyDecision{Allow: true, Obligations: []any{map[string]any{"redact": []any{"a.b"}}}},
+		},
+		{
+			name:    "missing allow",
+			expr:    `struct(reason="no decision")`,
+			wantErr: true,
+		},
+		{
+			name:    "wrong type",
+			expr:    `"yes"`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := st.EvalOptions(&syntax.FileOptions{}, &st.Thread{}, "test", tt.expr, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := decisionFromStarlark(v)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hesusruiz/domeproxy/internal/jpath"
+	st "go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Name of the thread local with the 'input' object of the current decision
+const localInput = "input"
+
+// domeModule is the 'dome' module available to the policies, with the checks which are common to most
+// DOME policies, so they do not have to be copied in each policy:
+//
+//	dome.has_power(function, action, domain="DOME") reports if the mandate of the caller includes the power.
+//	dome.mandate_valid_now() reports if the mandate of the caller is valid at this moment.
+//	dome.country_permitted(tmf, country) reports if the country restrictions of the object permit the country.
+//	dome.operator_permitted(tmf, operator) reports if the operator restrictions of the object permit the operator.
+//	dome.is_role(tmf, role) reports if the organization of the caller has the role in the related parties of the object.
+//
+// The functions without a 'tmf' argument use the Access Token in the 'input' object of the decision.
+var domeModule = &starlarkstruct.Module{
+	Name: "dome",
+	Members: st.StringDict{
+		"has_power":          st.NewBuiltin("has_power", domeHasPower),
+		"mandate_valid_now":  st.NewBuiltin("mandate_valid_now", domeMandateValidNow),
+		"country_permitted":  st.NewBuiltin("country_permitted", domeCountryPermitted),
+		"operator_permitted": st.NewBuiltin("operator_permitted", domeOperatorPermitted),
+		"is_role":            st.NewBuiltin("is_role", domeIsRole),
+	},
+}
+
+// inputFromThread returns the 'input' object of the decision being taken in the thread.
+func inputFromThread(thread *st.Thread, b *st.Builtin) (StarTMFMap, error) {
+	input, _ := thread.Local(localInput).(StarTMFMap)
+	if input == nil {
+		return nil, fmt.Errorf("%s: no input available", b.Name())
+	}
+	return input, nil
+}
+
+// mandateFromThread returns the mandate in the LEARCredential of the caller, which is empty if the
+// request is not authenticated.
+func mandateFromThread(thread *st.Thread, b *st.Builtin) (map[string]any, error) {
+	input, err := inputFromThread(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	return jpath.GetMap(map[string]any(input), "token.vc.credentialSubject.mandate"), nil
+}
+
+func domeHasPower(thread *st.Thread, b *st.Builtin, args st.Tuple, kwargs []st.Tuple) (st.Value, error) {
+
+	var function, action string
+	domain := "DOME"
+	if err := st.UnpackArgs(b.Name(), args, kwargs, "function", &function, "action", &action, "domain?", &domain); err != nil {
+		return nil, err
+	}
+
+	mandate, err := mandateFromThread(thread, b)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range jpath.GetList(mandate, "power") {
+		if powerGrants(p, function, action, domain) {
+			return st.True, nil
+		}
+	}
+
+	return st.False, nil
+}
+
+// powerGrants reports if a power of the mandate in a LEARCredential grants the action on the function in the domain.
+// Both the standard and the 'tmf_' prefixed names of the fields are accepted, the action and domain can be
+// single values or lists, and the values are compared without regards to case.
+func powerGrants(p any, function string, action string, domain string) bool {
+
+	powerField := func(name string) []string {
+		v, err := jpath.Get(p, "tmf_"+name)
+		if err != nil || v == nil {
+			v, _ = jpath.Get(p, name)
+		}
+		if s, ok := v.(string); ok {
+			return []string{s}
+		}
+		return stringList(v)
+	}
+
+	contains := func(values []string, s string) bool {
+		return slices.ContainsFunc(values, func(v string) bool { return strings.EqualFold(v, s) })
+	}
+
+	return contains(powerField("type"), "Domain") &&
+		contains(powerField("function"), function) &&
+		contains(powerField("action"), action) &&
+		contains(powerField("domain"), domain)
+}
+
+func domeMandateValidNow(thread *st.Thread, b *st.Builtin, args st.Tuple, kwargs []st.Tuple) (st.Value, error) {
+
+	if err := st.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+
+	input, err := inputFromThread(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	vc := jpath.GetMap(map[string]any(input), "token.vc")
+	if len(vc) == 0 {
+		return st.False, nil
+	}
+
+	// The validity period of the mandate and of the credential, if they are specified
+	now := time.Now()
+	periods := [][2]string{
+		{jpath.GetString(vc, "credentialSubject.mandate.life_span.start_date_time"), jpath.GetString(vc, "credentialSubject.mandate.life_span.end_date_time")},
+		{jpath.GetString(vc, "validFrom"), jpath.GetString(vc, "validUntil")},
+	}
+
+	for _, period := range periods {
+		if period[0] != "" {
+			start, err := time.Parse(time.RFC3339Nano, period[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid start of validity: %w", b.Name(), err)
+			}
+			if now.Before(start) {
+				return st.False, nil
+			}
+		}
+		if period[1] != "" {
+			end, err := time.Parse(time.RFC3339Nano, period[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid end of validity: %w", b.Name(), err)
+			}
+			if now.After(end) {
+				return st.False, nil
+			}
+		}
+	}
+
+	return st.True, nil
+}
+
+func domeCountryPermitted(thread *st.Thread, b *st.Builtin, args st.Tuple, kwargs []st.Tuple) (st.Value, error) {
+	return restrictionPermits(b, args, kwargs, "country", "Countries", "LegalRegion", strings.EqualFold)
+}
+
+func domeOperatorPermitted(thread *st.Thread, b *st.Builtin, args st.Tuple, kwargs []st.Tuple) (st.Value, error) {
+	return restrictionPermits(b, args, kwargs, "operator", "Operators", "Operator", sameOrganization)
+}
+
+// restrictionPermits implements the checks of the restrictions embedded in the object, where the element is
+// permitted if it is not in the prohibited list, and the permitted list is empty or includes it.
+// The calculated lists in the 'tmf' object passed to the policies are used if they exist, and otherwise
+// they are calculated from the terms in the object, as the PDP does.
+func restrictionPermits(
+	b *st.Builtin, args st.Tuple, kwargs []st.Tuple,
+	argName string, calculatedSuffix string, conceptSuffix string, equal func(a, b string) bool,
+) (st.Value, error) {
+
+	var tmfValue st.Value
+	var element string
+	if err := st.UnpackArgs(b.Name(), args, kwargs, "tmf", &tmfValue, argName, &element); err != nil {
+		return nil, err
+	}
+
+	tmfObject, err := tmfFromStarlark(b, tmfValue)
+	if err != nil {
+		return nil, err
+	}
+
+	contains := func(values []string) bool {
+		return slices.ContainsFunc(values, func(v string) bool { return equal(v, element) })
+	}
+
+	prohibited := restrictionElements(tmfObject, "prohibited"+calculatedSuffix, "prohibited"+conceptSuffix)
+	if contains(prohibited) {
+		return st.False, nil
+	}
+
+	permitted := restrictionElements(tmfObject, "permitted"+calculatedSuffix, "permitted"+conceptSuffix)
+	if len(permitted) > 0 && !contains(permitted) {
+		return st.False, nil
+	}
+
+	return st.True, nil
+}
+
+// restrictionElements returns the calculated list in the object, or calculates it from the terms of the object,
+// expanding the groups of countries like the PDP does.
+func restrictionElements(tmfObject map[string]any, calculated string, concept string) []string {
+	if _, found := tmfObject[calculated]; found {
+		return stringList(tmfObject[calculated])
+	}
+	elements := getRestrictionElements(tmfObject, concept)
+	if strings.HasSuffix(concept, "LegalRegion") {
+		elements, _ = expandRegions(elements)
+	}
+	return elements
+}
+
+// stringList returns the strings in a list, ignoring other types of elements.
+func stringList(v any) []string {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case []any:
+		var out []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+func domeIsRole(thread *st.Thread, b *st.Builtin, args st.Tuple, kwargs []st.Tuple) (st.Value, error) {
+
+	var tmfValue st.Value
+	var role string
+	if err := st.UnpackArgs(b.Name(), args, kwargs, "tmf", &tmfValue, "role", &role); err != nil {
+		return nil, err
+	}
+
+	tmfObject, err := tmfFromStarlark(b, tmfValue)
+	if err != nil {
+		return nil, err
+	}
+
+	input, err := inputFromThread(thread, b)
+	if err != nil {
+		return nil, err
+	}
+	organization := jpath.GetString(map[string]any(input), "user.organizationIdentifier")
+	if organization == "" {
+		return st.False, nil
+	}
+
+	for _, rp := range jpath.GetList(tmfObject, "relatedParty") {
+		if !strings.EqualFold(jpath.GetString(rp, "role"), role) {
+			continue
+		}
+		if sameOrganization(jpath.GetString(rp, "partyOrPartyRole.name"), organization) {
+			return st.True, nil
+		}
+	}
+
+	return st.False, nil
+}
+
+// tmfFromStarlark converts the TMF object passed to a function of the module, which can be the 'tmf' object
+// of the input, an object retrieved with star.get or a dict.
+func tmfFromStarlark(b *st.Builtin, v st.Value) (map[string]any, error) {
+	goValue, err := starlarkToGo(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	tmfObject, ok := goValue.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a TMF object, got %v", b.Name(), v.Type())
+	}
+	return tmfObject, nil
+}
+
+// sameOrganization compares two organization identifiers, with or without the 'did:elsi:' prefix.
+func sameOrganization(a string, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return strings.TrimPrefix(a, "did:elsi:") == strings.TrimPrefix(b, "did:elsi:")
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	st "go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+func TestDomeModule(t *testing.T) {
+
+	now := time.Now().UTC()
+	validToken := func(start, end time.Time) StarTMFMap {
+		token := StarTMFMap(getFakeClaimsJR())
+		mandate := token["vc"].(map[string]any)["credentialSubject"].(map[string]any)["mandate"].(map[string]any)
+		mandate["life_span"] = map[string]any{
+			"start_date_time": start.Format(time.RFC3339Nano),
+			"end_date_time":   end.Format(time.RFC3339Nano),
+		}
+		token["vc"].(map[string]any)["validUntil"] = end.Format(time.RFC3339Nano)
+		return token
+	}
+
+	user := StarTMFMap{"organizationIdentifier": "VATES-B60645900"}
+	current := StarTMFMap{"token": validToken(now.Add(-time.Hour), now.Add(time.Hour)), "user": user}
+	expired := StarTMFMap{"token": StarTMFMap(getFakeClaimsJR()), "user": user}
+	future := StarTMFMap{"token": validToken(now.Add(time.Hour), now.Add(2*time.Hour)), "user": user}
+	anonymous := StarTMFMap{"token": StarTMFMap{}, "user": StarTMFMap{}}
+
+	offering := StarTMFMap{
+		"productOfferingTerm": []any{map[string]any{
+			"@type":                 "OperatorRestriction",
+			"permittedLegalRegion":  []any{map[string]any{"country": "ES"}, map[string]any{"country": "FR"}},
+			"prohibitedLegalRegion": []any{map[string]any{"country": "FR"}},
+			"prohibitedOperator":    []any{map[string]any{"country": "did:elsi:VATIT-1"}},
+		}},
+		"relatedParty": []any{
+			map[string]any{"role": "Seller", "partyOrPartyRole": map[string]any{"@type": "PartyRef", "name": "did:elsi:VATES-B60645900"}},
+			map[string]any{"role": "Buyer", "partyOrPartyRole": map[string]any{"@type": "PartyRef", "name": "did:elsi:VATDE-2"}},
+		},
+	}
+	env := st.StringDict{
+		"offering":   offering,
+		"calculated": getAllRestrictionElements(StarTMFMap{"productOfferingTerm": offering["productOfferingTerm"]}),
+	}
+
+	tests := []struct {
+		input StarTMFMap
+		expr  string
+		want  st.Value
+	}{
+		{current, `dome.has_power("Onboarding", "Execute")`, st.True},
+		{current, `dome.has_power("productoffering", "update", "DOME")`, st.True},
+		{current, `dome.has_power("ProductOffering", "Upload")`, st.False},
+		{current, `dome.has_power("ProductOffering", "Create", domain="Other")`, st.False},
+		{anonymous, `dome.has_power("Onboarding", "Execute")`, st.False},
+
+		{current, `dome.mandate_valid_now()`, st.True},
+		{expired, `dome.mandate_valid_now()`, st.False},
+		{future, `dome.mandate_valid_now()`, st.False},
+		{anonymous, `dome.mandate_valid_now()`, st.False},
+
+		{current, `dome.country_permitted(offering, "ES")`, st.True},
+		{current, `dome.country_permitted(offering, "es")`, st.True},
+		{current, `dome.country_permitted(offering, "FR")`, st.False},
+		{current, `dome.country_permitted(offering, "IT")`, st.False},
+		{current, `dome.country_permitted(calculated, "ES")`, st.True},
+		{current, `dome.country_permitted(calculated, "IT")`, st.False},
+		{current, `dome.country_permitted({}, "IT")`, st.True},
+
+		{current, `dome.operator_permitted(offering, "VATIT-1")`, st.False},
+		{current, `dome.operator_permitted(offering, "did:elsi:VATES-1")`, st.True},
+
+		{current, `dome.is_role(offering, "seller")`, st.True},
+		{current, `dome.is_role(offering, "Buyer")`, st.False},
+		{anonymous, `dome.is_role(offering, "Seller")`, st.False},
+	}
+
+	for _, tt := range tests {
+		thread := &st.Thread{Name: "test"}
+		thread.SetLocal(localInput, tt.input)
+
+		got, err := st.EvalOptions(&syntax.FileOptions{}, thread, "<test>", tt.expr, env)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+
+	// The functions need the input of a decision
+	if _, err := st.EvalOptions(&syntax.FileOptions{}, &st.Thread{}, "<test>", `dome.mandate_valid_now()`, nil); err == nil {
+		t.Errorf("expected an error without input")
+	}
+}
+
+func TestDomeModuleInPolicy(t *testing.T) {
+
+	m, tmf, tokString := newExternalAuthzFixture(t)
+
+	policy := `
+def authorize():
+    if input.request.action == "READ":
+        return dome.is_role(input.tmf, "Seller") and dome.country_permitted(input.tmf, input.user.country)
+    return True
+`
+	if err := m.PutFile(m.config.PolicyFileName, []byte(policy)); err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := map[string]bool{
+		"urn:ngsi-ld:product-offering:0000": true,
+		"urn:ngsi-ld:product-offering:0002": false,
+	}
+	for id, want := range allowed {
+		uri := "/tmf-api/productCatalogManagement/v4/productOffering/" + id
+		r := httptest.NewRequest("GET", uri, nil)
+		r.Header.Set("X-Original-URI", uri)
+		r.Header.Set("X-Original-Method", "GET")
+		r.Header.Set("Authorization", "Bearer "+tokString)
+
+		decision, _, err := AuthorizeExternal(slog.Default(), tmf, m, r)
+		if err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if decision.Allow != want {
+			t.Errorf("%s: expected %v, got %v", id, want, decision.Allow)
+		}
+	}
+}
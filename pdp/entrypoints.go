@@ -0,0 +1,106 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"fmt"
+	"strings"
+
+	st "go.starlark.net/starlark"
+)
+
+// The prefix of the specialised authorization functions, like 'authorize_productOffering_READ' or 'authorize_LIST'
+const authorizePrefix = "authorize_"
+
+// resolveEntryPoints looks up in the compiled policy the functions invoked by the PDP, so they do not
+// have to be searched for each request.
+//
+// The policy can define specialised authorization functions for a resource and action, for a resource or
+// for an action, and a generic 'authorize' function which is used when there is not a more specific one.
+// At least one of them must be defined.
+func (te *threadEntry) resolveEntryPoints() error {
+	var err error
+
+	te.authorizeFunctions = map[string]*st.Function{}
+	for name, value := range te.globals {
+		if !strings.HasPrefix(name, authorizePrefix) {
+			continue
+		}
+		starFunction, ok := value.(*st.Function)
+		if !ok {
+			return fmt.Errorf("%s: expected a Callable but got %v", name, value.Type())
+		}
+		te.authorizeFunctions[strings.TrimPrefix(name, authorizePrefix)] = starFunction
+	}
+
+	if len(te.authorizeFunctions) == 0 {
+		// The module has to define a function called 'authorize', which will be invoked
+		// for each request to access protected resources.
+		te.authorizeFunction, err = getGlobalFunction(te.globals, "authorize")
+	} else {
+		te.authorizeFunction, err = getOptionalGlobalFunction(te.globals, "authorize")
+	}
+	if err != nil {
+		return err
+	}
+
+	// The 'list_filter' functions are optional, see listFilters
+	te.listFilterFunctions = map[string]*st.Function{}
+	for name, value := range te.globals {
+		if name != listFilterName && !strings.HasPrefix(name, listFilterName+"_") {
+			continue
+		}
+		starFunction, ok := value.(*st.Function)
+		if !ok {
+			return fmt.Errorf("%s: expected a Callable but got %v", name, value.Type())
+		}
+		resource := strings.TrimPrefix(strings.TrimPrefix(name, listFilterName), "_")
+		te.listFilterFunctions[resource] = starFunction
+	}
+
+	// The 'authenticate' function is optional. It is invoked once per request with a verified
+	// Access Token, before authorization, so the policy can reject the caller outright.
+	te.authenticateFunction, err = getOptionalGlobalFunction(te.globals, "authenticate")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// authorizeEntryPoint returns the most specific authorization function for the resource and action of the
+// request, in this order: 'authorize_{resource}_{action}', 'authorize_{resource}', 'authorize_{action}'
+// and 'authorize'. It also returns the name of the function, for the logs.
+func (te *threadEntry) authorizeEntryPoint(input StarTMFMap) (*st.Function, string, error) {
+
+	if len(te.authorizeFunctions) > 0 {
+		request, _ := input["request"].(StarTMFMap)
+		resource, _ := request["resource"].(string)
+		action, _ := request["action"].(string)
+
+		var candidates []string
+		if resource != "" && action != "" {
+			candidates = append(candidates, resource+"_"+action)
+		}
+		if resource != "" {
+			candidates = append(candidates, resource)
+		}
+		if action != "" {
+			candidates = append(candidates, action)
+		}
+
+		for _, candidate := range candidates {
+			if f, ok := te.authorizeFunctions[candidate]; ok {
+				return f, authorizePrefix + candidate, nil
+			}
+		}
+
+		if te.authorizeFunction == nil {
+			return nil, "", fmt.Errorf("no authorization function for resource '%s' and action '%s'", resource, action)
+		}
+	}
+
+	return te.authorizeFunction, "authorize", nil
+}
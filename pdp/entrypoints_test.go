@@ -0,0 +1,71 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthorizeEntryPoints(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+
+	policy := `
+def authorize_productOffering_READ():
+    return struct(allow=True, rule_id="po-read")
+
+def authorize_productOffering():
+    return struct(allow=False, rule_id="po")
+
+def authorize_LIST():
+    return struct(allow=True, rule_id="list")
+
+def authorize():
+    return struct(allow=False, rule_id="default")
+`
+	if err := os.WriteFile(policyFile, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		resource, action string
+		entryPoint       string
+		rule             string
+	}{
+		{"productOffering", "READ", "authorize_productOffering_READ", "po-read"},
+		{"productOffering", "LIST", "authorize_productOffering", "po"},
+		{"category", "LIST", "authorize_LIST", "list"},
+		{"category", "READ", "authorize", "default"},
+	}
+
+	for _, tt := range tests {
+		input := StarTMFMap{"request": StarTMFMap{"resource": tt.resource, "action": tt.action}}
+		decision, err := m.TakeAuthnDecision(Authorize, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.EntryPoint != tt.entryPoint || decision.RuleID != tt.rule {
+			t.Errorf("%s %s: got entry point %s and rule %s, want %s and %s",
+				tt.resource, tt.action, decision.EntryPoint, decision.RuleID, tt.entryPoint, tt.rule)
+		}
+	}
+
+	// Without the generic function, requests not matching any specialised function fail
+	policy = "def authorize_LIST():\n    return True\n"
+	if err := m.PutFile(policyFile, []byte(policy)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.TakeAuthnDecision(Authorize, StarTMFMap{"request": StarTMFMap{"resource": "category", "action": "READ"}}); err == nil {
+		t.Errorf("expected an error without a matching function")
+	}
+}
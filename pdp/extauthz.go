@@ -0,0 +1,113 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/hesusruiz/domeproxy/tmfcache"
+	"gitlab.com/greyxor/slogor"
+)
+
+// EnvoyPathPrefix is the path prefix of the Envoy ext_authz endpoint. It must be configured as the
+// 'path_prefix' of the HTTP authorization service in Envoy, which appends to it the path of the original request:
+//
+//	http_filters:
+//	- name: envoy.filters.http.ext_authz
+//	  typed_config:
+//	    "@type": type.googleapis.com/envoy.extensions.filters.http.ext_authz.v3.ExtAuthz
+//	    http_service:
+//	      server_uri:
+//	        uri: http://domepdp:9991
+//	        cluster: domepdp
+//	        timeout: 2s
+//	      path_prefix: /authorize/v1/envoy
+//	      authorization_response:
+//	        allowed_upstream_headers:
+//	          patterns:
+//	          - exact: x-user-org
+//	          - exact: x-user-country
+//	          - exact: x-decision-rule
+//	    authorization_request:
+//	      allowed_headers:
+//	        patterns:
+//	        - exact: authorization
+//	        - exact: x-forwarded-for
+const EnvoyPathPrefix = "/authorize/v1/envoy"
+
+// envoyDeniedBody is the body of the reply for denied requests, which Envoy sends to the client.
+type envoyDeniedBody struct {
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+	RuleID string `json:"rule_id,omitempty"`
+}
+
+// HandleEnvoyAuthorization returns an [http.Handler] implementing the HTTP service contract of the Envoy
+// ext_authz filter. Envoy sends a check request with the method and headers of the original request, and
+// with its path appended to [EnvoyPathPrefix]. The body of the original request is not sent.
+//
+// The reply is 200 with the user info and the decision in headers which Envoy can add to the upstream request
+// (with 'allowed_upstream_headers'), or 401/403 with a JSON body that Envoy returns to the client.
+func HandleEnvoyAuthorization(
+	logger *slog.Logger,
+	tmf *tmfcache.TMFCache,
+	ruleEngine *PDP,
+) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		// Describe the original request in the same way as the NGINX auth_request mode
+		checkRequest := envoyOriginalRequest(r)
+
+		decision, user, err := AuthorizeExternal(logger, tmf, ruleEngine, checkRequest)
+		if err != nil {
+			slog.Error("forbidden", slogor.Err(err), "URI", checkRequest.Header.Get("X-Original-URI"))
+		}
+
+		status := setDecisionHeaders(w, decision, user, err)
+		if status == http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		body := envoyDeniedBody{Code: http.StatusText(status)}
+		if err != nil {
+			body.Reason = err.Error()
+		} else {
+			body.Reason = decision.Reason
+			body.RuleID = decision.RuleID
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// envoyOriginalRequest returns a copy of the Envoy check request, with the X-Original-* headers
+// describing the original request received by Envoy.
+func envoyOriginalRequest(r *http.Request) *http.Request {
+
+	originalURI := strings.TrimPrefix(r.URL.RequestURI(), EnvoyPathPrefix)
+	if !strings.HasPrefix(originalURI, "/") {
+		originalURI = "/" + originalURI
+	}
+
+	// The client address is the first one in X-Forwarded-For, if Envoy is configured to send it
+	remoteAddr := r.RemoteAddr
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		remoteAddr = strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+	}
+
+	checkRequest := r.Clone(r.Context())
+	checkRequest.Header.Set("X-Original-URI", originalURI)
+	checkRequest.Header.Set("X-Original-Method", r.Method)
+	checkRequest.Header.Set("X-Original-Host", r.Host)
+	checkRequest.Header.Set("X-Original-Remote-Addr", remoteAddr)
+
+	return checkRequest
+}
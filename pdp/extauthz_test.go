@@ -0,0 +1,101 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleEnvoyAuthorization(t *testing.T) {
+
+	m, tmf, tokString := newExternalAuthzFixture(t)
+
+	handler := HandleEnvoyAuthorization(slog.Default(), tmf, m)
+
+	const prefix = "/tmf-api/productCatalogManagement/v4/productOffering"
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		authorization string
+		status        int
+		userOrg       string
+		ruleID        string
+	}{
+		{"anonymous list", "GET", prefix + "?limit=10", "", http.StatusOK, "", ""},
+		{"anonymous read retired", "GET", prefix + "/urn:ngsi-ld:product-offering:0001", "", http.StatusUnauthorized, "", "read"},
+		{"create without powers", "POST", prefix, "Bearer " + tokString, http.StatusForbidden, "did:elsi:VATES-1", "create"},
+		{"update own object", "PATCH", prefix + "/urn:ngsi-ld:product-offering:0000", "Bearer " + tokString, http.StatusOK, "did:elsi:VATES-1", ""},
+		{"update other object", "PATCH", prefix + "/urn:ngsi-ld:product-offering:0002", "Bearer " + tokString, http.StatusForbidden, "did:elsi:VATES-1", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Envoy keeps the method and the allowed headers of the original request, appends its path
+			// to the configured path prefix and does not send the body.
+			r := httptest.NewRequest(tt.method, EnvoyPathPrefix+tt.path, nil)
+			r.Host = "dome-marketplace.example"
+			r.Header.Set("X-Forwarded-For", "192.0.2.1, 10.0.0.1")
+			r.Header.Set("X-Request-Id", "3f8a8e4e-5b1c-4b8e-9d0a-1c2b3d4e5f60")
+			r.Header.Set("X-Envoy-Internal", "true")
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d (body: %s)", tt.status, w.Code, w.Body.String())
+			}
+			if got := w.Header().Get(HeaderUserOrg); got != tt.userOrg {
+				t.Errorf("expected %s '%s', got '%s'", HeaderUserOrg, tt.userOrg, got)
+			}
+
+			if w.Code == http.StatusOK {
+				return
+			}
+
+			var body envoyDeniedBody
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid denied body: %v", err)
+			}
+			if body.Reason == "" || body.RuleID != tt.ruleID {
+				t.Errorf("unexpected denied body %+v", body)
+			}
+		})
+	}
+}
+
+func TestEnvoyOriginalRequest(t *testing.T) {
+
+	r := httptest.NewRequest("DELETE", EnvoyPathPrefix+"/catalog/productOffering/urn:ngsi-ld:product-offering:1?x=1", nil)
+	r.Host = "dome-marketplace.example"
+	r.RemoteAddr = "10.0.0.1:4321"
+
+	original := envoyOriginalRequest(r)
+
+	want := map[string]string{
+		"X-Original-URI":         "/catalog/productOffering/urn:ngsi-ld:product-offering:1?x=1",
+		"X-Original-Method":      "DELETE",
+		"X-Original-Host":        "dome-marketplace.example",
+		"X-Original-Remote-Addr": "10.0.0.1:4321",
+	}
+	for name, value := range want {
+		if got := original.Header.Get(name); got != value {
+			t.Errorf("%s: expected '%s', got '%s'", name, value, got)
+		}
+	}
+
+	if r.Header.Get("X-Original-URI") != "" {
+		t.Errorf("the check request was modified")
+	}
+}
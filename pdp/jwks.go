@@ -0,0 +1,328 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	conf "github.com/hesusruiz/domeproxy/config"
+	"github.com/hesusruiz/domeproxy/internal/errl"
+	"gitlab.com/greyxor/slogor"
+)
+
+// DefaultJWKSRefreshInterval is the maximum time the keys of the Verifier are used without refreshing them, if not configured.
+const DefaultJWKSRefreshInterval = 1 * time.Hour
+
+// DefaultJWKSMinRefreshInterval is the minimum time between two retrievals of the keys of the Verifier, if not configured.
+// It limits the retrievals caused by tokens signed with unknown keys.
+const DefaultJWKSMinRefreshInterval = 1 * time.Minute
+
+// ErrUnknownVerificationKey is returned when the Access Token was signed with a key which is not
+// in the key set of the Verifier, even after refreshing it.
+var ErrUnknownVerificationKey = fmt.Errorf("unknown verification key")
+
+// jwksResponse is the key set retrieved from the Verifier, with the information in the HTTP headers
+// needed for caching it.
+type jwksResponse struct {
+	keys *jose.JSONWebKeySet
+
+	// The validators of the response, to make conditional requests
+	etag         string
+	lastModified string
+
+	// The time the response can be cached according to the headers, or -1 if they do not specify it
+	maxAge time.Duration
+}
+
+// jwksFetcher retrieves the key set, receiving the previous response (or nil) to make a conditional request.
+// If the key set did not change, it returns the previous keys.
+type jwksFetcher func(previous *jwksResponse) (*jwksResponse, error)
+
+// verifierKeySet keeps the key set used to verify the Access Tokens, refreshing it when it expires and
+// when a token is signed with an unknown key, so a key rotation in the Verifier does not require a restart.
+// If the Verifier can not be reached, the last key set retrieved is used.
+//
+// It is safe for concurrent use, and it is shared by all the evaluators of a PDP.
+type verifierKeySet struct {
+	fetch              jwksFetcher
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+
+	// The clock, replaced in tests
+	now func() time.Time
+
+	// Serializes the retrievals of the key set
+	fetchMu sync.Mutex
+
+	mu          sync.Mutex
+	current     *jwksResponse
+	expires     time.Time
+	lastAttempt time.Time
+	refreshing  bool
+}
+
+func newVerifierKeySet(fetch jwksFetcher, refreshInterval time.Duration, minRefreshInterval time.Duration) *verifierKeySet {
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultJWKSRefreshInterval
+	}
+	if minRefreshInterval <= 0 {
+		minRefreshInterval = DefaultJWKSMinRefreshInterval
+	}
+	if minRefreshInterval > refreshInterval {
+		minRefreshInterval = refreshInterval
+	}
+	return &verifierKeySet{
+		fetch:              fetch,
+		refreshInterval:    refreshInterval,
+		minRefreshInterval: minRefreshInterval,
+		now:                time.Now,
+	}
+}
+
+// Key returns the key with the given key identifier (the 'kid' header of the token). Tokens without
+// identifier use the first key of the set, and a set with a single key without identifier is used for all tokens.
+func (ks *verifierKeySet) Key(kid string) (*jose.JSONWebKey, error) {
+
+	ks.mu.Lock()
+	current := ks.current
+	expired := ks.now().After(ks.expires)
+	startRefresh := current != nil && expired && !ks.refreshing
+	if startRefresh {
+		ks.refreshing = true
+	}
+	ks.mu.Unlock()
+
+	if current == nil {
+		// There is no key set yet, so we must wait for it
+		if err := ks.refresh(); err != nil {
+			return nil, err
+		}
+	} else if startRefresh {
+		// The expired key set is still used while the new one is retrieved
+		go func() {
+			defer func() {
+				ks.mu.Lock()
+				ks.refreshing = false
+				ks.mu.Unlock()
+			}()
+			if err := ks.refresh(); err != nil {
+				slog.Warn("refreshing the verification keys, using the previous ones", slogor.Err(err))
+			}
+		}()
+	}
+
+	if key := ks.lookup(kid); key != nil {
+		return key, nil
+	}
+
+	// The token may be signed with a new key of the Verifier
+	if err := ks.refresh(); err != nil {
+		slog.Warn("refreshing the verification keys for an unknown key", "kid", kid, slogor.Err(err))
+	}
+	if key := ks.lookup(kid); key != nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%w: '%s'", ErrUnknownVerificationKey, kid)
+}
+
+// lookup selects the key in the current key set, or returns nil if there is no suitable key.
+func (ks *verifierKeySet) lookup(kid string) *jose.JSONWebKey {
+
+	ks.mu.Lock()
+	current := ks.current
+	ks.mu.Unlock()
+
+	if current == nil || len(current.keys.Keys) == 0 {
+		return nil
+	}
+	keys := current.keys.Keys
+
+	if kid == "" {
+		return &keys[0]
+	}
+	if found := current.keys.Key(kid); len(found) > 0 {
+		return &found[0]
+	}
+	if len(keys) == 1 && keys[0].KeyID == "" {
+		return &keys[0]
+	}
+
+	return nil
+}
+
+// refresh retrieves the key set, unless it was retrieved less than the minimum refresh interval ago.
+// If the retrieval fails the current key set is kept, and the error is returned.
+func (ks *verifierKeySet) refresh() error {
+
+	ks.fetchMu.Lock()
+	defer ks.fetchMu.Unlock()
+
+	ks.mu.Lock()
+	now := ks.now()
+	if !ks.lastAttempt.IsZero() && now.Sub(ks.lastAttempt) < ks.minRefreshInterval {
+		ks.mu.Unlock()
+		return nil
+	}
+	ks.lastAttempt = now
+	previous := ks.current
+	ks.mu.Unlock()
+
+	response, err := ks.fetch(previous)
+	if err != nil {
+		return err
+	}
+
+	// The caching headers determine the next refresh, within the configured limits
+	ttl := response.maxAge
+	if ttl < 0 || ttl > ks.refreshInterval {
+		ttl = ks.refreshInterval
+	}
+	if ttl < ks.minRefreshInterval {
+		ttl = ks.minRefreshInterval
+	}
+
+	ks.mu.Lock()
+	ks.current = response
+	ks.expires = now.Add(ttl)
+	ks.mu.Unlock()
+
+	slog.Debug("verification keys retrieved", "keys", len(response.keys.Keys), "expires", ks.expires)
+	return nil
+}
+
+// verifierJWKSFetcher retrieves the key set from the JWKS endpoint of the Verifier in the configuration,
+// which is discovered with its OpenID configuration the first time.
+func verifierJWKSFetcher(config *conf.Config, client *http.Client) jwksFetcher {
+	var jwksURI string
+
+	return func(previous *jwksResponse) (*jwksResponse, error) {
+		if jwksURI == "" {
+			oid, err := NewOpenIDConfig(config)
+			if err != nil {
+				return nil, err
+			}
+			jwksURI = oid.JwksUri
+		}
+		return fetchJWKS(client, jwksURI, previous)
+	}
+}
+
+// keyFuncFetcher adapts a function supplying a single verification key, which is called on each refresh.
+func keyFuncFetcher(config *conf.Config, keyFunc func(config *conf.Config) (*jose.JSONWebKey, error)) jwksFetcher {
+	return func(previous *jwksResponse) (*jwksResponse, error) {
+		key, err := keyFunc(config)
+		if err != nil {
+			return nil, err
+		}
+		return &jwksResponse{keys: &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{*key}}, maxAge: -1}, nil
+	}
+}
+
+// fetchJWKS retrieves a key set from the uri. If there is a previous response, the request is conditional,
+// and the previous keys are returned if they did not change.
+func fetchJWKS(client *http.Client, uri string, previous *jwksResponse) (*jwksResponse, error) {
+
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+	if previous != nil {
+		if previous.etag != "" {
+			req.Header.Set("If-None-Match", previous.etag)
+		}
+		if previous.lastModified != "" {
+			req.Header.Set("If-Modified-Since", previous.lastModified)
+		}
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errl.Errorf("retrieving JWKS from %s: %w", uri, err)
+	}
+	defer res.Body.Close()
+
+	maxAge := cacheMaxAge(res.Header, time.Now())
+
+	if res.StatusCode == http.StatusNotModified && previous != nil {
+		return &jwksResponse{
+			keys:         previous.keys,
+			etag:         previous.etag,
+			lastModified: previous.lastModified,
+			maxAge:       maxAge,
+		}, nil
+	}
+	if res.StatusCode > 299 {
+		return nil, errl.Errorf("retrieving JWKS from %s: response failed with status: %d", uri, res.StatusCode)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, errl.Errorf("reading JWKS from %s: %w", uri, err)
+	}
+
+	var jwks = &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(body, jwks); err != nil {
+		return nil, errl.Errorf("unmarshalling JWKS from %s: %w", uri, err)
+	}
+	if len(jwks.Keys) == 0 {
+		return nil, errl.Errorf("no JWK keys returned from %s", uri)
+	}
+
+	return &jwksResponse{
+		keys:         jwks,
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+		maxAge:       maxAge,
+	}, nil
+}
+
+// cacheMaxAge returns the time a response can be cached according to its Cache-Control or Expires headers,
+// or -1 if they do not specify it. Responses which must not be cached return zero.
+func cacheMaxAge(header http.Header, now time.Time) time.Duration {
+
+	if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
+		maxAge := time.Duration(-1)
+		for _, directive := range strings.Split(cacheControl, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache":
+				return 0
+			case "max-age":
+				if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds >= 0 {
+					maxAge = time.Duration(seconds) * time.Second
+				}
+			}
+		}
+		if maxAge >= 0 {
+			return maxAge
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			now = date
+		}
+		if maxAge := expiresAt.Sub(now); maxAge > 0 {
+			return maxAge
+		}
+		return 0
+	}
+
+	return -1
+}
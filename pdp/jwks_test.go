@@ -0,0 +1,256 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+	conf "github.com/hesusruiz/domeproxy/config"
+)
+
+// fakeVerifier serves the OpenID configuration and the key set of a Verifier whose keys can be rotated.
+type fakeVerifier struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	keys         map[string]*ecdsa.PrivateKey
+	version      int
+	requests     int
+	notModified  int
+	cacheControl string
+	failing      bool
+}
+
+func newFakeVerifier(t *testing.T, kids ...string) *fakeVerifier {
+	v := &fakeVerifier{}
+	v.rotate(t, kids...)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer": %q, "jwks_uri": %q}`, v.URL, v.URL+"/jwks")
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		v.requests++
+		if v.failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		etag := fmt.Sprintf(`"%d"`, v.version)
+		w.Header().Set("ETag", etag)
+		if v.cacheControl != "" {
+			w.Header().Set("Cache-Control", v.cacheControl)
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			v.notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		jwks := jose.JSONWebKeySet{}
+		for kid, key := range v.keys {
+			jwks.Keys = append(jwks.Keys, jose.JSONWebKey{Key: &key.PublicKey, KeyID: kid, Algorithm: "ES256", Use: "sig"})
+		}
+		json.NewEncoder(w).Encode(jwks)
+	})
+	v.Server = httptest.NewServer(mux)
+	t.Cleanup(v.Close)
+
+	return v
+}
+
+// rotate replaces the keys of the Verifier by new keys with the given identifiers.
+func (v *fakeVerifier) rotate(t *testing.T, kids ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.keys = map[string]*ecdsa.PrivateKey{}
+	for _, kid := range kids {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.keys[kid] = key
+	}
+	v.version++
+}
+
+func (v *fakeVerifier) token(t *testing.T, kid string, key *ecdsa.PrivateKey) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"iss": v.URL, "sub": "did:key:mandatee"})
+	token.Header["kid"] = kid
+	tokString, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokString
+}
+
+func (v *fakeVerifier) key(kid string) *ecdsa.PrivateKey {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.keys[kid]
+}
+
+func (v *fakeVerifier) counters() (requests int, notModified int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.requests, v.notModified
+}
+
+func TestVerifierKeyRotation(t *testing.T) {
+
+	verifier := newFakeVerifier(t, "k1", "k2")
+
+	policyFile := filepath.Join(t.TempDir(), "policy.star")
+	if err := os.WriteFile(policyFile, []byte("def authorize():\n    return True\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewPDP(&conf.Config{
+		PolicyFileName:         policyFile,
+		VerifierServer:         verifier.URL,
+		JWKSMinRefreshInterval: time.Nanosecond,
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both keys of the set are accepted, selected by the identifier in the token
+	for _, kid := range []string{"k1", "k2"} {
+		if _, _, err := m.getClaimsFromToken(verifier.token(t, kid, verifier.key(kid))); err != nil {
+			t.Errorf("token signed with %s: %v", kid, err)
+		}
+	}
+
+	// A token signed with the key of another set is rejected
+	oldKey := verifier.key("k1")
+	if _, _, err := m.getClaimsFromToken(verifier.token(t, "k2", oldKey)); err == nil {
+		t.Errorf("expected an error with a token signed with the wrong key")
+	}
+
+	// After a rotation, the new key is retrieved when a token uses it
+	verifier.rotate(t, "k3")
+	if _, _, err := m.getClaimsFromToken(verifier.token(t, "k3", verifier.key("k3"))); err != nil {
+		t.Errorf("token signed with the new key: %v", err)
+	}
+
+	_, _, err = m.getClaimsFromToken(verifier.token(t, "k1", oldKey))
+	if !errors.Is(err, ErrUnknownVerificationKey) {
+		t.Errorf("expected an unknown key error for a token signed with a retired key, got %v", err)
+	}
+}
+
+func TestVerifierKeySetRefresh(t *testing.T) {
+
+	verifier := newFakeVerifier(t, "k1")
+	verifier.cacheControl = "public, max-age=300"
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var clockMu sync.Mutex
+	advance := func(d time.Duration) {
+		clockMu.Lock()
+		now = now.Add(d)
+		clockMu.Unlock()
+	}
+
+	ks := newVerifierKeySet(verifierJWKSFetcher(&conf.Config{VerifierServer: verifier.URL}, http.DefaultClient), time.Hour, time.Minute)
+	ks.now = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return now
+	}
+
+	if key, err := ks.Key("k1"); err != nil || key.KeyID != "k1" {
+		t.Fatalf("expected key k1, got %v %v", key, err)
+	}
+
+	// Unknown keys cause a conditional request, which is rate limited
+	advance(2 * time.Minute)
+	for range 3 {
+		if _, err := ks.Key("k9"); !errors.Is(err, ErrUnknownVerificationKey) {
+			t.Fatalf("expected an unknown key error, got %v", err)
+		}
+	}
+	if requests, notModified := verifier.counters(); requests != 2 || notModified != 1 {
+		t.Fatalf("expected 2 requests and 1 not modified, got %d and %d", requests, notModified)
+	}
+
+	// The key set expires according to the caching headers, and is refreshed in the background
+	waitForRequests := func(n int) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			if requests, _ := verifier.counters(); requests >= n {
+				return
+			}
+		}
+		t.Fatalf("expected %d requests to the Verifier", n)
+	}
+
+	advance(4 * time.Minute)
+	if _, err := ks.Key("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if requests, _ := verifier.counters(); requests != 2 {
+		t.Fatalf("the key set was refreshed before expiring")
+	}
+
+	advance(2 * time.Minute)
+	if _, err := ks.Key("k1"); err != nil {
+		t.Fatal(err)
+	}
+	waitForRequests(3)
+
+	// The last key set is used while the Verifier is unreachable
+	verifier.mu.Lock()
+	verifier.failing = true
+	verifier.mu.Unlock()
+
+	advance(time.Hour)
+	for range 2 {
+		if key, err := ks.Key("k1"); err != nil || key.KeyID != "k1" {
+			t.Fatalf("expected the previous key k1, got %v %v", key, err)
+		}
+	}
+	waitForRequests(4)
+}
+
+func TestCacheMaxAge(t *testing.T) {
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header http.Header
+		want   time.Duration
+	}{
+		{http.Header{}, -1},
+		{http.Header{"Cache-Control": {"public, max-age=600"}}, 10 * time.Minute},
+		{http.Header{"Cache-Control": {"max-age=600, no-cache"}}, 0},
+		{http.Header{"Cache-Control": {"no-store"}}, 0},
+		{http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{http.Header{"Expires": {"0"}}, 0},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := cacheMaxAge(tt.header, now); got != tt.want {
+			t.Errorf("%v: expected %v, got %v", tt.header, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	st "go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// DefaultPolicyMaxSteps is the maximum number of Starlark execution steps for a single evaluation
+// of the policies, if not configured.
+const DefaultPolicyMaxSteps = 1_000_000
+
+// DefaultPolicyTimeout is the maximum wall-clock time for a single evaluation of the policies, if not configured.
+const DefaultPolicyTimeout = 2 * time.Second
+
+var (
+	ErrPolicyStepsExceeded    = errors.New("policy evaluation exceeded the maximum number of steps")
+	ErrPolicyDeadlineExceeded = errors.New("policy evaluation exceeded the deadline")
+)
+
+// callWithLimits calls the Starlark function in the thread of te, with a limit in the number of execution steps
+// and cancelling the thread if the context is done or the evaluation takes longer than the configured timeout.
+// The thread is left ready to be used again, whatever the result of the call.
+func (m *PDP) callWithLimits(ctx context.Context, te *threadEntry, fn *st.Function, args st.Tuple) (st.Value, error) {
+
+	if fn == nil {
+		return nil, fmt.Errorf("function not defined in the policy")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.policyTimeout)
+	defer cancel()
+
+	// The information built-ins take their database connection with the deadline of this evaluation
+	if pip, _ := te.thread.Local(localPIP).(*pipState); pip != nil {
+		pip.ctx = ctx
+		defer pip.release()
+	}
+
+	var result st.Value
+	err := m.runWithLimits(ctx, te.thread, func() (err error) {
+		result, err = st.Call(te.thread, fn, args, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// execWithLimits executes the top-level statements of a policy file or a module in the thread, with the same
+// limits as the evaluation of the policies, so a file can not hang its compilation.
+func (m *PDP) execWithLimits(thread *st.Thread, filename string, src any, predeclared st.StringDict) (st.StringDict, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.policyTimeout)
+	defer cancel()
+
+	var globals st.StringDict
+	err := m.runWithLimits(ctx, thread, func() (err error) {
+		globals, err = st.ExecFileOptions(&syntax.FileOptions{}, thread, filename, src, predeclared)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return globals, nil
+}
+
+// runWithLimits runs the Starlark code in the thread with a limit in the number of execution steps,
+// cancelling the thread when the context is done.
+// The thread is left ready to be used again, whatever the result of the execution.
+func (m *PDP) runWithLimits(ctx context.Context, thread *st.Thread, run func() error) error {
+
+	thread.Steps = 0
+	thread.SetMaxExecutionSteps(m.policyMaxSteps)
+
+	// Cancel the Starlark thread when the context is done.
+	// If cancellation already started, wait until it finishes before resetting the thread.
+	cancelled := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		thread.Cancel(ctx.Err().Error())
+		close(cancelled)
+	})
+	defer func() {
+		if !stop() {
+			<-cancelled
+		}
+		thread.Uncancel()
+		thread.Steps = 0
+	}()
+
+	if err := run(); err != nil {
+		switch {
+		case thread.Steps >= m.policyMaxSteps:
+			return fmt.Errorf("%w (%d): %w", ErrPolicyStepsExceeded, m.policyMaxSteps, err)
+		case ctx.Err() != nil:
+			return fmt.Errorf("%w: %w", ErrPolicyDeadlineExceeded, err)
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEvaluationLimits(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+	policy := `
+def authorize():
+    if input.user.loop:
+        for i in range(1000000000):
+            pass
+    return True
+`
+	if err := os.WriteFile(policyFile, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decide := func(loop bool) error {
+		t.Helper()
+		input := StarTMFMap{"user": StarTMFMap{"loop": loop}}
+		decision, err := m.TakeAuthnDecision(Authorize, input)
+		if err == nil && !decision.Allow {
+			t.Fatal("unexpected deny")
+		}
+		return err
+	}
+
+	m.policyMaxSteps = 10_000
+	if err := decide(true); !errors.Is(err, ErrPolicyStepsExceeded) {
+		t.Fatalf("expected ErrPolicyStepsExceeded, got %v", err)
+	}
+
+	// The threads in the pool can be used again
+	if err := decide(false); err != nil {
+		t.Fatalf("thread not reset after exceeding the steps: %v", err)
+	}
+
+	m.policyMaxSteps = 1 << 62
+	m.policyTimeout = 20 * time.Millisecond
+	if err := decide(true); !errors.Is(err, ErrPolicyDeadlineExceeded) {
+		t.Fatalf("expected ErrPolicyDeadlineExceeded, got %v", err)
+	}
+
+	if err := decide(false); err != nil {
+		t.Fatalf("thread not reset after the deadline: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hesusruiz/domeproxy/tmfcache"
+	st "go.starlark.net/starlark"
+)
+
+// The name of the functions declaring the row-level constraints for LIST requests,
+// like 'list_filter' or 'list_filter_productOffering'
+const listFilterName = "list_filter"
+
+// listFilters calls the most specific 'list_filter' function of the policy for the resource of the request, if
+// any, and returns the row-level constraints it declares, which the PDP translates into conditions of the query
+// to the database. The function has access to the 'request', 'token' and 'user' members of the input, but
+// not to the object. For example:
+//
+//	def list_filter():
+//	    return [
+//	        {"field": "lifecycleStatus", "op": "in", "values": ["Launched", "Active"]},
+//	        {"field": "prohibitedCountries", "op": "not contains", "value": input.user.country},
+//	    ]
+//
+// The constraints only reduce the number of objects evaluated, which are still checked one by one with
+// the 'authorize' functions, so it is safe if they are less restrictive than those functions.
+// See [tmfcache.RowFilter] for the supported fields and operators.
+func (m *PDP) listFilters(ctx context.Context, input StarTMFMap) ([]tmfcache.RowFilter, error) {
+
+	ent := m.threadPool.Get()
+	if ent == nil {
+		return nil, fmt.Errorf("getting a thread entry from pool")
+	}
+	defer m.threadPool.Put(ent)
+
+	te := ent.(*threadEntry)
+	if te == nil {
+		return nil, fmt.Errorf("invalid entry type in the pool")
+	}
+
+	// Check if the thread is still valid. If not, we need to recompile the file.
+	if err := m.Reset(te); err != nil {
+		return nil, err
+	}
+
+	request, _ := input["request"].(StarTMFMap)
+	resource, _ := request["resource"].(string)
+
+	filterFunction, ok := te.listFilterFunctions[resource]
+	if !ok {
+		filterFunction, ok = te.listFilterFunctions[""]
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	te.predeclared["input"] = input
+	te.thread.SetLocal(localPIP, &pipState{source: m.objectSource, remaining: m.pipCallBudget})
+	te.thread.SetLocal(localInput, input)
+	defer func() {
+		te.predeclared["input"] = StarTMFMap{}
+		te.thread.SetLocal(localPIP, nil)
+		te.thread.SetLocal(localInput, nil)
+	}()
+
+	result, err := m.callWithLimits(ctx, te, filterFunction, nil)
+	if err != nil {
+		return nil, fmt.Errorf("calling %s: %w", filterFunction.Name(), err)
+	}
+
+	filters, err := rowFiltersFromStarlark(result)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filterFunction.Name(), err)
+	}
+
+	return filters, nil
+}
+
+// rowFiltersFromStarlark converts the list of constraints returned by a 'list_filter' function. Each constraint
+// is a dict or struct with the 'field' and 'op' fields, and either a 'value' or a list of 'values'.
+func rowFiltersFromStarlark(result st.Value) ([]tmfcache.RowFilter, error) {
+
+	if result == st.None {
+		return nil, nil
+	}
+
+	list, ok := result.(st.Indexable)
+	if !ok {
+		return nil, fmt.Errorf("function returned wrong type: %v", result.Type())
+	}
+	constraints, err := starlarkListToGo(list)
+	if err != nil {
+		return nil, err
+	}
+
+	var filters []tmfcache.RowFilter
+	for i, c := range constraints {
+		constraint, ok := c.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("constraint %d: expected a dict, got %T", i, c)
+		}
+
+		filter := tmfcache.RowFilter{}
+		filter.Field, _ = constraint["field"].(string)
+		filter.Op, _ = constraint["op"].(string)
+
+		values := constraint["values"]
+		if value, found := constraint["value"]; found {
+			values = []any{value}
+		}
+		list, ok := values.([]any)
+		if !ok {
+			return nil, fmt.Errorf("constraint %d: 'values' must be a list", i)
+		}
+		for _, v := range list {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("constraint %d: values must be strings, got %T", i, v)
+			}
+			filter.Values = append(filter.Values, s)
+		}
+
+		// The objects can restrict the countries with groups like "EU", so a country is also
+		// selected by the groups which include it
+		if filter.Field == "permittedCountries" || filter.Field == "prohibitedCountries" {
+			var codes []string
+			for _, country := range filter.Values {
+				codes = append(codes, regionsIncluding(country)...)
+			}
+			filter.Values = codes
+		}
+
+		if err := filter.Validate(); err != nil {
+			return nil, fmt.Errorf("constraint %d: %w", i, err)
+		}
+		filters = append(filters, filter)
+	}
+
+	return filters, nil
+}
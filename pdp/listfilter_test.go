@@ -0,0 +1,194 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	conf "github.com/hesusruiz/domeproxy/config"
+	"github.com/hesusruiz/domeproxy/tmfcache"
+)
+
+func TestAuthorizeLISTWithFilters(t *testing.T) {
+
+	dir := t.TempDir()
+
+	tmf, err := tmfcache.NewTMFCache(&conf.Config{Dbname: filepath.Join(dir, "tmf.db")}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tmf.Close)
+	tmf.Maxfreshness = math.MaxInt
+
+	offerings := []struct {
+		status     string
+		prohibited string
+	}{
+		{"Launched", ""},
+		{"Retired", ""},
+		{"Launched", "ES"},
+		{"Launched", "FR"},
+		{"Launched", "eu"},
+		{"Launched", "EL"},
+	}
+	for i, o := range offerings {
+		id := fmt.Sprintf("urn:ngsi-ld:product-offering:%04d", i)
+		terms := "[]"
+		if o.prohibited != "" {
+			terms = fmt.Sprintf(`[{"@type": "OperatorRestriction", "prohibitedLegalRegion": [{"country": %q}]}]`, o.prohibited)
+		}
+		content := fmt.Sprintf(`{"id": %q, "href": %q, "@type": "productOffering", "lifecycleStatus": %q,
+			"lastUpdate": "2025-01-01T00:00:00Z", "productOfferingTerm": %s,
+			"relatedParty": [{"role": "Seller", "partyOrPartyRole": {"@type": "PartyRef", "id": "did:elsi:VATES-1", "name": "did:elsi:VATES-1"}}]}`,
+			id, id, o.status, terms)
+		object, err := tmfcache.TMFObjectFromBytes([]byte(content), "productOffering")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tmf.LocalUpsertTMFObject(nil, object); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The policy accepts everything except the last object, so the others can only be excluded by the filters
+	const authorize = `
+def authorize():
+    return input.tmf.id != "urn:ngsi-ld:product-offering:0003"
+`
+
+	tests := []struct {
+		name   string
+		filter string
+		want   []string
+	}{
+		{"without filters", "", []string{"0000", "0001", "0002", "0004", "0005"}},
+		{"filters for the resource", `
+def list_filter_productOffering():
+    return [
+        {"field": "lifecycleStatus", "op": "in", "values": ["Launched", "Active"]},
+        struct(field="prohibitedCountries", op="not contains", value="ES"),
+    ]
+`, []string{"0000", "0005"}},
+		{"countries in groups", `
+def list_filter():
+    return [{"field": "prohibitedCountries", "op": "not contains", "value": "it"}]
+`, []string{"0000", "0001", "0002", "0005"}},
+		{"countries with aliases", `
+def list_filter():
+    return [{"field": "prohibitedCountries", "op": "not contains", "value": "GR"}]
+`, []string{"0000", "0001", "0002"}},
+		{"countries outside groups", `
+def list_filter():
+    return [{"field": "prohibitedCountries", "op": "not contains", "value": "CH"}]
+`, []string{"0000", "0001", "0002", "0004", "0005"}},
+		{"generic filters", `
+def list_filter():
+    return [{"field": "lifecycleStatus", "op": "!=", "value": "Launched"}]
+`, []string{"0001"}},
+		{"filters for another resource", `
+def list_filter_productSpecification():
+    return [{"field": "lifecycleStatus", "op": "==", "value": "Retired"}]
+`, []string{"0000", "0001", "0002", "0004", "0005"}},
+		{"invalid filters are ignored", `
+def list_filter():
+    return [{"field": "lifecycleStatus", "op": "like", "value": "Launched"}]
+`, []string{"0000", "0001", "0002", "0004", "0005"}},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			policyFile := filepath.Join(dir, fmt.Sprintf("policy%d.star", i))
+			if err := os.WriteFile(policyFile, []byte(authorize+tt.filter), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			m, err := NewOfflinePDP(policyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const uri = "/tmf-api/productCatalogManagement/v4/productOffering"
+			r := httptest.NewRequest("GET", uri, nil)
+			r.Header.Set("X-Original-URI", uri)
+			r.Header.Set("X-Original-Method", "GET")
+			objects, err := AuthorizeLIST(slog.Default(), tmf, m, r, "productCatalogManagement", "productOffering")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, o := range objects {
+				got = append(got, o.GetID()[len("urn:ngsi-ld:product-offering:"):])
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAuthorizeLISTWithFiltersUsesLatestVersion(t *testing.T) {
+
+	dir := t.TempDir()
+
+	tmf, err := tmfcache.NewTMFCache(&conf.Config{Dbname: filepath.Join(dir, "tmf.db")}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tmf.Close)
+	tmf.Maxfreshness = math.MaxInt
+
+	// The latest version of the object is retired, but the previous one satisfies the filter
+	const id = "urn:ngsi-ld:product-offering:0000"
+	for _, v := range []struct{ version, status string }{{"0.1", "Launched"}, {"0.2", "Retired"}} {
+		content := fmt.Sprintf(`{"id": %q, "href": %q, "@type": "productOffering", "version": %q, "lifecycleStatus": %q,
+			"lastUpdate": "2025-01-01T00:00:00Z",
+			"relatedParty": [{"role": "Seller", "partyOrPartyRole": {"@type": "PartyRef", "id": "did:elsi:VATES-1", "name": "did:elsi:VATES-1"}}]}`,
+			id, id, v.version, v.status)
+		object, err := tmfcache.TMFObjectFromBytes([]byte(content), "productOffering")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tmf.LocalUpsertTMFObject(nil, object); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policyFile := filepath.Join(t.TempDir(), "policy.star")
+	policy := `
+def authorize():
+    return True
+
+def list_filter():
+    return [{"field": "lifecycleStatus", "op": "in", "values": ["Launched"]}]
+`
+	if err := os.WriteFile(policyFile, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const uri = "/tmf-api/productCatalogManagement/v4/productOffering"
+	r := httptest.NewRequest("GET", uri, nil)
+	r.Header.Set("X-Original-URI", uri)
+	r.Header.Set("X-Original-Method", "GET")
+	objects, err := AuthorizeLIST(slog.Default(), tmf, m, r, "productCatalogManagement", "productOffering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range objects {
+		t.Errorf("expected no objects, got version %s with status %v", o.GetVersion(), o.GetContentAsMap()["lifecycleStatus"])
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	st "go.starlark.net/starlark"
+)
+
+// Names of the thread locals used while loading modules
+const (
+	localDependencies = "dependencies"
+	localLoading      = "loading"
+	localModule       = "module"
+)
+
+// compiledModule is a helper module loaded by the policy with the 'load' statement, compiled and
+// ready to be used by any thread.
+type compiledModule struct {
+	// The hash of the content of the file that was compiled
+	hash uint64
+
+	// The globals of the module, which are frozen and can be shared among threads
+	globals st.StringDict
+
+	// The hashes of the modules loaded (directly or indirectly) by this one
+	dependencies map[string]uint64
+}
+
+// resolveModuleName returns the name of the module to use with the file cache.
+// Modules are resolved relative to the location of the module loading them (the base),
+// which can be a local file or a URL.
+func resolveModuleName(base string, module string) (string, error) {
+
+	if strings.HasPrefix(module, "https://") {
+		return module, nil
+	}
+
+	if strings.HasPrefix(base, "https://") {
+		base, err := url.Parse(base)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(module)
+		if err != nil {
+			return "", err
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+
+	if filepath.IsAbs(module) {
+		return filepath.Clean(module), nil
+	}
+
+	return filepath.Join(filepath.Dir(base), filepath.FromSlash(path.Clean(module))), nil
+}
+
+// loadModule implements the 'load' statement of Starlark, reading the module through the file cache,
+// so helper modules can be in the same place as the policy and are refreshed in the same way.
+//
+// Helper modules are compiled once per version of their content and shared among all the threads,
+// so they can not access the 'input' object directly: the policy must pass the data as arguments.
+func (m *PDP) loadModule(thread *st.Thread, module string) (st.StringDict, error) {
+
+	// The threads compiling a module record its name, otherwise the policy is loading it
+	base, _ := thread.Local(localModule).(string)
+	if base == "" {
+		base = m.scriptname
+	}
+
+	name, err := resolveModuleName(base, module)
+	if err != nil {
+		return nil, fmt.Errorf("invalid module name %s: %w", module, err)
+	}
+
+	// The dependencies of the policy being compiled, to detect later if any of them changes
+	dependencies, _ := thread.Local(localDependencies).(map[string]uint64)
+	if dependencies == nil {
+		dependencies = map[string]uint64{}
+	}
+
+	entry, err := m.getVerifiedFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("reading module %s: %w", name, err)
+	}
+
+	// Use the compiled module if it is the same version and its own dependencies did not change
+	if cm, ok := m.modules.Load(name); ok {
+		cm := cm.(*compiledModule)
+		if cm.hash == entry.FileHash && !m.dependenciesChanged(cm.dependencies) {
+			dependencies[name] = cm.hash
+			for k, v := range cm.dependencies {
+				dependencies[k] = v
+			}
+			return cm.globals, nil
+		}
+	}
+
+	// Detect cycles in the chain of loads
+	loading, _ := thread.Local(localLoading).(map[string]bool)
+	if loading[name] {
+		return nil, fmt.Errorf("cycle in load of module %s", name)
+	}
+	childLoading := map[string]bool{name: true}
+	for k := range loading {
+		childLoading[k] = true
+	}
+
+	// Compile the module in its own thread, recording its dependencies, with the same limits as the policies
+	cm := &compiledModule{
+		hash:         entry.FileHash,
+		dependencies: map[string]uint64{},
+	}
+
+	child := &st.Thread{
+		Name:  "load " + name,
+		Load:  thread.Load,
+		Print: thread.Print,
+	}
+	child.SetLocal(localDependencies, cm.dependencies)
+	child.SetLocal(localLoading, childLoading)
+	child.SetLocal(localModule, name)
+
+	cm.globals, err = m.execWithLimits(child, name, entry.Content, nil)
+	if err != nil {
+		return nil, err
+	}
+	cm.globals.Freeze()
+
+	m.modules.Store(name, cm)
+
+	dependencies[name] = cm.hash
+	for k, v := range cm.dependencies {
+		dependencies[k] = v
+	}
+
+	return cm.globals, nil
+}
+
+// dependenciesChanged returns true if the content of any of the files has changed.
+// An error reading a file is considered a change, so the error is reported when compiling again.
+func (m *PDP) dependenciesChanged(dependencies map[string]uint64) bool {
+	for name, hash := range dependencies {
+		entry, err := m.getVerifiedFile(name)
+		if err != nil || entry.FileHash != hash {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadHelperModules(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+	helperFile := filepath.Join(dir, "lib", "helpers.star")
+
+	policy := `
+load("lib/helpers.star", "is_allowed")
+
+def authorize():
+    return is_allowed(input.user.country)
+`
+	helper := `
+load("countries.star", "allowed")
+
+def is_allowed(country):
+    return country in allowed
+`
+	countries := `allowed = ["ES"]`
+
+	if err := os.MkdirAll(filepath.Dir(helperFile), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// The helper loads the module next to it, not the one next to the policy
+	for name, content := range map[string]string{
+		policyFile: policy,
+		helperFile: helper,
+		filepath.Join(dir, "lib", "countries.star"): countries,
+		filepath.Join(dir, "countries.star"):        `allowed = ["FR"]`,
+	} {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decide := func(country string) bool {
+		t.Helper()
+		input := StarTMFMap{"user": StarTMFMap{"country": country}}
+		decision, err := m.TakeAuthnDecision(Authorize, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decision.Allow
+	}
+
+	if !decide("ES") {
+		t.Errorf("ES should be allowed")
+	}
+	if decide("FR") {
+		t.Errorf("FR should not be allowed yet")
+	}
+
+	// A change in an indirect dependency must be picked up without changing the policy file
+	if err := m.PutFile(filepath.Join(dir, "lib", "countries.star"), []byte(`allowed = ["ES", "FR"]`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !decide("FR") {
+		t.Errorf("FR should be allowed after updating the helper module")
+	}
+}
+
+func TestResolveModuleName(t *testing.T) {
+
+	tests := []struct {
+		base   string
+		module string
+		want   string
+	}{
+		{"/policies/policy.star", "lib/helpers.star", "/policies/lib/helpers.star"},
+		{"/policies/lib/helpers.star", "countries.star", "/policies/lib/countries.star"},
+		{"/policies/lib/helpers.star", "../common.star", "/policies/common.star"},
+		{"/policies/lib/helpers.star", "/other/module.star", "/other/module.star"},
+		{"https://example.org/policies/lib/helpers.star", "countries.star", "https://example.org/policies/lib/countries.star"},
+		{"https://example.org/policies/lib/helpers.star", "../common.star", "https://example.org/policies/common.star"},
+		{"/policies/policy.star", "https://example.org/module.star", "https://example.org/module.star"},
+	}
+
+	for _, tt := range tests {
+		got, err := resolveModuleName(filepath.FromSlash(tt.base), tt.module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(tt.want, "https://") {
+			tt.want = filepath.FromSlash(tt.want)
+		}
+		if got != tt.want {
+			t.Errorf("%s from %s: expected %s, got %s", tt.module, tt.base, tt.want, got)
+		}
+	}
+}
+
+func TestLoadCycle(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+
+	files := map[string]string{
+		policyFile:                   "load(\"a.star\", \"x\")\ndef authorize():\n    return True\n",
+		filepath.Join(dir, "a.star"): "load(\"b.star\", \"y\")\nx = 1\n",
+		filepath.Join(dir, "b.star"): "load(\"a.star\", \"x\")\ny = 2\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewOfflinePDP(policyFile); err == nil {
+		t.Fatal("expected an error for a cycle in load")
+	}
+}
+
+func TestLoadModuleLimits(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+
+	files := map[string]string{
+		policyFile:                       "load(\"heavy.star\", \"x\")\ndef authorize():\n    return True\n",
+		filepath.Join(dir, "heavy.star"): "def spin():\n    for i in range(1000000000):\n        pass\n    return 1\n\nx = spin()\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The top-level code of the module is bounded like the evaluation of the policies
+	_, err := NewOfflinePDP(policyFile)
+	if !errors.Is(err, ErrPolicyStepsExceeded) {
+		t.Fatalf("expected the steps of the module to be limited, got %v", err)
+	}
+}
@@ -37,7 +37,7 @@ var MarshalSingleStringAsArray = true
 // NewNumericDate constructs a new *NumericDate from a standard library time.Time struct.
 // It will truncate the timestamp according to the precision specified in TimePrecision.
 func NewNumericDate(t time.Time) *jwt.NumericDate {
-	return &jwt.NumericDate{t.Truncate(TimePrecision)}
+	return &jwt.NumericDate{Time: t.Truncate(TimePrecision)}
 }
 
 // newNumericDateFromSeconds creates a new *NumericDate out of a float64 representing a
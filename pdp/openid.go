@@ -173,39 +173,19 @@ func NewOpenIDConfig(config *config.Config) (*OpenIDConfig, error) {
 	return oid, nil
 }
 
+// VerificationJWK retrieves the key set of the Verifier and returns its first key.
+// The PDP keeps the whole key set, selecting the key for each Access Token.
 func (oid *OpenIDConfig) VerificationJWK() (*jose.JSONWebKey, error) {
 
 	if oid.JwksUri == "" {
 		return nil, fmt.Errorf("no JwksUri")
 	}
 
-	res, err := http.Get(oid.JwksUri)
+	response, err := fetchJWKS(http.DefaultClient, oid.JwksUri, nil)
 	if err != nil {
-		slog.Error(err.Error())
-		return nil, err
-	}
-	body, err := io.ReadAll(res.Body)
-	res.Body.Close()
-	if res.StatusCode > 299 {
-		err := fmt.Errorf("response failed with status: %d", res.StatusCode)
-		return nil, err
-	}
-	if err != nil {
-		return nil, err
-	}
-
-	var jwks = &jose.JSONWebKeySet{}
-	err = json.Unmarshal(body, jwks)
-	if err != nil {
-		slog.Error("unmarshalling JWKS", slogor.Err(err))
-		return nil, err
-	}
-
-	if len(jwks.Keys) == 0 {
-		err := fmt.Errorf("no JWK keys returned")
 		return nil, err
 	}
 
-	return &jwks.Keys[0], nil
+	return &response.keys.Keys[0], nil
 
 }
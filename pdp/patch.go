@@ -0,0 +1,79 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// mergePatch returns the result of applying the patch to the target as a JSON Merge Patch (RFC 7386),
+// which is the format of the body of the PATCH requests in the TMForum APIs. The target is not modified.
+func mergePatch(target any, patch any) any {
+
+	patchMap, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	result := map[string]any{}
+	if targetMap, ok := target.(map[string]any); ok {
+		maps.Copy(result, targetMap)
+	}
+
+	for k, v := range patchMap {
+		if v == nil {
+			delete(result, k)
+			continue
+		}
+		result[k] = mergePatch(result[k], v)
+	}
+
+	return result
+}
+
+// objectChanges returns the members which are different in both objects, as a list of dicts with the
+// dotted 'path' of the member and its 'old' and 'new' values, which are None when the member does not
+// exist. Objects are compared member by member, and the rest of values, including lists, as a whole.
+func objectChanges(oldValue any, newValue any) []any {
+	changes := []any{}
+	collectChanges("", oldValue, newValue, &changes)
+	return changes
+}
+
+func collectChanges(path string, oldValue any, newValue any, changes *[]any) {
+
+	oldMap, oldIsMap := oldValue.(map[string]any)
+	newMap, newIsMap := newValue.(map[string]any)
+	if oldIsMap && newIsMap {
+		keys := slices.Collect(maps.Keys(oldMap))
+		for k := range newMap {
+			if _, found := oldMap[k]; !found {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+
+		for _, k := range keys {
+			memberPath := k
+			if path != "" {
+				memberPath = path + "." + k
+			}
+			collectChanges(memberPath, oldMap[k], newMap[k], changes)
+		}
+		return
+	}
+
+	if reflect.DeepEqual(oldValue, newValue) {
+		return
+	}
+
+	*changes = append(*changes, map[string]any{
+		"path": path,
+		"old":  oldValue,
+		"new":  newValue,
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergePatchAndChanges(t *testing.T) {
+
+	current := map[string]any{
+		"id":              "urn:1",
+		"lifecycleStatus": "Active",
+		"description":     "old",
+		"validFor":        map[string]any{"startDateTime": "2025-01-01", "endDateTime": "2025-12-31"},
+		"relatedParty":    []any{map[string]any{"role": "Seller", "id": "did:elsi:VATES-1"}},
+	}
+	patch := map[string]any{
+		"description": "new",
+		"validFor":    map[string]any{"endDateTime": nil},
+		"relatedParty": []any{
+			map[string]any{"role": "Seller", "id": "did:elsi:VATFR-2"},
+		},
+		"version": "2.0",
+	}
+
+	patched := mergePatch(current, patch).(map[string]any)
+
+	want := map[string]any{
+		"id":              "urn:1",
+		"lifecycleStatus": "Active",
+		"description":     "new",
+		"validFor":        map[string]any{"startDateTime": "2025-01-01"},
+		"relatedParty":    []any{map[string]any{"role": "Seller", "id": "did:elsi:VATFR-2"}},
+		"version":         "2.0",
+	}
+	if !reflect.DeepEqual(patched, want) {
+		t.Fatalf("unexpected patched object %v", patched)
+	}
+	if current["description"] != "old" || len(current["validFor"].(map[string]any)) != 2 {
+		t.Errorf("the stored object was modified: %v", current)
+	}
+
+	changes := objectChanges(current, patched)
+
+	var paths []string
+	for _, c := range changes {
+		paths = append(paths, c.(map[string]any)["path"].(string))
+	}
+	wantPaths := []string{"description", "relatedParty", "validFor.endDateTime", "version"}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Fatalf("expected changes in %v, got %v", wantPaths, paths)
+	}
+
+	if c := changes[2].(map[string]any); c["old"] != "2025-12-31" || c["new"] != nil {
+		t.Errorf("unexpected change %v", c)
+	}
+	if len(objectChanges(current, current)) != 0 {
+		t.Errorf("expected no changes for the same object")
+	}
+}
+
+func TestAuthorizeUPDATEInput(t *testing.T) {
+
+	m, tmf, tokString := newExternalAuthzFixture(t)
+
+	// The policy denies all updates, reporting what it received
+	policy := `
+def authorize():
+    paths = [c.path for c in input.changes]
+    return struct(allow=False, reason="%s %s %s" % (input.tmf.lifecycleStatus, input.tmf_new.lifecycleStatus, ",".join(paths)))
+`
+	if err := m.PutFile(m.config.PolicyFileName, []byte(policy)); err != nil {
+		t.Fatal(err)
+	}
+
+	const id = "urn:ngsi-ld:product-offering:0000"
+	const uri = "/tmf-api/productCatalogManagement/v4/productOffering/" + id
+	body := `{"lifecycleStatus": "Retired", "description": "no longer offered"}`
+
+	r := httptest.NewRequest("PATCH", uri, strings.NewReader(body))
+	r.Header.Set("X-Original-URI", uri)
+	r.Header.Set("X-Original-Method", "PATCH")
+	r.Header.Set("Authorization", "Bearer "+tokString)
+
+	_, err := AuthorizeUPDATE(slog.Default(), tmf, m, r, "productCatalogManagement", "productOffering", id)
+
+	var denied *DeniedError
+	if !errors.As(err, &denied) {
+		t.Fatalf("expected the policy to deny the update, got %v", err)
+	}
+	if want := "Launched Retired description,lifecycleStatus"; denied.Decision.Reason != want {
+		t.Errorf("expected the policy to receive '%s', got '%s'", want, denied.Decision.Reason)
+	}
+}
@@ -5,6 +5,9 @@
 package pdp
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"hash/maphash"
 	"io"
@@ -26,7 +29,6 @@ import (
 	starjson "go.starlark.net/lib/json"
 	"go.starlark.net/lib/math"
 	sttime "go.starlark.net/lib/time"
-	"go.starlark.net/repl"
 	st "go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
 	"go.starlark.net/syntax"
@@ -44,6 +46,8 @@ func init() {
 		Members: st.StringDict{
 			"getinput": st.NewBuiltin("getinput", getInputElement),
 			"getbody":  st.NewBuiltin("getbody", getRequestBody),
+			"get":      st.NewBuiltin("get", pipGet),
+			"list":     st.NewBuiltin("list", pipList),
 		},
 	}
 
@@ -52,6 +56,10 @@ func init() {
 	st.Universe["time"] = sttime.Module
 	st.Universe["math"] = math.Module
 	st.Universe["star"] = Module
+	st.Universe["dome"] = domeModule
+
+	// The 'struct' built-in allows policies to return structured decisions
+	st.Universe["struct"] = st.NewBuiltin("struct", starlarkstruct.Make)
 
 }
 
@@ -85,11 +93,14 @@ type PDP struct {
 	// If not specified by the caller, a default implementation is used, which uses the file system.
 	// readFileFun func(fileName string) (entry *FileEntry, err error)
 
-	// The public key used to verify the Access Tokens. In DOME they belong to the Verifier,
-	// and the PDP retrieves it dynamically depending on the environment.
+	// The public keys used to verify the Access Tokens. In DOME they belong to the Verifier,
+	// and the PDP retrieves them dynamically depending on the environment, refreshing them when they
+	// expire or a token is signed with an unknown key.
 	// The caller is able to provide a function to retrieve the key from a different place.
-	verifierJWK        *jose.JSONWebKey
-	verificationKeyFun func(config *conf.Config) (*jose.JSONWebKey, error)
+	verifierKeys *verifierKeySet
+
+	// The checks of the Access Tokens besides the signature, according to the environment.
+	tokenChecks *tokenChecks
 
 	debug bool
 
@@ -106,6 +117,40 @@ type PDP struct {
 	// the new version of the policies
 	threadPool sync.Pool
 
+	// The helper modules loaded by the policies, compiled and shared among all the threads.
+	modules sync.Map
+
+	// The public keys trusted to sign the policy files. If nil, signatures are not checked.
+	// The last version of each file with a valid signature is kept, to be used if a new version
+	// with an invalid signature is received.
+	trustedPolicyKeys *jose.JSONWebKeySet
+	verifiedFiles     sync.Map
+	rejectedFiles     sync.Map
+
+	// The cache of authorization decisions, nil if it is not enabled.
+	decisionCache *decisionCache
+
+	// The source of TMF objects for the information built-ins, and the maximum number of calls
+	// to them when taking a single decision.
+	objectSource  TMFObjectSource
+	pipCallBudget int
+
+	// The limits for a single evaluation of the policies, so a buggy policy can not block a request forever.
+	policyMaxSteps uint64
+	policyTimeout  time.Duration
+
+	// The evaluator of the candidate policy running in shadow mode, nil if not configured.
+	shadow *shadowEvaluator
+
+	// The store with the versions of the uploaded policy files, nil if not configured.
+	policyStore *PolicyStore
+
+	// The persistent log of the authorization decisions, nil if not configured.
+	auditLog *AuditLog
+
+	// The recorder of the inputs of the decisions, nil if not configured.
+	recorder *DecisionRecorder
+
 	// The http Client to retrieve the policies from a remote server if configured to do so.
 	httpClient *http.Client
 }
@@ -118,8 +163,8 @@ type PDP struct {
 //     provided, the default function is used, which reads from the disk and using a cache
 //     to improve performance.
 //   - verificationKeyFunc is a user-provided function to supply the verification key for
-//     access tokens. If not provided, the default function is used which queries the Verifier
-//     JWKS endpoint for the public key of the Verifier.
+//     access tokens, which is called again when the key expires. If not provided, the keys
+//     are retrieved from the Verifier JWKS endpoint, and selected with the 'kid' header of the token.
 func NewPDP(
 	config *conf.Config,
 	readFileFun func(fileName string) (fentry *conf.FileEntry, err error),
@@ -134,19 +179,29 @@ func NewPDP(
 	m.fileCache = conf.NewSimpleFileCache(nil)
 	m.fileCache.Get(config.PolicyFileName)
 
+	// Load the keys to verify the signatures of the policies, if configured
+	if config.PolicyTrustedKeysFile != "" {
+		keys, err := LoadTrustedPolicyKeys(config.PolicyTrustedKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		m.trustedPolicyKeys = keys
+	}
+
 	// Set either the user-supplied key retrieval function or the default one.
+	var fetch jwksFetcher
 	if verificationKeyFunc == nil {
-		m.verificationKeyFun = m.defaultVerificationKey
+		fetch = verifierJWKSFetcher(config, &http.Client{Timeout: 10 * time.Second})
 	} else {
-		m.verificationKeyFun = verificationKeyFunc
+		fetch = keyFuncFetcher(config, verificationKeyFunc)
 	}
+	m.verifierKeys = newVerifierKeySet(fetch, config.JWKSRefreshInterval, config.JWKSMinRefreshInterval)
+	m.tokenChecks = newTokenChecks(config, verificationKeyFunc == nil)
 
-	// Retrieve the key at initialization time, to discover any possible
+	// Retrieve the keys at initialization time, to discover any possible
 	// error in environment configuration as early as possible (eg, the Verifier is not running).
-	// TODO: provide for refresh of the key without restarting the PDP
 	var err error
-	m.verifierJWK, err = m.verificationKeyFun(config)
-	if err != nil {
+	if err = m.verifierKeys.refresh(); err != nil {
 		return nil, fmt.Errorf("error retrieving verification key: %w", err)
 	}
 
@@ -159,6 +214,23 @@ func NewPDP(
 
 	m.debug = config.Debug
 
+	// The decision cache is optional, and only enabled if configured with a size
+	m.decisionCache = newDecisionCache(config.DecisionCacheSize, config.DecisionCacheTTL)
+
+	m.pipCallBudget = config.PIPCallBudget
+	if m.pipCallBudget <= 0 {
+		m.pipCallBudget = DefaultPIPCallBudget
+	}
+
+	m.policyMaxSteps = config.PolicyMaxSteps
+	if m.policyMaxSteps == 0 {
+		m.policyMaxSteps = DefaultPolicyMaxSteps
+	}
+	m.policyTimeout = config.PolicyTimeout
+	if m.policyTimeout <= 0 {
+		m.policyTimeout = DefaultPolicyTimeout
+	}
+
 	// We use an http.Client with a timeout of 10 seconds and no redirects.
 	m.httpClient = &http.Client{
 		Timeout: 10 * time.Second,
@@ -167,37 +239,27 @@ func NewPDP(
 		},
 	}
 
-	return m, nil
-}
-
-// defaultVerificationKey returns the verification key for Access Tokens, in JWK format.
-//
-// It receives the config struct, enabling a different mechanism depending on it.
-func (m *PDP) defaultVerificationKey(config *conf.Config) (*jose.JSONWebKey, error) {
-
-	// Retrieve the OpenID configuration from the Verifier
-	oid, err := NewOpenIDConfig(config)
-	if err != nil {
-		return nil, err
-	}
-
-	// Use the link in the OpenID config to retrieve the key from the Verifier.
-	// In DOME, we use the first key from the keyset retrieved.
-	m.verifierJWK, err = oid.VerificationJWK()
-	if err != nil {
-		return nil, err
+	// The candidate policy, evaluated for every request in parallel with the active one
+	if config.ShadowPolicyFileName != "" {
+		m.shadow, err = m.newShadowEvaluator(config.ShadowPolicyFileName)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return m.verifierJWK, nil
-
+	return m, nil
 }
 
+// VerificationJWK returns the key used to verify the Access Tokens without a key identifier,
+// which is the first key of the Verifier.
 func (m *PDP) VerificationJWK() (key *jose.JSONWebKey, err error) {
-	if m.verifierJWK == nil {
-		m.verifierJWK, err = m.verificationKeyFun(m.config)
-		return m.verifierJWK, err
-	}
-	return m.verifierJWK, nil
+	return m.verifierKeys.Key("")
+}
+
+// VerificationKey returns the key of the Verifier with the key identifier in the 'kid' header of an Access Token.
+// The keys are retrieved again if there is no key with that identifier, so the Verifier can rotate its keys.
+func (m *PDP) VerificationKey(kid string) (key *jose.JSONWebKey, err error) {
+	return m.verifierKeys.Key(kid)
 }
 
 // threadEntry represents the pool of Starlark threads for policy rules execution.
@@ -214,6 +276,22 @@ type threadEntry struct {
 	authorizeFunction    *st.Function
 	scriptname           string
 	scriptHash           uint64
+
+	// The specialised authorization functions, indexed by the name without the 'authorize_' prefix
+	authorizeFunctions map[string]*st.Function
+
+	// The functions declaring the row-level constraints for LIST requests, indexed by resource,
+	// with the generic 'list_filter' function indexed by the empty string
+	listFilterFunctions map[string]*st.Function
+
+	// The hex encoded SHA256 hash of the policy file, which is stable across restarts, for the audit log
+	policyDigest string
+
+	// The hashes of the modules loaded by the policy, to detect when any of them changes
+	dependencies map[string]uint64
+
+	// The version of the policy and the modules it loads, used as part of the key of the decision cache
+	policyVersion uint64
 }
 
 // BufferedParseAndCompileFile reads a file with Starlark code and compiles it, storing the resulting global
@@ -223,6 +301,21 @@ type threadEntry struct {
 // creating a new Thread and so the old ones will never be called again and eventually will be disposed.
 func (m *PDP) BufferedParseAndCompileFile(scriptname string) *threadEntry {
 	slog.Debug("BufferedParseAndCompileFile Start")
+
+	te, err := m.parseAndCompileFile(scriptname)
+	if err != nil {
+		slog.Error("error compiling Starlark program", slogor.Err(err), "file", scriptname)
+		return nil
+	}
+
+	slog.Debug("BufferedParseAndCompileFile End")
+	return te
+
+}
+
+// parseAndCompileFile does the real work for BufferedParseAndCompileFile, returning any error
+// to the caller instead of just logging it.
+func (m *PDP) parseAndCompileFile(scriptname string) (*threadEntry, error) {
 	var err error
 
 	// The Starlark thread will be created for each invocation of the PDP in a local variable
@@ -234,7 +327,7 @@ func (m *PDP) BufferedParseAndCompileFile(scriptname string) *threadEntry {
 
 	// The compiled program context will be stored in a new Starlark thread for each invocation
 	te.thread = &st.Thread{
-		Load: repl.MakeLoadOptions(&syntax.FileOptions{}),
+		Load: m.loadModule,
 		Print: func(_ *st.Thread, msg string) {
 			logger.Info("rules => " + msg)
 		},
@@ -247,10 +340,10 @@ func (m *PDP) BufferedParseAndCompileFile(scriptname string) *threadEntry {
 	te.predeclared["input"] = StarTMFMap{}
 
 	// Get the file from the cache, which will be up to date according to its freshness policy.
-	entry, err := m.fileCache.Get(scriptname)
+	// If signatures are required, only a verified version of the file is returned.
+	entry, err := m.getVerifiedFile(scriptname)
 	if err != nil {
-		slog.Error("reading script", slogor.Err(err), "file", scriptname)
-		return nil
+		return nil, fmt.Errorf("reading script %s: %w", scriptname, err)
 	}
 
 	// entry, err := m.readFileFun(scriptname)
@@ -260,29 +353,31 @@ func (m *PDP) BufferedParseAndCompileFile(scriptname string) *threadEntry {
 	// }
 
 	te.scriptHash = entry.FileHash
+	te.policyDigest = fileDigest(entry.Content)
 	src := entry.Content
 
+	// Record the modules loaded by the policy
+	te.dependencies = map[string]uint64{}
+	te.thread.SetLocal(localDependencies, te.dependencies)
+
 	// Parse and execute the top-level commands in the script file
 	// The globals are thread-local and not process-global
-	te.globals, err = st.ExecFileOptions(&syntax.FileOptions{}, te.thread, scriptname, src, te.predeclared)
+	te.globals, err = m.execWithLimits(te.thread, scriptname, src, te.predeclared)
 	if err != nil {
-		slog.Error("error compiling Starlark program", slogor.Err(err))
-		return nil
+		return nil, err
 	}
 
 	// Make sure that the global environment is frozen so the Startlark script cannot
 	// modify it. This is important for security and to avoid concurrency problems.
 	te.globals.Freeze()
+	te.policyVersion = policyVersion(te.scriptHash, te.dependencies)
 
-	// The module has to define a function called 'authorize', which will be invoked
-	// for each request to access protected resources.
-	te.authorizeFunction, err = getGlobalFunction(te.globals, "authorize")
-	if err != nil {
-		return nil
+	// Look up the functions that the PDP invokes for each request
+	if err := te.resolveEntryPoints(); err != nil {
+		return nil, err
 	}
 
-	slog.Debug("BufferedParseAndCompileFile End")
-	return te
+	return te, nil
 
 }
 
@@ -290,40 +385,42 @@ func (m *PDP) Reset(te *threadEntry) error {
 
 	// Read the file again, to check if it has changed.
 	// entry, err := m.readFileFun(te.scriptname)
-	entry, err := m.fileCache.Get(te.scriptname)
+	entry, err := m.getVerifiedFile(te.scriptname)
 	if err != nil {
 		slog.Error("reading script", slogor.Err(err), "file", te.scriptname)
 		return nil
 	}
 
-	// If hashes are the same, we do not need to recompile the file.
-	if entry.FileHash == te.scriptHash {
+	// If hashes are the same for the policy and the modules it loads, we do not need to recompile the file.
+	if entry.FileHash == te.scriptHash && !m.dependenciesChanged(te.dependencies) {
 		return nil
 	}
 
 	// The file has changed, so we recompile it.
 	src := entry.Content
 
+	dependencies := map[string]uint64{}
+	te.thread.SetLocal(localDependencies, dependencies)
+
 	// Parse and execute the top-level commands in the script file
 	// The globals are thread-local and not process-global
-	te.globals, err = st.ExecFileOptions(&syntax.FileOptions{}, te.thread, te.scriptname, src, te.predeclared)
+	globals, err := m.execWithLimits(te.thread, te.scriptname, src, te.predeclared)
 	if err != nil {
 		slog.Error("error compiling Starlark program", slogor.Err(err))
 		return err
 	}
+	te.globals = globals
+	te.scriptHash = entry.FileHash
+	te.policyDigest = fileDigest(entry.Content)
+	te.dependencies = dependencies
+	te.policyVersion = policyVersion(te.scriptHash, te.dependencies)
 
 	// Make sure that the global environment is frozen so the Startlark script cannot
 	// modify it. This is important for security and to avoid concurrency problems.
 	te.globals.Freeze()
 
-	// The module has to define a function called 'authorize', which will be invoked
-	// for each request to access protected resources.
-	te.authorizeFunction, err = getGlobalFunction(te.globals, "authorize")
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// Look up the functions that the PDP invokes for each request
+	return te.resolveEntryPoints()
 }
 
 // getGlobalFunction retrieves a Callable from the supplied globals dictionary.
@@ -348,6 +445,21 @@ func getGlobalFunction(globals st.StringDict, funcName string) (*st.Function, er
 	return starFunction, nil
 }
 
+// fileDigest returns the hex encoded SHA256 hash of the contents of a file.
+func fileDigest(content []byte) string {
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+// getOptionalGlobalFunction is like getGlobalFunction, but returns nil without error
+// if the function is not defined.
+func getOptionalGlobalFunction(globals st.StringDict, funcName string) (*st.Function, error) {
+	if _, ok := globals[funcName]; !ok {
+		return nil, nil
+	}
+	return getGlobalFunction(globals, funcName)
+}
+
 // // defaultReadDiskFileFun reads the given file from disk, using a sync.Map to store it
 // // It is safe for concurrent use.
 // func (m *PDP) defaultReadDiskFileFun(fileName string) (*FileEntry, error) {
@@ -648,59 +760,114 @@ func getGlobalFunction(globals st.StringDict, funcName string) (*st.Function, er
 // for the decision. They are:
 // - the Verifiable Credential with the information from the caller needed for the decision
 // - the protected resource that the caller identified in the Credential wants to access
+//
+// The policy function can return a boolean or a struct/dict with the fields described in [PolicyDecision].
+func (m *PDP) TakeAuthnDecision(decision Decision, input StarTMFMap) (*PolicyDecision, error) {
+	return m.takeAuthnDecision(context.Background(), decision, input, nil)
+}
 
-func (m *PDP) TakeAuthnDecision(decision Decision, input StarTMFMap) (bool, error) {
+// takeAuthnDecision evaluates the policies as TakeAuthnDecision. If objectHash is not nil and the decision cache
+// is enabled, authorization decisions are cached for the version of the policies, the hash of the TMF object
+// and the rest of the data in the input, including the claims of the token.
+// The evaluation is cancelled when ctx is done, or when it exceeds the configured limits of steps or time.
+func (m *PDP) takeAuthnDecision(ctx context.Context, decision Decision, input StarTMFMap, objectHash []byte) (*PolicyDecision, error) {
 	var err error
 
 	// Get a Starlark Thread from the pool to evaluate the policies.
 	ent := m.threadPool.Get()
 	if ent == nil {
-		return false, fmt.Errorf("getting a thread entry from pool")
+		return nil, fmt.Errorf("getting a thread entry from pool")
 	}
 	defer m.threadPool.Put(ent)
 
 	te := ent.(*threadEntry)
 	if te == nil {
-		return false, fmt.Errorf("invalid entry type in the pool")
+		return nil, fmt.Errorf("invalid entry type in the pool")
 	}
 
 	// Check if the thread is still valid. If not, we need to recompile the file.
 	err = m.Reset(te)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+
+	// Policies without an 'authenticate' function accept all callers with a valid Access Token
+	if decision == Authenticate && te.authenticateFunction == nil {
+		return &PolicyDecision{Allow: true}, nil
+	}
+
+	// Use a cached decision if possible
+	var cacheKey decisionCacheKey
+	useCache := m.decisionCache != nil && decision == Authorize && len(objectHash) == len(cacheKey.object)
+	if useCache {
+		cacheKey.policy = te.policyVersion
+		copy(cacheKey.object[:], objectHash)
+		cacheKey.args, err = decisionArgsDigest(input)
+		if err != nil {
+			slog.Warn("calculating key of decision cache", slogor.Err(err))
+			useCache = false
+		} else if cached, found := m.decisionCache.get(cacheKey); found {
+			return cached, nil
+		}
 	}
 
 	// We mutate the predeclared identifier, so the policy can access the data for this request.
 	// We can also service possible callbacks from the rules engine.
 	te.predeclared["input"] = input
 
+	// The information built-ins have a budget of calls for each decision
+	pip := &pipState{source: m.objectSource, remaining: m.pipCallBudget}
+	te.thread.SetLocal(localPIP, pip)
+	te.thread.SetLocal(localInput, input)
+
+	// Do not keep the data of this request in the thread when it goes back to the pool
+	defer func() {
+		te.predeclared["input"] = StarTMFMap{}
+		te.thread.SetLocal(localPIP, nil)
+		te.thread.SetLocal(localInput, nil)
+	}()
+
 	// Build the arguments to the StarLark function, which is empty.
 	var args st.Tuple
 
 	// Call the corresponding function in the Starlark Thread
 	var result st.Value
+	var entryPoint string
 	if decision == Authenticate {
 		// Call the 'authenticate' funcion
-		result, err = st.Call(te.thread, te.authenticateFunction, args, nil)
+		entryPoint = "authenticate"
+		result, err = m.callWithLimits(ctx, te, te.authenticateFunction, args)
 	} else {
-		// Call the 'authorize' function
-		result, err = st.Call(te.thread, te.authorizeFunction, args, nil)
+		// Call the most specific 'authorize' function for the request
+		var authorizeFunction *st.Function
+		authorizeFunction, entryPoint, err = te.authorizeEntryPoint(input)
+		if err != nil {
+			return nil, err
+		}
+		result, err = m.callWithLimits(ctx, te, authorizeFunction, args)
 	}
 
 	if err != nil {
-		fmt.Printf("rules ERROR: %s\n", err.(*st.EvalError).Backtrace())
-		return false, fmt.Errorf("error calling function: %w", err)
+		if evalErr, ok := err.(*st.EvalError); ok {
+			slog.Error("error calling policy function", "function", entryPoint, "file", te.scriptname, "backtrace", evalErr.Backtrace())
+		}
+		return nil, fmt.Errorf("error calling function: %w", err)
 	}
 
-	// Check that the value returned is of the correct type (boolean)
-	resultType := result.Type()
-	if resultType != "bool" {
-		err := fmt.Errorf("function returned wrong type: %v", resultType)
-		return false, err
+	// Check that the value returned is of the correct type (boolean or struct/dict), and convert it
+	policyDecision, err := decisionFromStarlark(result)
+	if err != nil {
+		return nil, err
+	}
+	policyDecision.EntryPoint = entryPoint
+	policyDecision.PolicyHash = te.policyDigest
+
+	// Decisions which depend on other objects are not cached, because those objects may change
+	if useCache && pip.calls == 0 {
+		m.decisionCache.put(cacheKey, policyDecision)
 	}
 
-	// Return the value as a Go boolean
-	return bool(result.(st.Bool).Truth()), nil
+	return policyDecision, nil
 
 }
 
@@ -1004,6 +1171,12 @@ func anyToValue(value any) st.Value {
 			l = append(l, anyToValue(elem))
 		}
 		return StarTMFList(l)
+	case []string:
+		var l []st.Value
+		for _, elem := range v {
+			l = append(l, st.String(elem))
+		}
+		return StarTMFList(l)
 	case bool:
 		return st.Bool(v)
 	case float64:
@@ -1067,6 +1240,42 @@ func (s StarTMFList) Index(i int) st.Value {
 	return anyToValue(value)
 }
 
+// HasBinary interface, so the lists can be used with the 'in' and 'not in' operators
+func (s StarTMFList) Binary(op syntax.Token, y st.Value, side st.Side) (st.Value, error) {
+	if op != syntax.IN || side != st.Right {
+		return nil, nil
+	}
+	for i := range s {
+		eq, err := st.Equal(s.Index(i), y)
+		if err != nil {
+			return nil, err
+		}
+		if eq {
+			return st.True, nil
+		}
+	}
+	return st.False, nil
+}
+
+// Iterable interface, so the lists can be used in 'for' loops and comprehensions
+func (s StarTMFList) Iterate() st.Iterator { return &starTMFListIterator{list: s} }
+
+type starTMFListIterator struct {
+	list StarTMFList
+	i    int
+}
+
+func (it *starTMFListIterator) Next(p *st.Value) bool {
+	if it.i >= len(it.list) {
+		return false
+	}
+	*p = it.list.Index(it.i)
+	it.i++
+	return true
+}
+
+func (it *starTMFListIterator) Done() {}
+
 var seed = maphash.MakeSeed()
 
 // hashString computes the hash of s.
@@ -1092,6 +1301,10 @@ func softHashString(s string) uint32 {
 
 // getClaimsFromToken verifies the Access Token received with the request, and extracts the claims in its payload.
 // The most important claim in the payload is the LEARCredential that was used for authentication.
+//
+// Besides the signature and the validity period (with the configured clock skew), the token must use one of
+// the allowed signing algorithms, be issued by a trusted Verifier and be intended for one of the expected audiences.
+// Each check fails with its own error, like ErrTokenUntrustedIssuer.
 func (m *PDP) getClaimsFromToken(tokString string) (claims map[string]any, found bool, err error) {
 	var token *jwt.Token
 	var theClaims = MapClaims{}
@@ -1100,9 +1313,21 @@ func (m *PDP) getClaimsFromToken(tokString string) (claims map[string]any, found
 		return nil, false, nil
 	}
 
-	// For testing purposes, you can uncomment the following
-	verifierPublicKeyFunc := func(*jwt.Token) (any, error) {
-		vk, err := m.VerificationJWK()
+	checks := m.tokenChecks
+
+	verifierPublicKeyFunc := func(token *jwt.Token) (any, error) {
+
+		// The algorithm and the issuer are checked before retrieving any key
+		if err := checks.checkAlgorithm(token.Method.Alg()); err != nil {
+			return nil, err
+		}
+		issuer, _ := token.Claims.GetIssuer()
+		if err := checks.checkIssuer(issuer); err != nil {
+			return nil, err
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		vk, err := checks.keySet(issuer, m.config, m.verifierKeys).Key(kid)
 		if err != nil {
 			return nil, errl.Error(err)
 		}
@@ -1111,11 +1336,16 @@ func (m *PDP) getClaimsFromToken(tokString string) (claims map[string]any, found
 	}
 
 	// Validate and verify the token
-	token, err = jwt.NewParser().ParseWithClaims(tokString, &theClaims, verifierPublicKeyFunc)
+	token, err = jwt.NewParser(jwt.WithLeeway(checks.clockSkew)).ParseWithClaims(tokString, &theClaims, verifierPublicKeyFunc)
 	if err != nil {
 		return nil, false, errl.Errorf("error parsing token: %w", err)
 	}
 
+	audiences, _ := theClaims.GetAudience()
+	if err := checks.checkAudience(audiences); err != nil {
+		return nil, false, errl.Error(err)
+	}
+
 	jwtmapClaims := token.Claims.(*MapClaims)
 
 	return *jwtmapClaims, true, nil
@@ -8,9 +8,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -25,34 +27,6 @@ import (
 	st "go.starlark.net/starlark"
 )
 
-// HandleGETAuthorization returns an [http.Handler] which asks for an authorization decision from the PDP
-// by evaluation of the proper policy rules.
-// The parameter tmf should be an already instantiated [TMFCache] database manager.
-// It also expects in ruleEngine an instance of a policy engine.
-func HandleGETAuthorization(
-	logger *slog.Logger,
-	tmf *tmfcache.TMFCache,
-	ruleEngine *PDP,
-) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-
-		// Check authorization as if we are reading the object, but we are only interested in
-		// the authorization result, not in the object itself.
-		// TODO: process the request to get the object id, type and resource
-		_, err := AuthorizeREAD(logger, tmf, ruleEngine, r, "catalog", "productOffering", "")
-		if err != nil {
-			// The user can not access the object
-			slog.Error("forbidden", slogor.Err(err), "URI", r.URL.RequestURI())
-			http.Error(w, "forbidden", http.StatusForbidden)
-			return
-		}
-
-		// The user is granted access to the object
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-	}
-}
-
 // AuthorizeLIST processes a GET request to retrieve a list of TMF objects
 func AuthorizeLIST(
 	logger *slog.Logger, tmf *tmfcache.TMFCache, ruleEngine *PDP, r *http.Request, tmfAPI string, tmfResource string,
@@ -75,7 +49,7 @@ func AuthorizeLIST(
 
 	// LIST requests can be unauthenticated, but individual returned objects are
 	// subject to visibility policies.
-	_, tokenArgument, userArgument, err := extractCallerInfo(logger, tmf, ruleEngine, r)
+	_, tokenArgument, userArgument, err := extractCallerInfo(logger, tmf, ruleEngine, r, requestArgument)
 	if err != nil {
 		return nil, errl.Error(err)
 	}
@@ -107,6 +81,9 @@ func AuthorizeLIST(
 
 	perObject := func(tmfObject tmfcache.TMFObject) tmfcache.LoopControl {
 
+		// The hash of the object as stored, used by the decision cache
+		objectHash := tmfObject.Hash()
+
 		// Set the map representation
 		oMap := tmfObject.GetContentAsMap()
 		oMap["resource"] = tmfObject.GetType()
@@ -134,9 +111,9 @@ func AuthorizeLIST(
 		// Pass the request, the object and the user to the rules engine for a decision.
 		// *********************************************************************************
 
-		userCanAccessObject := takeDecision(ruleEngine, requestArgument, tokenArgument, tmfObjectArgument, userArgument)
+		decision := takeDecision(r.Context(), ruleEngine, requestArgument, tokenArgument, tmfObjectArgument, userArgument, objectHash)
 
-		if !userCanAccessObject {
+		if !decision.Allow {
 			// This object is not a candidate, tell that we need another object
 			return tmfcache.LoopContinue
 		}
@@ -148,8 +125,16 @@ func AuthorizeLIST(
 			return tmfcache.LoopContinue
 		}
 
+		// Apply the obligations from the policy, so the caller receives only what is allowed to see.
+		// If they can not be applied, the object is not returned.
+		objectView, err := applyObligations(tmfObject, decision)
+		if err != nil {
+			logger.Error("applying obligations", slogor.Err(err), "id", tmfObject.GetID())
+			return tmfcache.LoopContinue
+		}
+
 		counter++
-		finalObjects = append(finalObjects, tmfObject)
+		finalObjects = append(finalObjects, objectView)
 
 		if len(finalObjects) >= limit {
 			// We reached the limit, stop the loop
@@ -161,10 +146,23 @@ func AuthorizeLIST(
 
 	}
 
+	// The row-level constraints declared by the policy are added to the query to the database, so fewer
+	// objects have to be evaluated. Each object is still checked, so we can continue without them.
+	filters, err := ruleEngine.listFilters(r.Context(), StarTMFMap{
+		"request": requestArgument,
+		"token":   tokenArgument,
+		"tmf":     StarTMFMap{},
+		"user":    userArgument,
+	})
+	if err != nil {
+		logger.Warn("PDP: evaluating list filters", slogor.Err(err))
+		filters = nil
+	}
+
 	// Retrieve the TMF objects of the given type only locally
 	// We do not go to the upstream TMF API server, for performance reasons and to
 	// implement policy rules easier.
-	err = tmf.LocalRetrieveListTMFObject(nil, tmfResource, r.Form, perObject)
+	err = tmf.LocalRetrieveFilteredListTMFObject(nil, tmfResource, r.Form, filters, perObject)
 	if err != nil {
 		return nil, errl.Errorf("retrieving list of objects: %w", err)
 	}
@@ -207,7 +205,7 @@ func AuthorizeREAD(
 	// ******************************************************************************
 
 	// READ requests can be unauthenticated
-	_, tokenArgument, userArgument, err := extractCallerInfo(logger, tmf, ruleEngine, r)
+	_, tokenArgument, userArgument, err := extractCallerInfo(logger, tmf, ruleEngine, r, requestArgument)
 	if err != nil {
 		return nil, errl.Error(err)
 	}
@@ -233,7 +231,39 @@ func AuthorizeREAD(
 
 	tmfObject, _ := ro.(*tmfcache.TMFGeneralObject)
 
-	// Create a summary map object for the rules engine, to make rules simple to write
+	// The hash of the object as stored, used by the decision cache
+	objectHash := tmfObject.Hash()
+
+	// Build the arguments for the rules engine, updating the user with the info in the object
+	tmfObjectArgument := readObjectArguments(tmfObject, userArgument)
+
+	// ********************************************************************************
+	// 6. Pass the request, the object and the user to the rules engine for a decision.
+	// ********************************************************************************
+
+	decision := takeDecision(r.Context(), ruleEngine, requestArgument, tokenArgument, tmfObjectArgument, userArgument, objectHash)
+
+	// ***************************************************************************************
+	// 7. Reply to the caller with the object, if the rules engine did not deny the operation.
+	// ***************************************************************************************
+
+	if !decision.Allow {
+		return nil, errl.Error(&DeniedError{Decision: decision})
+	}
+
+	// Apply the obligations from the policy to a copy of the object, so the cached one stays untouched
+	objectView, err := applyObligations(tmfObject, decision)
+	if err != nil {
+		return nil, errl.Errorf("applying obligations: %w", err)
+	}
+
+	return objectView, nil
+}
+
+// readObjectArguments creates a summary map object of the TMF object for the rules engine, to make rules
+// simple to write, and updates the user object combining info from the Access Token and the object.
+func readObjectArguments(tmfObject *tmfcache.TMFGeneralObject, userArgument StarTMFMap) StarTMFMap {
+
 	oMap := tmfObject.GetContentAsMap()
 
 	tmfObjectArgument := StarTMFMap(oMap)
@@ -255,32 +285,40 @@ func AuthorizeREAD(
 	// *************************************************************************************
 
 	// Update the TMF object with the restrictions on countries and operator identifiers
-	tmfObjectArgument = getAllRestrictionElements(tmfObjectArgument)
-
-	// ********************************************************************************
-	// 6. Pass the request, the object and the user to the rules engine for a decision.
-	// ********************************************************************************
-
-	userCanAccessObject := takeDecision(ruleEngine, requestArgument, tokenArgument, tmfObjectArgument, userArgument)
+	return getAllRestrictionElements(tmfObjectArgument)
+}
 
-	// ***************************************************************************************
-	// 7. Reply to the caller with the object, if the rules engine did not deny the operation.
-	// ***************************************************************************************
+// getAllRestrictionElements returns a shallow copy of the object with the lists of restrictions on countries
+// and operators calculated from its terms. The object itself is not modified, because it can be the content
+// of a cached object, which is returned to the callers.
+func getAllRestrictionElements(tmfObject StarTMFMap) StarTMFMap {
 
-	if userCanAccessObject {
-		return tmfObject, nil
-	} else {
-		return nil, errl.Errorf("not authorized")
+	tmfObjectArgument := maps.Clone(tmfObject)
+	if tmfObjectArgument == nil {
+		tmfObjectArgument = StarTMFMap{}
 	}
-}
-
-func getAllRestrictionElements(tmfObjectArgument StarTMFMap) StarTMFMap {
 
+	// The countries can be specified with the codes of groups like "EU" or "EEA", which are expanded into
+	// their member countries. The codes as they appear in the object are also available to the policies.
 	permittedLegalRegions := getRestrictionElements(tmfObjectArgument, "permittedLegalRegion")
-	tmfObjectArgument["permittedCountries"] = permittedLegalRegions
+	tmfObjectArgument["permittedCountriesRaw"] = permittedLegalRegions
+	permittedCountries, unknownPermitted := expandRegions(permittedLegalRegions)
+	tmfObjectArgument["permittedCountries"] = permittedCountries
 
 	prohibitedLegalRegions := getRestrictionElements(tmfObjectArgument, "prohibitedLegalRegion")
-	tmfObjectArgument["prohibitedCountries"] = prohibitedLegalRegions
+	tmfObjectArgument["prohibitedCountriesRaw"] = prohibitedLegalRegions
+	prohibitedCountries, unknownProhibited := expandRegions(prohibitedLegalRegions)
+	tmfObjectArgument["prohibitedCountries"] = prohibitedCountries
+
+	// Unknown codes are reported to the policies, which decide what to do with the object
+	unknownCountries := append(unknownPermitted, unknownProhibited...)
+	if unknownCountries == nil {
+		unknownCountries = []string{}
+	}
+	tmfObjectArgument["unknownCountries"] = unknownCountries
+	if len(unknownCountries) > 0 {
+		logUnknownCountries(tmfObjectArgument["id"], unknownCountries)
+	}
 
 	permittedOperators := getRestrictionElements(tmfObjectArgument, "permittedOperator")
 	tmfObjectArgument["permittedOperators"] = permittedOperators
@@ -345,7 +383,7 @@ func AuthorizeUPDATE(
 	// Process the Access Token and retrieve info about the user sending the request.
 	// ******************************************************************************
 
-	tokString, tokenArgument, userArgument, err := extractCallerInfo(logger, tmf, ruleEngine, r)
+	tokString, tokenArgument, userArgument, err := extractCallerInfo(logger, tmf, ruleEngine, r, requestArgument)
 	if err != nil {
 		return nil, errl.Error(err)
 	}
@@ -386,16 +424,7 @@ func AuthorizeUPDATE(
 
 	userOrgId := userArgument["organizationIdentifier"].(string)
 
-	userOrgDID := userOrgId
-	if !strings.HasPrefix(userOrgId, "did:elsi:") {
-		userOrgDID = "did:elsi:" + userOrgId
-	}
-
-	if userOrgDID != existingTmfObject.Seller && userOrgDID != existingTmfObject.SellerOperator &&
-		userOrgDID != existingTmfObject.Buyer && userOrgDID != existingTmfObject.BuyerOperator {
-		slog.Error("REJECTED: the user is not the owner", "user", userOrgDID,
-			"seller", existingTmfObject.Seller, "sellerOperator", existingTmfObject.SellerOperator,
-			"buyer", existingTmfObject.Buyer, "buyerOperator", existingTmfObject.BuyerOperator)
+	if !isObjectOwner(userOrgId, existingTmfObject) {
 		return nil, errl.Errorf("not authorized")
 	}
 
@@ -408,21 +437,40 @@ func AuthorizeUPDATE(
 		return nil, errl.Errorf("failed to read body: %w", err)
 	}
 
-	// Parse the request body into a StarTMFMap
-	incomingObjectArgument := StarTMFMap{}
-	if err := json.Unmarshal(incomingRequestBody, &incomingObjectArgument); err != nil {
+	// Parse the request body, which is a JSON Merge Patch for the object
+	var patch map[string]any
+	if err := json.Unmarshal(incomingRequestBody, &patch); err != nil {
 		return nil, errl.Errorf("failed to parse request: %w", err)
 	}
 
+	// Calculate the object as it will be after the update, from a copy of the stored one
+	var currentObject map[string]any
+	if err := json.Unmarshal(existingTmfObject.GetContentAsJSON(), &currentObject); err != nil {
+		return nil, errl.Errorf("failed to parse stored object %s: %w", id, err)
+	}
+	patchedObject, _ := mergePatch(currentObject, patch).(map[string]any)
+	changes := objectChanges(currentObject, patchedObject)
+
 	logger.Debug("AuthorizeUPDATE: updating", "type", tmfResource)
 
 	// *********************************************************************************
 	// 6. Check if the user can perform the operation on the object.
+	// The policy receives the stored object in 'tmf', the object after the update in 'tmf_new'
+	// and the list of changed members in 'changes', so it can reason about the change itself.
 	// *********************************************************************************
 
-	userCanAccessObject := takeDecision(ruleEngine, requestArgument, tokenArgument, incomingObjectArgument, userArgument)
-	if !userCanAccessObject {
-		return nil, errl.Errorf("take decision: not authorized")
+	input := StarTMFMap{
+		"request": requestArgument,
+		"token":   tokenArgument,
+		"tmf":     readObjectArguments(existingTmfObject, userArgument),
+		"tmf_new": getAllRestrictionElements(StarTMFMap(patchedObject)),
+		"changes": changes,
+		"user":    userArgument,
+	}
+
+	decision := takeDecisionForInput(r.Context(), ruleEngine, input, nil)
+	if !decision.Allow {
+		return nil, errl.Error(&DeniedError{Decision: decision})
 	}
 
 	// **********************************************************************************
@@ -453,6 +501,26 @@ func AuthorizeUPDATE(
 	return tmfObject, nil
 }
 
+// isObjectOwner checks that the organization of the user is one of the parties of the object,
+// which is required to modify it.
+func isObjectOwner(userOrgId string, tmfObject *tmfcache.TMFGeneralObject) bool {
+
+	userOrgDID := userOrgId
+	if !strings.HasPrefix(userOrgId, "did:elsi:") {
+		userOrgDID = "did:elsi:" + userOrgId
+	}
+
+	if userOrgDID != tmfObject.Seller && userOrgDID != tmfObject.SellerOperator &&
+		userOrgDID != tmfObject.Buyer && userOrgDID != tmfObject.BuyerOperator {
+		slog.Error("REJECTED: the user is not the owner", "user", userOrgDID,
+			"seller", tmfObject.Seller, "sellerOperator", tmfObject.SellerOperator,
+			"buyer", tmfObject.Buyer, "buyerOperator", tmfObject.BuyerOperator)
+		return false
+	}
+
+	return true
+}
+
 var ErrorAlreadyExists = errl.Errorf("object already exists")
 
 func AuthorizeCREATE(
@@ -475,7 +543,7 @@ func AuthorizeCREATE(
 	// Process the Access Token and retrieve info about the user sending the request.
 	// ******************************************************************************
 
-	tokString, tokenArgument, userArgument, err := extractCallerInfo(logger, tmf, ruleEngine, r)
+	tokString, tokenArgument, userArgument, err := extractCallerInfo(logger, tmf, ruleEngine, r, requestArgument)
 	if err != nil {
 		return nil, errl.Error(err)
 	}
@@ -535,9 +603,9 @@ func AuthorizeCREATE(
 	// Check if the user can perform the operation on the object.
 	// *********************************************************************************
 
-	userCanCreateObject := takeDecision(ruleEngine, requestArgument, tokenArgument, incomingObjectArgument, userArgument)
-	if !userCanCreateObject {
-		return nil, errl.Errorf("take decision: not authorized")
+	decision := takeDecision(r.Context(), ruleEngine, requestArgument, tokenArgument, incomingObjectArgument, userArgument, nil)
+	if !decision.Allow {
+		return nil, errl.Error(&DeniedError{Decision: decision})
 	}
 
 	// **********************************************************************************
@@ -926,16 +994,41 @@ func parseHTTPRequest(logger *slog.Logger, r *http.Request) (StarTMFMap, error)
 
 }
 
+// authenticateCaller evaluates the 'authenticate' function of the policy for the caller of the request,
+// which already presented a verified Access Token. The request argument describes the original request
+// being authorized (see parseHTTPRequest), not the request to the PDP.
+// It returns a DeniedError if the policy rejects the caller.
+func (m *PDP) authenticateCaller(ctx context.Context, requestArgument StarTMFMap, tokenArgument StarTMFMap, userArgument StarTMFMap) error {
+
+	input := StarTMFMap{
+		"request": requestArgument,
+		"token":   tokenArgument,
+		"user":    userArgument,
+	}
+
+	decision, err := m.takeAuthnDecision(ctx, Authenticate, input, nil)
+	if err != nil {
+		return errl.Errorf("authenticating caller: %w", err)
+	}
+	if !decision.Allow {
+		return errl.Error(&DeniedError{Decision: decision})
+	}
+
+	return nil
+}
+
 // extractCallerInfo retrieves the Access Token from the request, verifies it if it exists and
 // creates a StarTMFMap ready to be passed to the rules engine.
 //
 // The access token may not exist, but if it does then it must be valid.
 // For convenience of the policies, some calculated fields are created and returned in the 'user' object.
+// The request argument is the original request, passed to the 'authenticate' function of the policy.
 func extractCallerInfo(
 	logger *slog.Logger,
 	tmf *tmfcache.TMFCache,
 	ruleEngine *PDP,
 	r *http.Request,
+	requestArgument StarTMFMap,
 ) (tokString string, tokenArgument StarTMFMap, user StarTMFMap, err error) {
 
 	// Check if we are testing the PDP, and if so, return a dummy token
@@ -1010,33 +1103,9 @@ func extractCallerInfo(
 
 		powers := jpath.GetList(verifiableCredential, "credentialSubject.mandate.power")
 		for _, p := range powers {
-			ptype := jpath.GetString(p, "type")
-			pdomain := jpath.GetString(p, "domain")
-			pfunction := jpath.GetString(p, "function")
-			paction := jpath.GetString(p, "action")
-
-			// Check fields without regards to case
-			if strings.EqualFold(ptype, "Domain") &&
-				strings.EqualFold(pdomain, "DOME") &&
-				strings.EqualFold(pfunction, "Onboarding") &&
-				strings.EqualFold(paction, "execute") {
-
-				userArgument["isLEAR"] = true
-			}
-
-			ptype = jpath.GetString(p, "tmf_type")
-			pdomain = jpath.GetString(p, "tmf_domain")
-			pfunction = jpath.GetString(p, "tmf_function")
-			paction = jpath.GetString(p, "tmf_action")
-
-			if strings.EqualFold(ptype, "Domain") &&
-				strings.EqualFold(pdomain, "DOME") &&
-				strings.EqualFold(pfunction, "Onboarding") &&
-				strings.EqualFold(paction, "execute") {
-
+			if isLEARPower(p) {
 				userArgument["isLEAR"] = true
 			}
-
 		}
 
 	} else {
@@ -1062,6 +1131,12 @@ func extractCallerInfo(
 	}
 	userArgument["country"] = country
 
+	// The policy can reject the caller before the request is processed any further
+	if err := ruleEngine.authenticateCaller(r.Context(), requestArgument, tokenArgument, userArgument); err != nil {
+		logger.Warn("caller rejected by the policy", slogor.Err(err), "organizationIdentifier", userOrganizationIdentifier)
+		return "", nil, nil, err
+	}
+
 	// *******************************************************************************************
 	// Check if the organization of the user already exists in our database, and create it if not
 	// *******************************************************************************************
@@ -1094,13 +1169,25 @@ func extractCallerInfo(
 
 }
 
+// isLEARPower reports if a power of the mandate in a LEARCredential is the one granted to the LEAR of the
+// organization: Onboarding in the DOME domain.
+func isLEARPower(p any) bool {
+	return powerGrants(p, "Onboarding", "Execute", "DOME")
+}
+
+// takeDecision asks the rules engine for an authorization decision. It never returns nil, and
+// an error evaluating the policy is considered a rejection.
+// If objectHash is not nil, it is the hash of the stored TMF object and the decision can be served
+// from the decision cache.
 func takeDecision(
+	ctx context.Context,
 	ruleEngine *PDP,
 	requestArgument StarTMFMap,
 	tokenArgument StarTMFMap,
 	tmfObjectArgument StarTMFMap,
 	userArgument StarTMFMap,
-) bool {
+	objectHash []byte,
+) *PolicyDecision {
 	// Assemble all data in a single "input" argument, to the style of OPA.
 	// We mutate the predeclared identifier, so the policy can access the data for this request.
 	// We can also service possible callbacks from the rules engine.
@@ -1111,6 +1198,13 @@ func takeDecision(
 		"user":    userArgument,
 	}
 
+	return takeDecisionForInput(ctx, ruleEngine, input, objectHash)
+}
+
+// takeDecisionForInput is like takeDecision, for an 'input' object already assembled by the caller,
+// which can include additional members for some actions.
+func takeDecisionForInput(ctx context.Context, ruleEngine *PDP, input StarTMFMap, objectHash []byte) *PolicyDecision {
+
 	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
 		b, err := json.MarshalIndent(input, "", "  ")
 		if err == nil {
@@ -1118,21 +1212,50 @@ func takeDecision(
 		}
 	}
 
-	decision, err := ruleEngine.TakeAuthnDecision(Authorize, input)
+	decision, err := ruleEngine.takeAuthnDecision(ctx, Authorize, input, objectHash)
 
 	// An error is considered a rejection, continue with the next candidate object
 	if err != nil {
 		slog.Error("PDP: request rejected due to an error", slogor.Err(err))
-		return false
+		switch {
+		case errors.Is(err, ErrPolicyStepsExceeded):
+			decision = &PolicyDecision{Allow: false, Reason: ErrPolicyStepsExceeded.Error()}
+		case errors.Is(err, ErrPolicyDeadlineExceeded):
+			decision = &PolicyDecision{Allow: false, Reason: ErrPolicyDeadlineExceeded.Error()}
+		default:
+			decision = &PolicyDecision{Allow: false, Reason: "error evaluating the policy"}
+		}
+	}
+
+	// Record the decision for compliance, including the errors
+	ruleEngine.audit(ctx, input, decision)
+
+	// Keep the full input, to replay the decisions offline against other policies
+	if ruleEngine.recorder != nil {
+		ruleEngine.recorder.record(input, decision)
+	}
+
+	// Compare with the candidate policy if configured, without affecting the decision
+	if ruleEngine.shadow != nil {
+		ruleEngine.shadow.evaluate(ctx, input, decision)
+	}
+
+	if err != nil {
+		return decision
+	}
+
+	logAttrs := []any{"rule", decision.RuleID}
+	if ruleEngine.config.LogEntryPoints {
+		logAttrs = append(logAttrs, "entryPoint", decision.EntryPoint)
 	}
 
 	// The rules engine rejected the request, continue with the next candidate object
-	if !decision {
-		slog.Warn("PDP: request rejected due to policy")
-		return false
+	if !decision.Allow {
+		slog.Warn("PDP: request rejected due to policy", append([]any{"reason", decision.Reason}, logAttrs...)...)
+		return decision
 	}
 
 	// The rules engine accepted the request, add the object to the final list
-	slog.Info("PDP: request authorised")
-	return true
+	slog.Info("PDP: request authorised", logAttrs...)
+	return decision
 }
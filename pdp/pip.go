@@ -0,0 +1,229 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	conf "github.com/hesusruiz/domeproxy/config"
+	"github.com/hesusruiz/domeproxy/tmfcache"
+	st "go.starlark.net/starlark"
+	"zombiezen.com/go/sqlite"
+)
+
+// DefaultPIPCallBudget is the maximum number of calls to the information built-ins (star.get and star.list)
+// that a policy can perform when taking a single decision, if not configured.
+const DefaultPIPCallBudget = 10
+
+// The maximum number of objects returned by star.list
+const pipMaxListResults = 100
+
+// Name of the thread local with the state of the information built-ins for the current decision
+const localPIP = "pip"
+
+// TMFObjectSource is the Policy Information Point (PIP) used by the policies to retrieve TMF objects
+// related to the one being accessed. Only local reads are performed, so evaluation of the policies
+// never waits for the upstream TMForum servers.
+// It is implemented by [tmfcache.TMFCache].
+type TMFObjectSource interface {
+	LocalRetrieveTMFObject(dbconn *sqlite.Conn, id string, resource string, version string) (tmfcache.TMFObject, bool, error)
+	LocalRetrieveListTMFObject(dbconn *sqlite.Conn, tmfResource string, queryValues url.Values, perObject func(tmfObject tmfcache.TMFObject) tmfcache.LoopControl) error
+}
+
+// connSource is implemented by the sources of TMF objects with a pool of database connections, like
+// [tmfcache.TMFCache]. The information built-ins take the connection with the context of the evaluation,
+// so they fail when the deadline of the policies is exceeded instead of waiting forever for a connection
+// when the pool is exhausted, for example by LIST requests, which hold a connection while evaluating the objects.
+type connSource interface {
+	TakeConn(ctx context.Context) (*sqlite.Conn, error)
+	PutConn(dbconn *sqlite.Conn)
+}
+
+// SetObjectSource sets the source of TMF objects for the star.get and star.list built-ins.
+// If it is not set, the built-ins fail when called.
+func (m *PDP) SetObjectSource(source TMFObjectSource) {
+	m.objectSource = source
+	if m.shadow != nil {
+		m.shadow.pdp.objectSource = source
+	}
+}
+
+// pipState is the state of the information built-ins while taking a single decision.
+type pipState struct {
+	source    TMFObjectSource
+	remaining int
+	calls     int
+
+	// The context of the evaluation of the policies, and the database connection taken with it
+	ctx    context.Context
+	dbconn *sqlite.Conn
+}
+
+// conn returns the database connection for the calls of the current evaluation, taking it the first time.
+// It returns nil when the source manages its own connections, or outside of an evaluation with limits.
+func (pip *pipState) conn() (*sqlite.Conn, error) {
+	if pip.dbconn != nil {
+		return pip.dbconn, nil
+	}
+	pool, ok := pip.source.(connSource)
+	if !ok || pip.ctx == nil {
+		return nil, nil
+	}
+
+	dbconn, err := pool.TakeConn(pip.ctx)
+	if err != nil {
+		return nil, err
+	}
+	pip.dbconn = dbconn
+	return dbconn, nil
+}
+
+// release returns the database connection of the evaluation, if one was taken.
+func (pip *pipState) release() {
+	if pip.dbconn != nil {
+		pip.source.(connSource).PutConn(pip.dbconn)
+		pip.dbconn = nil
+	}
+	pip.ctx = nil
+}
+
+// pipFromThread returns the state of the information built-ins for the current decision, after
+// checking that a source is available and that the call budget is not exhausted.
+func pipFromThread(thread *st.Thread, b *st.Builtin) (*pipState, error) {
+
+	pip, _ := thread.Local(localPIP).(*pipState)
+	if pip == nil || pip.source == nil {
+		return nil, fmt.Errorf("%s: no source of TMF objects available", b.Name())
+	}
+
+	if pip.remaining <= 0 {
+		return nil, fmt.Errorf("%s: budget of calls exhausted for this decision", b.Name())
+	}
+	pip.remaining--
+	pip.calls++
+
+	return pip, nil
+}
+
+// pipGet implements star.get(id, resource=""), which returns the object with the given id from the local
+// cache, or None if it does not exist. The resource type is derived from the id if not specified.
+func pipGet(thread *st.Thread, b *st.Builtin, args st.Tuple, kwargs []st.Tuple) (st.Value, error) {
+
+	var id, resource string
+	if err := st.UnpackArgs(b.Name(), args, kwargs, "id", &id, "resource?", &resource); err != nil {
+		return nil, err
+	}
+
+	if resource == "" {
+		var err error
+		resource, err = conf.FromIdToResourceType(id)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+	}
+
+	pip, err := pipFromThread(thread, b)
+	if err != nil {
+		return nil, err
+	}
+
+	dbconn, err := pip.conn()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+
+	tmfObject, found, err := pip.source.LocalRetrieveTMFObject(dbconn, id, resource, "")
+	if errors.Is(err, tmfcache.ErrorNotFound) || (err == nil && !found) {
+		return st.None, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: retrieving %s: %w", b.Name(), id, err)
+	}
+
+	return StarTMFMap(tmfObject.GetContentAsMap()), nil
+}
+
+// pipList implements star.list(resource, query=None), which returns a list with the objects of the given
+// type in the local cache which satisfy the query, using the same syntax as the query of the TMForum APIs.
+// At most pipMaxListResults objects are returned.
+func pipList(thread *st.Thread, b *st.Builtin, args st.Tuple, kwargs []st.Tuple) (st.Value, error) {
+
+	var resource string
+	var query st.IterableMapping
+	if err := st.UnpackArgs(b.Name(), args, kwargs, "resource", &resource, "query?", &query); err != nil {
+		return nil, err
+	}
+
+	queryValues, err := queryFromStarlark(query)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+
+	pip, err := pipFromThread(thread, b)
+	if err != nil {
+		return nil, err
+	}
+
+	dbconn, err := pip.conn()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+
+	var objects []st.Value
+	err = pip.source.LocalRetrieveListTMFObject(dbconn, resource, queryValues, func(tmfObject tmfcache.TMFObject) tmfcache.LoopControl {
+		objects = append(objects, StarTMFMap(tmfObject.GetContentAsMap()))
+		if len(objects) >= pipMaxListResults {
+			return tmfcache.LoopStop
+		}
+		return tmfcache.LoopContinue
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: retrieving %s: %w", b.Name(), resource, err)
+	}
+
+	list := st.NewList(objects)
+	list.Freeze()
+	return list, nil
+}
+
+// queryFromStarlark converts a Starlark dict to the query values of a TMForum request.
+// The values can be strings, numbers, booleans or lists of them.
+func queryFromStarlark(query st.IterableMapping) (url.Values, error) {
+
+	values := url.Values{}
+	if query == nil {
+		return values, nil
+	}
+
+	for _, item := range query.Items() {
+		key, ok := st.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("query keys must be strings, got %s", item[0].Type())
+		}
+
+		switch v := item[1].(type) {
+		case st.String:
+			values.Add(key, string(v))
+		case st.Int, st.Float, st.Bool:
+			values.Add(key, v.String())
+		case st.Indexable:
+			for i := range v.Len() {
+				elem := v.Index(i)
+				if s, ok := st.AsString(elem); ok {
+					values.Add(key, s)
+				} else {
+					values.Add(key, elem.String())
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid value for query parameter %s: %s", key, item[1].Type())
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	conf "github.com/hesusruiz/domeproxy/config"
+	"github.com/hesusruiz/domeproxy/tmfcache"
+	"zombiezen.com/go/sqlite"
+)
+
+// fakeObjectSource serves TMF objects from memory
+type fakeObjectSource struct {
+	objects map[string]tmfcache.TMFObject
+}
+
+func (f *fakeObjectSource) LocalRetrieveTMFObject(_ *sqlite.Conn, id string, resource string, version string) (tmfcache.TMFObject, bool, error) {
+	o, ok := f.objects[id]
+	if !ok || o.GetType() != resource {
+		return nil, false, tmfcache.ErrorNotFound
+	}
+	return o, true, nil
+}
+
+func (f *fakeObjectSource) LocalRetrieveListTMFObject(_ *sqlite.Conn, resource string, query url.Values, perObject func(tmfObject tmfcache.TMFObject) tmfcache.LoopControl) error {
+	for _, o := range f.objects {
+		if o.GetType() != resource {
+			continue
+		}
+		if status := query.Get("lifecycleStatus"); status != "" && o.GetContentAsMap()["lifecycleStatus"] != status {
+			continue
+		}
+		if perObject(o) == tmfcache.LoopStop {
+			return nil
+		}
+	}
+	return nil
+}
+
+func TestPIPBuiltins(t *testing.T) {
+
+	spec := []byte(`{
+		"id": "urn:ngsi-ld:product-specification:0001",
+		"href": "urn:ngsi-ld:product-specification:0001",
+		"@type": "productSpecification",
+		"name": "Spec",
+		"version": "1.0",
+		"lifecycleStatus": "Retired",
+		"lastUpdate": "2025-01-01T00:00:00Z"
+	}`)
+	specObject, err := tmfcache.TMFObjectFromBytes(spec, "productSpecification")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+	policy := `
+def authorize():
+    spec = star.get(input.tmf.specId)
+    if spec == None:
+        return False
+    retired = star.list("productSpecification", {"lifecycleStatus": "Retired"})
+    return spec.lifecycleStatus != "Retired" and len(retired) == 1
+`
+	if err := os.WriteFile(policyFile, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decide := func(specId string) (*PolicyDecision, error) {
+		input := StarTMFMap{"tmf": StarTMFMap{"specId": specId}}
+		return m.TakeAuthnDecision(Authorize, input)
+	}
+
+	// Without a source of objects the built-ins fail
+	if _, err := decide("urn:ngsi-ld:product-specification:0001"); err == nil {
+		t.Fatal("expected an error without a source of objects")
+	}
+
+	m.SetObjectSource(&fakeObjectSource{objects: map[string]tmfcache.TMFObject{
+		"urn:ngsi-ld:product-specification:0001": specObject,
+	}})
+
+	decision, err := decide("urn:ngsi-ld:product-specification:0001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Allow {
+		t.Error("a retired specification should be denied")
+	}
+
+	decision, err = decide("urn:ngsi-ld:product-specification:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Allow {
+		t.Error("a missing specification should be denied")
+	}
+
+	// The budget of calls is enforced for each decision
+	m.pipCallBudget = 1
+	if _, err := decide("urn:ngsi-ld:product-specification:0001"); err == nil {
+		t.Error("expected an error when the budget of calls is exhausted")
+	}
+}
+
+func TestPIPConnectionDeadline(t *testing.T) {
+
+	tmf, err := tmfcache.NewTMFCache(&conf.Config{Dbname: filepath.Join(t.TempDir(), "tmf.db")}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tmf.Close)
+
+	policyFile := filepath.Join(t.TempDir(), "policy.star")
+	policy := `
+def authorize():
+    return star.get("urn:ngsi-ld:product-specification:0001") == None
+`
+	if err := os.WriteFile(policyFile, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetObjectSource(tmf)
+	m.policyTimeout = 50 * time.Millisecond
+
+	// Exhaust the pool of connections, like concurrent LIST requests evaluating their objects
+	var held []*sqlite.Conn
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		dbconn, err := tmf.TakeConn(ctx)
+		cancel()
+		if err != nil {
+			break
+		}
+		held = append(held, dbconn)
+	}
+
+	// The built-in fails at the deadline of the policies instead of waiting for a connection
+	_, err = m.TakeAuthnDecision(Authorize, StarTMFMap{})
+	if !errors.Is(err, ErrPolicyDeadlineExceeded) {
+		t.Errorf("expected a deadline error, got %v", err)
+	}
+
+	for _, dbconn := range held {
+		tmf.PutConn(dbconn)
+	}
+
+	// The connection of the evaluation is returned to the pool after each decision
+	for range len(held) + 1 {
+		decision, err := m.TakeAuthnDecision(Authorize, StarTMFMap{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decision.Allow {
+			t.Fatal("expected the missing object to be allowed")
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hesusruiz/domeproxy/internal/errl"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// policyversion Table Schema
+//
+// The `policyversion` table keeps all the versions of the policy files (and the modules they load)
+// uploaded to the PDP, so they survive restarts and can be compared and rolled back.
+// Only one version of each file is active, which is the one used by the PDP.
+//
+// # Columns
+//
+// `name` `TEXT` `NOT NULL`: The name of the file, as used by the PDP (eg. `auth_policies.star`).
+// `version` `INTEGER` `NOT NULL`: The number of the version, starting at 1 for each file.
+// `author` `TEXT`: Who uploaded the version.
+// `created` `INTEGER` `NOT NULL`: A Unix timestamp of the upload.
+// `hash` `TEXT` `NOT NULL`: The hex encoded SHA256 hash of the content.
+// `content` `BLOB` `NOT NULL`: The contents of the file.
+// `active` `INTEGER` `NOT NULL`: 1 if this is the version used by the PDP, 0 otherwise.
+// `comment` `TEXT`: A description of the version, for example when it is a rollback of a previous one.
+// `signature` `TEXT`: The detached JWS over the content, if it was uploaded with a signature.
+const createPolicyVersionTableSQL = `
+CREATE TABLE IF NOT EXISTS policyversion (
+	"name" TEXT NOT NULL,
+	"version" INTEGER NOT NULL,
+	"author" TEXT,
+	"created" INTEGER NOT NULL,
+	"hash" TEXT NOT NULL,
+	"content" BLOB NOT NULL,
+	"active" INTEGER NOT NULL DEFAULT 0,
+	"comment" TEXT,
+	"signature" TEXT,
+
+	PRIMARY KEY ("name", "version")
+);
+PRAGMA journal_mode = WAL;
+`
+
+const insertPolicyVersionSQL = `INSERT INTO policyversion (name, version, author, created, hash, content, active, comment, signature) VALUES (:name, :version, :author, :created, :hash, :content, 1, :comment, NULLIF(:signature, ''));`
+
+const selectPolicyVersionColumns = `name, version, author, created, hash, active, comment`
+
+var ErrPolicyVersionNotFound = errors.New("policy version not found")
+
+// PolicyVersion is a version of a policy file in the store.
+type PolicyVersion struct {
+	Name    string    `json:"name"`
+	Version int       `json:"version"`
+	Author  string    `json:"author"`
+	Created time.Time `json:"created"`
+	Hash    string    `json:"hash"`
+	Active  bool      `json:"active"`
+	Comment string    `json:"comment,omitempty"`
+
+	// The content and its signature are only retrieved when a single version is requested
+	Content   []byte `json:"-"`
+	Signature []byte `json:"-"`
+}
+
+// PolicyStore is the persistent store of the versions of the policy files, in SQLite.
+type PolicyStore struct {
+	dbpool *sqlitex.Pool
+}
+
+// NewPolicyStore opens the store in the database file, creating the table if needed.
+func NewPolicyStore(dbname string) (*PolicyStore, error) {
+
+	dbpool, err := sqlitex.NewPool(dbname, sqlitex.PoolOptions{
+		PoolSize: 4,
+	})
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+
+	conn, err := dbpool.Take(context.Background())
+	if err != nil {
+		dbpool.Close()
+		return nil, errl.Error(err)
+	}
+	defer dbpool.Put(conn)
+
+	err = sqlitex.ExecuteScript(conn, createPolicyVersionTableSQL, nil)
+	if err == nil {
+		err = addPolicySignatureColumn(conn)
+	}
+	if err != nil {
+		dbpool.Close()
+		return nil, errl.Errorf("creating policy store: %w", err)
+	}
+
+	return &PolicyStore{dbpool: dbpool}, nil
+}
+
+// addPolicySignatureColumn adds the column with the signature to the tables created before it existed.
+func addPolicySignatureColumn(conn *sqlite.Conn) error {
+	found := false
+	err := sqlitex.Execute(conn, `SELECT name FROM pragma_table_info('policyversion') WHERE name = 'signature';`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			found = true
+			return nil
+		},
+	})
+	if err != nil || found {
+		return err
+	}
+	return sqlitex.Execute(conn, `ALTER TABLE policyversion ADD COLUMN "signature" TEXT;`, nil)
+}
+
+func (s *PolicyStore) Close() error {
+	return s.dbpool.Close()
+}
+
+// Add stores a new version of the file and makes it the active one, returning the version created.
+// The signature is optional.
+func (s *PolicyStore) Add(name string, content []byte, signature []byte, author string, comment string) (pv *PolicyVersion, err error) {
+
+	conn, err := s.dbpool.Take(context.Background())
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+	defer s.dbpool.Put(conn)
+
+	release := sqlitex.Save(conn)
+	defer release(&err)
+
+	last := 0
+	err = sqlitex.Execute(conn, `SELECT COALESCE(MAX(version), 0) FROM policyversion WHERE name = ?;`, &sqlitex.ExecOptions{
+		Args: []any{name},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			last = stmt.ColumnInt(0)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+
+	err = sqlitex.Execute(conn, `UPDATE policyversion SET active = 0 WHERE name = ? AND active = 1;`, &sqlitex.ExecOptions{
+		Args: []any{name},
+	})
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+
+	pv = &PolicyVersion{
+		Name:      name,
+		Version:   last + 1,
+		Author:    author,
+		Created:   time.Now().Truncate(time.Second),
+		Hash:      fileDigest(content),
+		Active:    true,
+		Comment:   comment,
+		Content:   content,
+		Signature: signature,
+	}
+
+	err = sqlitex.Execute(conn, insertPolicyVersionSQL, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":name":      pv.Name,
+			":version":   pv.Version,
+			":author":    pv.Author,
+			":created":   pv.Created.Unix(),
+			":hash":      pv.Hash,
+			":content":   pv.Content,
+			":comment":   pv.Comment,
+			":signature": string(pv.Signature),
+		},
+	})
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+
+	return pv, nil
+}
+
+// List returns the versions of the file, the most recent first, without their content.
+func (s *PolicyStore) List(name string) ([]PolicyVersion, error) {
+	return s.query(false, `SELECT `+selectPolicyVersionColumns+` FROM policyversion WHERE name = ? ORDER BY version DESC;`, name)
+}
+
+// Get returns the version of the file, with its content.
+func (s *PolicyStore) Get(name string, version int) (*PolicyVersion, error) {
+	versions, err := s.query(true, `SELECT `+selectPolicyVersionColumns+`, content, signature FROM policyversion WHERE name = ? AND version = ?;`, name, version)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, errl.Errorf("%s version %d: %w", name, version, ErrPolicyVersionNotFound)
+	}
+	return &versions[0], nil
+}
+
+// ActiveVersions returns the active version of all the files in the store, with their content.
+func (s *PolicyStore) ActiveVersions() ([]PolicyVersion, error) {
+	return s.query(true, `SELECT `+selectPolicyVersionColumns+`, content, signature FROM policyversion WHERE active = 1 ORDER BY name;`)
+}
+
+func (s *PolicyStore) query(withContent bool, sql string, args ...any) ([]PolicyVersion, error) {
+
+	conn, err := s.dbpool.Take(context.Background())
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+	defer s.dbpool.Put(conn)
+
+	var versions []PolicyVersion
+	err = sqlitex.Execute(conn, sql, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			pv := PolicyVersion{
+				Name:    stmt.GetText("name"),
+				Version: int(stmt.GetInt64("version")),
+				Author:  stmt.GetText("author"),
+				Created: time.Unix(stmt.GetInt64("created"), 0),
+				Hash:    stmt.GetText("hash"),
+				Active:  stmt.GetInt64("active") == 1,
+				Comment: stmt.GetText("comment"),
+			}
+			if withContent {
+				pv.Content = make([]byte, stmt.GetLen("content"))
+				stmt.GetBytes("content", pv.Content)
+				if signature := stmt.GetText("signature"); signature != "" {
+					pv.Signature = []byte(signature)
+				}
+			}
+			versions = append(versions, pv)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,257 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/goccy/go-yaml"
+	conf "github.com/hesusruiz/domeproxy/config"
+)
+
+// PolicyTestCase is a single test of a policy file, as described in a fixture file.
+// The 'request', 'token', 'user' and 'tmf' objects are passed to the policy exactly as the
+// PDP does when processing a live request, and the decision must be the one in 'expect'.
+type PolicyTestCase struct {
+	Name    string         `json:"name"`
+	Request map[string]any `json:"request"`
+	Token   map[string]any `json:"token"`
+	User    map[string]any `json:"user"`
+	TMF     map[string]any `json:"tmf"`
+
+	// TMFNew is the object after the update, for UPDATE requests.
+	// The changes passed to the policy are calculated from TMF and TMFNew.
+	TMFNew map[string]any `json:"tmf_new"`
+
+	// Expect is either "allow" or "deny".
+	Expect string `json:"expect"`
+
+	// File is the fixture file where the test was defined.
+	File string `json:"-"`
+}
+
+// policyTestFile is the structure of a fixture file, which can be written in YAML or JSON.
+type policyTestFile struct {
+	Tests []PolicyTestCase `json:"tests"`
+}
+
+// PolicyTestResult is the outcome of running a single PolicyTestCase.
+type PolicyTestResult struct {
+	Case   PolicyTestCase
+	Got    string
+	Reason string
+	Passed bool
+	Err    error
+}
+
+// PolicyTestReport summarizes the execution of a set of policy tests.
+type PolicyTestReport struct {
+	PolicyFile string
+	Results    []PolicyTestResult
+	Passed     int
+	Failed     int
+}
+
+// OK returns true if all the tests in the report passed.
+func (r *PolicyTestReport) OK() bool {
+	return r.Failed == 0
+}
+
+// Print writes a human readable pass/fail report to w.
+func (r *PolicyTestReport) Print(w io.Writer) {
+	for _, res := range r.Results {
+		if res.Passed {
+			fmt.Fprintf(w, "PASS %s: %s\n", res.Case.File, res.Case.Name)
+			continue
+		}
+		if res.Err != nil {
+			fmt.Fprintf(w, "FAIL %s: %s: expected %s, got %s (%s)\n", res.Case.File, res.Case.Name, res.Case.Expect, res.Got, res.Err)
+		} else if res.Reason != "" {
+			fmt.Fprintf(w, "FAIL %s: %s: expected %s, got %s (%s)\n", res.Case.File, res.Case.Name, res.Case.Expect, res.Got, res.Reason)
+		} else {
+			fmt.Fprintf(w, "FAIL %s: %s: expected %s, got %s\n", res.Case.File, res.Case.Name, res.Case.Expect, res.Got)
+		}
+	}
+	fmt.Fprintf(w, "%s: %d passed, %d failed\n", r.PolicyFile, r.Passed, r.Failed)
+}
+
+// NewOfflinePDP creates a PDP for the given policy file which does not need access to the Verifier,
+// for running policies outside of the server (eg., in tests or from the command line).
+// The policy is compiled eagerly, so any syntax error is reported immediately.
+func NewOfflinePDP(policyFileName string) (*PDP, error) {
+
+	config := &conf.Config{
+		PolicyFileName: policyFileName,
+	}
+
+	// Access Tokens are not verified offline, so an empty key is enough
+	noKey := func(config *conf.Config) (*jose.JSONWebKey, error) {
+		return &jose.JSONWebKey{}, nil
+	}
+
+	m, err := NewPDP(config, nil, noKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compile the policy to detect errors early
+	if _, err := m.parseAndCompileFile(policyFileName); err != nil {
+		return nil, fmt.Errorf("compiling %s: %w", policyFileName, err)
+	}
+
+	return m, nil
+}
+
+// LoadPolicyTestFile reads the test cases from a fixture file, in YAML or JSON format.
+func LoadPolicyTestFile(fileName string) ([]PolicyTestCase, error) {
+
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON is a subset of YAML, and we convert to JSON so the numbers are decoded as float64,
+	// in the same way as the objects that the PDP processes at runtime.
+	jsonContent, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", fileName, err)
+	}
+
+	var tf policyTestFile
+	if err := json.Unmarshal(jsonContent, &tf); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", fileName, err)
+	}
+
+	for i := range tf.Tests {
+		tc := &tf.Tests[i]
+		tc.File = fileName
+		if tc.Name == "" {
+			tc.Name = fmt.Sprintf("test #%d", i+1)
+		}
+		tc.Expect = strings.ToLower(tc.Expect)
+		if tc.Expect != "allow" && tc.Expect != "deny" {
+			return nil, fmt.Errorf("%s: %s: 'expect' must be 'allow' or 'deny', got %q", fileName, tc.Name, tc.Expect)
+		}
+	}
+
+	return tf.Tests, nil
+}
+
+// RunPolicyTests loads the policy file and evaluates against it the test cases in the fixture files.
+// It returns an error only if the policy or the fixtures can not be loaded. Test failures are
+// reported in the returned PolicyTestReport.
+func RunPolicyTests(policyFileName string, fixtureFiles []string) (*PolicyTestReport, error) {
+
+	m, err := NewOfflinePDP(policyFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var cases []PolicyTestCase
+	for _, f := range fixtureFiles {
+		fileCases, err := LoadPolicyTestFile(f)
+		if err != nil {
+			return nil, err
+		}
+		cases = append(cases, fileCases...)
+	}
+
+	report := &PolicyTestReport{PolicyFile: policyFileName}
+
+	for _, tc := range cases {
+		res := m.runPolicyTestCase(tc)
+		if res.Passed {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+		report.Results = append(report.Results, res)
+	}
+
+	return report, nil
+}
+
+func (m *PDP) runPolicyTestCase(tc PolicyTestCase) PolicyTestResult {
+
+	input := newPolicyInput(tc.Request, tc.Token, tc.User, tc.TMF, tc.TMFNew, nil)
+
+	res := PolicyTestResult{Case: tc}
+
+	decision, err := m.TakeAuthnDecision(Authorize, input)
+	if err != nil {
+		// An error is a rejection, as in the live PDP
+		res.Err = err
+		decision = &PolicyDecision{Allow: false}
+	}
+	res.Reason = decision.Reason
+
+	if decision.Allow {
+		res.Got = "allow"
+	} else {
+		res.Got = "deny"
+	}
+	res.Passed = res.Got == tc.Expect
+
+	return res
+}
+
+// newPolicyInput assembles the 'input' object for the policy from its elements, as decoded from JSON or YAML.
+// The user object always has some default values, and the restriction elements are calculated from
+// the object, in the same way as for live requests.
+// For UPDATE requests, tmfNew is the object after the update. If changes is nil, it is calculated from both objects.
+func newPolicyInput(request, token, user, tmf, tmfNew map[string]any, changes []any) StarTMFMap {
+
+	userArgument := StarTMFMap{
+		"isAuthenticated":        false,
+		"isLEAR":                 false,
+		"isOwner":                false,
+		"country":                "",
+		"organizationIdentifier": "",
+	}
+	for k, v := range user {
+		userArgument[k] = v
+	}
+
+	requestArgument := StarTMFMap(request)
+	if requestArgument == nil {
+		requestArgument = StarTMFMap{}
+	}
+	tokenArgument := StarTMFMap(token)
+	if tokenArgument == nil {
+		tokenArgument = StarTMFMap{}
+	}
+
+	tmfObjectArgument := StarTMFMap{}
+	for k, v := range tmf {
+		tmfObjectArgument[k] = v
+	}
+	tmfObjectArgument = getAllRestrictionElements(tmfObjectArgument)
+
+	input := StarTMFMap{
+		"request": requestArgument,
+		"token":   tokenArgument,
+		"tmf":     tmfObjectArgument,
+		"user":    userArgument,
+	}
+
+	if tmfNew != nil {
+		if changes == nil {
+			changes = objectChanges(tmf, tmfNew)
+		}
+		tmfNewArgument := StarTMFMap{}
+		for k, v := range tmfNew {
+			tmfNewArgument[k] = v
+		}
+		input["tmf_new"] = getAllRestrictionElements(tmfNewArgument)
+		input["changes"] = changes
+	}
+
+	return input
+}
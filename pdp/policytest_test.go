@@ -0,0 +1,75 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestPolicyFixtures runs the fixtures in testdata/policies against the example policy
+// at the root of the repository, in the same way as 'domepdp policy test'.
+func TestPolicyFixtures(t *testing.T) {
+
+	fixtures, err := filepath.Glob("testdata/policies/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixture files found")
+	}
+
+	report, err := RunPolicyTests("../auth_policies.star", fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, res := range report.Results {
+		if !res.Passed {
+			t.Errorf("%s: %s: expected %s, got %s (err: %v)", res.Case.File, res.Case.Name, res.Case.Expect, res.Got, res.Err)
+		}
+	}
+}
+
+func TestPolicyFixturesReportFailures(t *testing.T) {
+
+	fixture := filepath.Join(t.TempDir(), "wrong.json")
+	content := `{"tests": [
+		{"name": "wrong expectation", "user": {"country": "RU"}, "expect": "allow"},
+		{"name": "right expectation", "user": {"country": "RU"}, "expect": "deny"}
+	]}`
+	if err := os.WriteFile(fixture, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := RunPolicyTests("../auth_policies.star", []string{fixture})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.OK() || report.Passed != 1 || report.Failed != 1 {
+		t.Fatalf("expected 1 passed and 1 failed, got %d passed and %d failed", report.Passed, report.Failed)
+	}
+
+	var out strings.Builder
+	report.Print(&out)
+	if !strings.Contains(out.String(), "FAIL") || !strings.Contains(out.String(), "wrong expectation") {
+		t.Errorf("report does not include the failure:\n%s", out.String())
+	}
+}
+
+func TestLoadPolicyTestFileInvalidExpectation(t *testing.T) {
+
+	fixture := filepath.Join(t.TempDir(), "invalid.yaml")
+	if err := os.WriteFile(fixture, []byte("tests:\n  - name: bad\n    expect: maybe\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadPolicyTestFile(fixture); err == nil {
+		t.Fatal("expected an error for an invalid 'expect' value")
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	conf "github.com/hesusruiz/domeproxy/config"
+	"github.com/hesusruiz/domeproxy/internal/jpath"
+	"go.starlark.net/resolve"
+	st "go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+var ErrNoPolicyStore = errors.New("the PDP does not have a policy store")
+
+// ErrPolicyAuthor is returned when the caller changing a policy presents an invalid Access Token.
+var ErrPolicyAuthor = errors.New("invalid access token of the policy author")
+
+// PolicyValidationError is returned when an uploaded policy does not compile or fails the smoke test.
+type PolicyValidationError struct {
+	Name string
+
+	// The position in the Starlark source where the error was detected ("file:line:col"), if known
+	Position string
+
+	Msg string
+}
+
+func (e *PolicyValidationError) Error() string {
+	if e.Position != "" {
+		return fmt.Sprintf("invalid policy %s: %s: %s", e.Name, e.Position, e.Msg)
+	}
+	return fmt.Sprintf("invalid policy %s: %s", e.Name, e.Msg)
+}
+
+// newPolicyValidationError extracts the position of the error from the different errors reported by Starlark.
+func newPolicyValidationError(name string, err error) *PolicyValidationError {
+
+	var syntaxErr syntax.Error
+	var resolveErrs resolve.ErrorList
+	var evalErr *st.EvalError
+
+	switch {
+	case errors.As(err, &syntaxErr):
+		return &PolicyValidationError{Name: name, Position: syntaxErr.Pos.String(), Msg: syntaxErr.Msg}
+	case errors.As(err, &resolveErrs) && len(resolveErrs) > 0:
+		return &PolicyValidationError{Name: name, Position: resolveErrs[0].Pos.String(), Msg: resolveErrs[0].Msg}
+	case errors.As(err, &evalErr) && len(evalErr.CallStack) > 0:
+		frame := evalErr.CallStack[len(evalErr.CallStack)-1]
+		return &PolicyValidationError{Name: name, Position: frame.Pos.String(), Msg: evalErr.Msg}
+	}
+
+	return &PolicyValidationError{Name: name, Msg: err.Error()}
+}
+
+// smokeTestInput is the input used to check that a new policy can take a decision. It represents an
+// anonymous user reading a product offering without restrictions.
+func smokeTestInput() StarTMFMap {
+	return StarTMFMap{
+		"request": StarTMFMap{
+			"action":      "READ",
+			"method":      "GET",
+			"host":        "localhost",
+			"remote_addr": "127.0.0.1",
+			"path":        []any{"catalog", "productOffering", "urn:ngsi-ld:product-offering:smoke-test"},
+			"query":       StarTMFMap{},
+			"api":         "productCatalogManagement",
+			"resource":    "productOffering",
+			"id":          "urn:ngsi-ld:product-offering:smoke-test",
+		},
+		"token": StarTMFMap{},
+		"user": StarTMFMap{
+			"isAuthenticated":        false,
+			"organizationIdentifier": "",
+			"country":                "",
+			"isLEAR":                 false,
+			"isOwner":                false,
+			"isSeller":               false,
+			"isSellerOperator":       false,
+			"isBuyer":                false,
+			"isBuyerOperator":        false,
+		},
+		"tmf": StarTMFMap{
+			"id":                     "urn:ngsi-ld:product-offering:smoke-test",
+			"resource":               "productOffering",
+			"lifecycleStatus":        "Launched",
+			"organizationIdentifier": "",
+			"permittedCountries":     []any{},
+			"prohibitedCountries":    []any{},
+			"permittedCountriesRaw":  []any{},
+			"prohibitedCountriesRaw": []any{},
+			"unknownCountries":       []any{},
+			"permittedOperators":     []any{},
+			"prohibitedOperators":    []any{},
+		},
+	}
+}
+
+// ValidatePolicy checks that the new content of the file can be used by the PDP. Starlark files are compiled
+// together with the policy that uses them, and the policy must be able to take a decision for a sample request.
+// Other files (like signatures) are not checked.
+func (m *PDP) ValidatePolicy(name string, content []byte) error {
+
+	if !strings.HasSuffix(name, ".star") {
+		return nil
+	}
+
+	// The policy is compiled with a separate file cache, so the active policy is not affected.
+	validator := &PDP{
+		config:         m.config,
+		scriptname:     m.scriptname,
+		verifierKeys:   m.verifierKeys,
+		tokenChecks:    m.tokenChecks,
+		fileCache:      conf.NewSimpleFileCache(nil),
+		objectSource:   m.objectSource,
+		pipCallBudget:  m.pipCallBudget,
+		policyMaxSteps: m.policyMaxSteps,
+		policyTimeout:  m.policyTimeout,
+	}
+
+	// The files currently used by the PDP are the base, and the new content replaces one of them.
+	// This includes the files that were uploaded before, which are not in the disk.
+	if entry, err := m.fileCache.Get(m.scriptname); err == nil {
+		validator.fileCache.Set(m.scriptname, entry.Content, 0)
+	}
+	m.modules.Range(func(key, _ any) bool {
+		if entry, err := m.fileCache.Get(key.(string)); err == nil {
+			validator.fileCache.Set(key.(string), entry.Content, 0)
+		}
+		return true
+	})
+	validator.fileCache.Set(name, content, 0)
+
+	// A helper module is compiled on its own first, because the policy may not use it yet
+	if name != m.scriptname {
+		thread := &st.Thread{Name: "validate " + name, Load: validator.loadModule}
+		thread.SetLocal(localModule, name)
+		if _, err := validator.execWithLimits(thread, name, content, nil); err != nil {
+			return newPolicyValidationError(name, err)
+		}
+	}
+
+	if _, err := validator.parseAndCompileFile(m.scriptname); err != nil {
+		return newPolicyValidationError(name, err)
+	}
+
+	validator.threadPool.New = func() any {
+		return validator.BufferedParseAndCompileFile(validator.scriptname)
+	}
+	for _, decision := range []Decision{Authenticate, Authorize} {
+		if _, err := validator.takeAuthnDecision(context.Background(), decision, smokeTestInput(), nil); err != nil {
+			verr := newPolicyValidationError(name, err)
+			verr.Msg = "smoke test failed: " + verr.Msg
+			return verr
+		}
+	}
+
+	return nil
+}
+
+// SetPolicyStore sets the store where the uploaded policies are kept, and activates the versions in the store,
+// so the policies uploaded before a restart are used instead of the ones in the disk.
+func (m *PDP) SetPolicyStore(store *PolicyStore) error {
+
+	active, err := store.ActiveVersions()
+	if err != nil {
+		return err
+	}
+
+	for _, pv := range active {
+		if pv.Signature != nil {
+			if err := m.fileCache.Set(pv.Name+signatureFileSuffix, pv.Signature, 0); err != nil {
+				return err
+			}
+		}
+		if err := m.fileCache.Set(pv.Name, pv.Content, 0); err != nil {
+			return err
+		}
+		slog.Info("policy activated from the store", "file", pv.Name, "version", pv.Version, "author", pv.Author)
+	}
+
+	m.policyStore = store
+	return nil
+}
+
+// UploadPolicy validates the new content of the file and, if it is valid, stores it as a new version and activates it.
+// If the PDP does not have a store, the new content is activated without keeping the history.
+// The signature is the detached JWS over the content, which is required if the PDP is configured with trusted keys.
+func (m *PDP) UploadPolicy(name string, content []byte, signature []byte, author string) (*PolicyVersion, error) {
+	return m.activatePolicy(name, content, signature, author, "")
+}
+
+// RollbackPolicy activates again a previous version of the file, which is stored as a new version.
+func (m *PDP) RollbackPolicy(name string, version int, author string) (*PolicyVersion, error) {
+
+	if m.policyStore == nil {
+		return nil, ErrNoPolicyStore
+	}
+
+	pv, err := m.policyStore.Get(name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.activatePolicy(name, pv.Content, pv.Signature, author, fmt.Sprintf("rollback to version %d", version))
+}
+
+func (m *PDP) activatePolicy(name string, content []byte, signature []byte, author string, comment string) (*PolicyVersion, error) {
+
+	// When signatures are required, the PDP would ignore a version without a valid signature and keep
+	// using the previous one, so it is rejected instead of being recorded as the active version
+	if m.trustedPolicyKeys != nil {
+		if len(signature) == 0 {
+			return nil, fmt.Errorf("%s: %w: the signature is required", name, ErrInvalidPolicySignature)
+		}
+		if err := VerifyPolicySignature(content, signature, m.trustedPolicyKeys); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if err := m.ValidatePolicy(name, content); err != nil {
+		return nil, err
+	}
+
+	var pv *PolicyVersion
+	if m.policyStore != nil {
+		var err error
+		pv, err = m.policyStore.Add(name, content, signature, author, comment)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The signature is set first, so the new content is never checked against the previous signature
+	if len(signature) > 0 {
+		if err := m.fileCache.Set(name+signatureFileSuffix, signature, 0); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.fileCache.Set(name, content, 0); err != nil {
+		return nil, err
+	}
+
+	if pv != nil {
+		slog.Info("new policy version activated", "file", name, "version", pv.Version, "author", author, "comment", comment)
+	} else {
+		slog.Info("new policy activated without history", "file", name, "author", author)
+	}
+
+	return pv, nil
+}
+
+// PolicyAuthor returns who is changing a policy, to be recorded in the history of versions. It is the mandatee
+// (or the subject) of the Access Token of the caller, which is verified like in any other request.
+// The address of the caller is used only if the request does not include an Access Token.
+func (m *PDP) PolicyAuthor(r *http.Request) (string, error) {
+
+	claims, found, err := m.getClaimsFromToken(tokenFromHeader(r))
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrPolicyAuthor, err)
+	}
+	if found {
+		author := cmp.Or(jpath.GetString(claims, "vc.credentialSubject.mandate.mandatee.id"), jpath.GetString(claims, "sub"))
+		if author != "" {
+			return author, nil
+		}
+	}
+
+	return r.RemoteAddr, nil
+}
+
+// PolicyVersions returns the versions of the file in the store, the most recent first.
+func (m *PDP) PolicyVersions(name string) ([]PolicyVersion, error) {
+	if m.policyStore == nil {
+		return nil, ErrNoPolicyStore
+	}
+	return m.policyStore.List(name)
+}
+
+// PolicyVersion returns a version of the file in the store, including its content.
+func (m *PDP) PolicyVersion(name string, version int) (*PolicyVersion, error) {
+	if m.policyStore == nil {
+		return nil, ErrNoPolicyStore
+	}
+	return m.policyStore.Get(name, version)
+}
+
+// DiffPolicyVersions returns the differences between two versions of the file, in unified diff format.
+func (m *PDP) DiffPolicyVersions(name string, from int, to int) (string, error) {
+
+	fromVersion, err := m.PolicyVersion(name, from)
+	if err != nil {
+		return "", err
+	}
+	toVersion, err := m.PolicyVersion(name, to)
+	if err != nil {
+		return "", err
+	}
+
+	return unifiedDiff(
+		fmt.Sprintf("%s@%d", name, from),
+		fmt.Sprintf("%s@%d", name, to),
+		fromVersion.Content,
+		toVersion.Content,
+	), nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+	conf "github.com/hesusruiz/domeproxy/config"
+)
+
+func TestPolicyVersions(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+	allowPolicy := "def authorize():\n    return True\n"
+	denyPolicy := "def authorize():\n    return False\n"
+
+	if err := os.WriteFile(policyFile, []byte(allowPolicy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewPolicyStore(filepath.Join(dir, "policies.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetPolicyStore(store); err != nil {
+		t.Fatal(err)
+	}
+
+	decide := func(m *PDP) bool {
+		t.Helper()
+		decision, err := m.TakeAuthnDecision(Authorize, smokeTestInput())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decision.Allow
+	}
+
+	for _, content := range []string{allowPolicy, denyPolicy} {
+		if _, err := m.UploadPolicy(policyFile, []byte(content), nil, "tester"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if decide(m) {
+		t.Errorf("version 2 should deny")
+	}
+
+	// Invalid policies are rejected, reporting where the error is, and the active version is not changed
+	invalid := map[string]string{
+		"syntax error":  "def authorize():\n    return (True\n",
+		"runtime error": "def authorize():\n    return 1 // 0\n",
+	}
+	for desc, content := range invalid {
+		_, err := m.UploadPolicy(policyFile, []byte(content), nil, "tester")
+		var verr *PolicyValidationError
+		if !errors.As(err, &verr) {
+			t.Fatalf("%s: expected a validation error, got %v", desc, err)
+		}
+		if !strings.Contains(verr.Position, "policy.star:") {
+			t.Errorf("%s: position not reported: %v", desc, verr)
+		}
+	}
+	if decide(m) {
+		t.Errorf("an invalid policy was activated")
+	}
+
+	versions, err := m.PolicyVersions(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != 2 || !versions[0].Active || versions[1].Active {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+
+	diff, err := m.DiffPolicyVersions(policyFile, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "-    return True\n+    return False\n") {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+
+	pv, err := m.RollbackPolicy(policyFile, 1, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Version != 3 || pv.Comment != "rollback to version 1" {
+		t.Errorf("unexpected rollback version %+v", pv)
+	}
+	if !decide(m) {
+		t.Errorf("the rollback to version 1 should allow")
+	}
+
+	if _, err := m.RollbackPolicy(policyFile, 7, "tester"); !errors.Is(err, ErrPolicyVersionNotFound) {
+		t.Errorf("expected version not found, got %v", err)
+	}
+
+	// After a restart the active version in the store is used, not the one in the disk
+	if _, err := m.UploadPolicy(policyFile, []byte(denyPolicy), nil, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.SetPolicyStore(store); err != nil {
+		t.Fatal(err)
+	}
+	if decide(restarted) {
+		t.Errorf("the active version was not restored from the store")
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+
+	a := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\n"
+	b := "one\ntwo\nthree\nFOUR\nfive\nsix\nseven\neight\nnine\n"
+
+	want := `--- a
++++ b
+@@ -1,8 +1,9 @@
+ one
+ two
+ three
+-four
++FOUR
+ five
+ six
+ seven
+ eight
++nine
+`
+	if got := unifiedDiff("a", "b", []byte(a), []byte(b)); got != want {
+		t.Errorf("unexpected diff:\n%s", got)
+	}
+
+	if got := unifiedDiff("a", "b", []byte(a), []byte(a)); got != "" {
+		t.Errorf("expected no differences, got:\n%s", got)
+	}
+}
+
+func TestPolicyAuthor(t *testing.T) {
+
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.star")
+	if err := os.WriteFile(policyFile, []byte("def authorize():\n    return True\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewPDP(&conf.Config{PolicyFileName: policyFile}, nil, func(config *conf.Config) (*jose.JSONWebKey, error) {
+		return &jose.JSONWebKey{Key: &key.PublicKey, Algorithm: "ES256"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(key *ecdsa.PrivateKey) string {
+		claims := jwt.MapClaims{"sub": "did:key:subject", "vc": map[string]any{"credentialSubject": map[string]any{
+			"mandate": map[string]any{"mandatee": map[string]any{"id": "did:key:mandatee"}},
+		}}}
+		tokString, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokString
+	}
+
+	// The author is the mandatee of the verified Access Token, whatever the caller claims in other headers
+	r := httptest.NewRequest("POST", "/adminapi/v1/file/policy.star", nil)
+	r.Header.Set("Authorization", "Bearer "+sign(key))
+	r.Header.Set("X-Author", "someone else")
+	if author, err := m.PolicyAuthor(r); err != nil || author != "did:key:mandatee" {
+		t.Errorf("expected the mandatee as author, got %q %v", author, err)
+	}
+
+	// A token which can not be verified is rejected
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer "+sign(otherKey))
+	if _, err := m.PolicyAuthor(r); !errors.Is(err, ErrPolicyAuthor) {
+		t.Errorf("expected an invalid author error, got %v", err)
+	}
+
+	// Without a token, the address of the caller is used
+	r.Header.Del("Authorization")
+	if author, err := m.PolicyAuthor(r); err != nil || author != r.RemoteAddr {
+		t.Errorf("expected the address of the caller as author, got %q %v", author, err)
+	}
+}
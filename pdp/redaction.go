@@ -0,0 +1,200 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hesusruiz/domeproxy/internal/jpath"
+	"github.com/hesusruiz/domeproxy/tmfcache"
+)
+
+// The value that replaces the masked fields in the TMF objects returned to the caller.
+const maskedValue = "********"
+
+// A redaction obligation tells the PDP to remove or mask some fields of the TMF object before
+// replying to the caller. The fields are specified with dotted paths, where list elements are
+// selected with their index or with '*' for all the elements in the list. For example:
+//
+//	{"type": "redact", "remove": ["productOfferingPrice"], "mask": ["contactMedium.*.emailAddress"]}
+const obligationRedact = "redact"
+
+// redaction is the set of fields to remove or mask from a TMF object.
+type redaction struct {
+	remove []string
+	mask   []string
+}
+
+// redactionFromDecision collects all the redaction obligations in the decision.
+// It returns nil if there is nothing to redact.
+// Obligations of other types are ignored, so they can be used by other components.
+func redactionFromDecision(decision *PolicyDecision) (*redaction, error) {
+	if decision == nil || len(decision.Obligations) == 0 {
+		return nil, nil
+	}
+
+	r := &redaction{}
+
+	for _, o := range decision.Obligations {
+		obligation, ok := o.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid obligation: %v", o)
+		}
+		if jpath.GetString(obligation, "type") != obligationRedact {
+			continue
+		}
+
+		for _, field := range []string{"remove", "mask"} {
+			paths, ok := obligation[field]
+			if !ok {
+				continue
+			}
+			list, ok := paths.([]any)
+			if !ok {
+				return nil, fmt.Errorf("invalid redaction obligation: '%s' must be a list of paths", field)
+			}
+			for _, p := range list {
+				path, ok := p.(string)
+				if !ok || len(path) == 0 {
+					return nil, fmt.Errorf("invalid redaction obligation: invalid path in '%s': %v", field, p)
+				}
+				if field == "remove" {
+					r.remove = append(r.remove, path)
+				} else {
+					r.mask = append(r.mask, path)
+				}
+			}
+		}
+	}
+
+	if len(r.remove) == 0 && len(r.mask) == 0 {
+		return nil, nil
+	}
+
+	return r, nil
+}
+
+// applyObligations returns the view of the TMF object that the caller is allowed to see,
+// according to the obligations in the decision.
+// If there is something to redact, a new object is returned with a redacted copy of the content, so the
+// original object is never modified. Otherwise the original object is returned.
+func applyObligations(tmfObject tmfcache.TMFObject, decision *PolicyDecision) (tmfcache.TMFObject, error) {
+
+	r, err := redactionFromDecision(decision)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return tmfObject, nil
+	}
+
+	original, ok := tmfObject.(*tmfcache.TMFGeneralObject)
+	if !ok {
+		return nil, fmt.Errorf("unsupported object type for redaction: %T", tmfObject)
+	}
+
+	content := deepCopyJSON(original.GetContentAsMap()).(map[string]any)
+
+	for _, path := range r.remove {
+		content = redactPath(content, strings.Split(path, "."), false).(map[string]any)
+	}
+	for _, path := range r.mask {
+		content = redactPath(content, strings.Split(path, "."), true).(map[string]any)
+	}
+
+	redacted := *original
+	redacted.ContentAsMap = content
+	redacted.ContentAsJSON = nil
+
+	return &redacted, nil
+}
+
+// redactPath removes or masks the element at the path inside data, returning the updated data.
+// Non-existent paths are ignored, as the policy may be written for objects with optional fields.
+func redactPath(data any, path []string, mask bool) any {
+	if len(path) == 0 {
+		return data
+	}
+	component, rest := path[0], path[1:]
+
+	switch d := data.(type) {
+
+	case map[string]any:
+		value, ok := d[component]
+		if !ok {
+			return d
+		}
+		if len(rest) > 0 {
+			d[component] = redactPath(value, rest, mask)
+		} else if mask {
+			d[component] = maskedValue
+		} else {
+			delete(d, component)
+		}
+		return d
+
+	case []any:
+		selected := func(i int) bool { return true }
+		if component != "*" {
+			index, err := strconv.Atoi(component)
+			if err != nil {
+				return d
+			}
+			selected = func(i int) bool { return i == index }
+		}
+
+		var result []any
+		for i, elem := range d {
+			switch {
+			case !selected(i):
+				result = append(result, elem)
+			case len(rest) > 0:
+				result = append(result, redactPath(elem, rest, mask))
+			case mask:
+				result = append(result, maskedValue)
+			default:
+				// The element is removed from the list
+			}
+		}
+		if result == nil {
+			result = []any{}
+		}
+		return result
+
+	default:
+		return d
+	}
+}
+
+// deepCopyJSON copies the maps and lists in a JSON-like object, so the copy can be modified
+// without affecting the original.
+func deepCopyJSON(data any) any {
+	switch d := data.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(d))
+		for k, v := range d {
+			m[k] = deepCopyJSON(v)
+		}
+		return m
+	case StarTMFMap:
+		return deepCopyJSON(map[string]any(d))
+	case []any:
+		l := make([]any, len(d))
+		for i, v := range d {
+			l[i] = deepCopyJSON(v)
+		}
+		return l
+	case []string:
+		l := make([]any, len(d))
+		for i, v := range d {
+			l[i] = v
+		}
+		return l
+	default:
+		return d
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hesusruiz/domeproxy/tmfcache"
+)
+
+func TestApplyObligations(t *testing.T) {
+
+	content := []byte(`{
+		"id": "urn:ngsi-ld:product-offering:0001",
+		"href": "urn:ngsi-ld:product-offering:0001",
+		"@type": "productOffering",
+		"name": "Offering",
+		"version": "1.0",
+		"lifecycleStatus": "Launched",
+		"lastUpdate": "2025-01-01T00:00:00Z",
+		"internalPrice": 10,
+		"contactMedium": [
+			{"mediumType": "email", "emailAddress": "a@example.com"},
+			{"mediumType": "email", "emailAddress": "b@example.com"}
+		]
+	}`)
+
+	tmfObject, err := tmfcache.TMFObjectFromBytes(content, "productOffering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalETag := tmfObject.ETag()
+
+	decision := &PolicyDecision{
+		Allow: true,
+		Obligations: []any{
+			map[string]any{
+				"type":   "redact",
+				"remove": []any{"internalPrice", "nonexistent.field"},
+				"mask":   []any{"contactMedium.*.emailAddress"},
+			},
+		},
+	}
+
+	view, err := applyObligations(tmfObject, decision)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viewMap := view.GetContentAsMap()
+	if _, ok := viewMap["internalPrice"]; ok {
+		t.Errorf("internalPrice was not removed")
+	}
+	wantContacts := []any{
+		map[string]any{"mediumType": "email", "emailAddress": maskedValue},
+		map[string]any{"mediumType": "email", "emailAddress": maskedValue},
+	}
+	if !reflect.DeepEqual(viewMap["contactMedium"], wantContacts) {
+		t.Errorf("contactMedium not masked: %v", viewMap["contactMedium"])
+	}
+
+	// The original object must not be modified
+	if _, ok := tmfObject.GetContentAsMap()["internalPrice"]; !ok {
+		t.Errorf("the original object was modified")
+	}
+	if tmfObject.ETag() != originalETag {
+		t.Errorf("the ETag of the original object changed")
+	}
+
+	// The ETag is calculated on the redacted view
+	if view.ETag() == originalETag {
+		t.Errorf("the ETag of the redacted view is the same as the original")
+	}
+
+	// Without obligations, the same object is returned
+	same, err := applyObligations(tmfObject, &PolicyDecision{Allow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != tmfObject {
+		t.Errorf("expected the original object when there is nothing to redact")
+	}
+}
+
+func TestRedactPathRemoveListElement(t *testing.T) {
+
+	data := map[string]any{
+		"relatedParty": []any{"seller", "buyer", "operator"},
+	}
+
+	got := redactPath(data, []string{"relatedParty", "1"}, false)
+
+	want := map[string]any{
+		"relatedParty": []any{"seller", "operator"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The groups of countries which can be used in the country restrictions of the TMF objects, instead of
+// listing all their members. The memberships must be kept up to date when they change.
+var regionGroups = map[string][]string{
+	// The Member States of the European Union, since 1 February 2020
+	"EU": {
+		"AT", "BE", "BG", "HR", "CY", "CZ", "DK", "EE", "FI", "FR", "DE", "GR", "HU", "IE",
+		"IT", "LV", "LT", "LU", "MT", "NL", "PL", "PT", "RO", "SK", "SI", "ES", "SE",
+	},
+
+	// The European Economic Area: the EU plus Iceland, Liechtenstein and Norway
+	"EEA": {
+		"AT", "BE", "BG", "HR", "CY", "CZ", "DK", "EE", "FI", "FR", "DE", "GR", "HU", "IE",
+		"IT", "LV", "LT", "LU", "MT", "NL", "PL", "PT", "RO", "SK", "SI", "ES", "SE",
+		"IS", "LI", "NO",
+	},
+
+	// The European Free Trade Association
+	"EFTA": {"IS", "LI", "NO", "CH"},
+}
+
+// The codes used for Greece and the United Kingdom in EU contexts, which are replaced by their ISO 3166-1 codes
+var countryAliases = map[string]string{
+	"EL": "GR",
+	"UK": "GB",
+}
+
+// The ISO 3166-1 alpha-2 country codes
+var countryCodes = func() map[string]bool {
+	codes := map[string]bool{}
+	for _, c := range strings.Fields(`
+		AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS BT BV BW
+		BY BZ CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI
+		FJ FK FM FO FR GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM HN HR HT HU ID IE IL IM IN
+		IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME
+		MF MG MH MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF
+		PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV
+		SX SY SZ TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI VN VU WF WS YE
+		YT ZA ZM ZW XK`) {
+		codes[c] = true
+	}
+	return codes
+}()
+
+// normalizeCountry returns the country code in upper case, with the aliases replaced by the ISO 3166-1 code.
+func normalizeCountry(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if iso, isAlias := countryAliases[code]; isAlias {
+		return iso
+	}
+	return code
+}
+
+// expandRegions replaces the group codes in the list by the countries in the group, and the aliases of
+// countries by their ISO 3166-1 code, without duplicates. Codes which are neither a country nor a group are
+// kept in the list, so they do not match any country, and are also returned as unknown.
+func expandRegions(codes []string) (countries []string, unknown []string) {
+
+	countries = []string{}
+	add := func(c string) {
+		if !slices.Contains(countries, c) {
+			countries = append(countries, c)
+		}
+	}
+
+	for _, code := range codes {
+		country := normalizeCountry(code)
+		if members, isGroup := regionGroups[country]; isGroup {
+			for _, c := range members {
+				add(c)
+			}
+			continue
+		}
+		if !countryCodes[country] {
+			unknown = append(unknown, code)
+		}
+		add(country)
+	}
+
+	return countries, unknown
+}
+
+// regionsIncluding returns the country, its aliases and the codes of the groups which include it, which are
+// all the codes that select the country in a restriction.
+func regionsIncluding(country string) []string {
+	country = normalizeCountry(country)
+	codes := []string{country}
+	for alias, iso := range countryAliases {
+		if iso == country {
+			codes = append(codes, alias)
+		}
+	}
+	for group, members := range regionGroups {
+		if slices.Contains(members, country) {
+			codes = append(codes, group)
+		}
+	}
+	slices.Sort(codes[1:])
+	return codes
+}
+
+// The maximum number of objects remembered to log their unknown country codes only once
+const maxUnknownCountriesLogged = 10000
+
+// unknownCountriesLogged are the objects and codes already logged, so the same object is not logged again
+// in every evaluation of the policies. It is emptied when full, because the objects of UPDATE requests
+// come from the callers.
+var unknownCountriesLogged = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: map[string]bool{}}
+
+// logUnknownCountries logs the unknown country codes in the restrictions of an object, once for each
+// object and list of codes.
+func logUnknownCountries(id any, codes []string) {
+	key := fmt.Sprintf("%v|%s", id, strings.Join(codes, ","))
+
+	logged := &unknownCountriesLogged
+	logged.Lock()
+	if logged.seen[key] {
+		logged.Unlock()
+		return
+	}
+	if len(logged.seen) >= maxUnknownCountriesLogged {
+		clear(logged.seen)
+	}
+	logged.seen[key] = true
+	logged.Unlock()
+
+	slog.Warn("unknown country codes in restrictions", "id", id, "codes", codes)
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"bytes"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hesusruiz/domeproxy/tmfcache"
+	st "go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+func TestExpandRegions(t *testing.T) {
+
+	countries, unknown := expandRegions([]string{"es", "EFTA", "NO", "XX"})
+	want := []string{"ES", "IS", "LI", "NO", "CH", "XX"}
+	if !slices.Equal(countries, want) {
+		t.Errorf("expected %v, got %v", want, countries)
+	}
+	if !slices.Equal(unknown, []string{"XX"}) {
+		t.Errorf("expected XX to be unknown, got %v", unknown)
+	}
+
+	countries, unknown = expandRegions([]string{"EEA"})
+	if len(countries) != 30 || len(unknown) != 0 {
+		t.Errorf("expected the 30 countries of the EEA, got %v (unknown %v)", countries, unknown)
+	}
+	for _, c := range regionGroups["EU"] {
+		if !slices.Contains(countries, c) {
+			t.Errorf("EU country %s not in the EEA", c)
+		}
+	}
+
+	if got := regionsIncluding("no"); !slices.Equal(got, []string{"NO", "EEA", "EFTA"}) {
+		t.Errorf("unexpected regions including NO: %v", got)
+	}
+
+	// The codes used in EU contexts are the same countries as their ISO codes
+	countries, unknown = expandRegions([]string{"EL", "gr", "UK"})
+	if !slices.Equal(countries, []string{"GR", "GB"}) || len(unknown) != 0 {
+		t.Errorf("expected GR and GB, got %v (unknown %v)", countries, unknown)
+	}
+	for _, country := range []string{"GR", "el"} {
+		if got := regionsIncluding(country); !slices.Equal(got, []string{"GR", "EEA", "EL", "EU"}) {
+			t.Errorf("unexpected regions including %s: %v", country, got)
+		}
+	}
+}
+
+func TestRestrictionElementsWithRegions(t *testing.T) {
+
+	offering := getAllRestrictionElements(StarTMFMap{
+		"id": "urn:ngsi-ld:product-offering:0000",
+		"productOfferingTerm": []any{map[string]any{
+			"@type":                 "OperatorRestriction",
+			"permittedLegalRegion":  []any{map[string]any{"country": "EU"}, map[string]any{"country": "CH"}},
+			"prohibitedLegalRegion": []any{map[string]any{"country": "FR"}, map[string]any{"country": "ZZ"}},
+		}},
+	})
+
+	tests := []struct {
+		expr string
+		want st.Value
+	}{
+		{`"DE" in offering.permittedCountries`, st.True},
+		{`"CH" in offering.permittedCountries`, st.True},
+		{`"NO" not in offering.permittedCountries`, st.True},
+		{`"EU" in offering.permittedCountriesRaw`, st.True},
+		{`"DE" in offering.permittedCountriesRaw`, st.False},
+		{`len(offering.permittedCountries)`, st.MakeInt(28)},
+		{`offering.unknownCountries[0]`, st.String("ZZ")},
+		{`len(offering.unknownCountries)`, st.MakeInt(1)},
+		{`dome.country_permitted(offering, "IT")`, st.True},
+		{`dome.country_permitted(offering, "FR")`, st.False},
+		{`dome.country_permitted(offering, "NO")`, st.False},
+	}
+
+	env := st.StringDict{"offering": offering}
+	for _, tt := range tests {
+		got, err := st.EvalOptions(&syntax.FileOptions{}, &st.Thread{}, "<test>", tt.expr, env)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if eq, _ := st.Equal(got, tt.want); !eq {
+			t.Errorf("%s: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+}
+
+func TestUnknownCountriesLoggedOnce(t *testing.T) {
+
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	offering := func(country string) StarTMFMap {
+		return StarTMFMap{
+			"id": "urn:ngsi-ld:product-offering:0001",
+			"productOfferingTerm": []any{map[string]any{
+				"@type":                "OperatorRestriction",
+				"permittedLegalRegion": []any{map[string]any{"country": country}},
+			}},
+		}
+	}
+
+	for range 3 {
+		getAllRestrictionElements(offering("ZZ"))
+	}
+	getAllRestrictionElements(offering("XY"))
+
+	if n := strings.Count(buf.String(), "unknown country codes"); n != 2 {
+		t.Errorf("expected the unknown codes of each version of the object logged once, got %d logs:\n%s", n, buf.String())
+	}
+}
+
+func TestRestrictionElementsDoNotModifyTheObject(t *testing.T) {
+
+	object, err := tmfcache.TMFObjectFromBytes([]byte(`{
+		"id": "urn:ngsi-ld:product-offering:0001",
+		"href": "urn:ngsi-ld:product-offering:0001",
+		"@type": "productOffering",
+		"lastUpdate": "2025-01-01T00:00:00Z",
+		"productOfferingTerm": [{"@type": "OperatorRestriction", "permittedLegalRegion": [{"country": "EU"}]}]
+	}`), "productOffering")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argument := readObjectArguments(object.(*tmfcache.TMFGeneralObject), StarTMFMap{})
+	if len(argument["permittedCountries"].([]string)) != 27 {
+		t.Errorf("unexpected permitted countries %v", argument["permittedCountries"])
+	}
+
+	// The calculated lists are not returned to the callers with the object
+	for _, member := range []string{"permittedCountries", "permittedCountriesRaw", "unknownCountries", "permittedOperators"} {
+		if _, found := object.GetContentAsMap()[member]; found {
+			t.Errorf("member %s added to the object", member)
+		}
+	}
+}
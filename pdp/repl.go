@@ -0,0 +1,328 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/chzyer/readline"
+	"go.starlark.net/repl"
+	st "go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// DecisionInput is the 'input' object of a decision, as recorded in a file or written by hand.
+type DecisionInput struct {
+	Request map[string]any `json:"request"`
+	Token   map[string]any `json:"token"`
+	User    map[string]any `json:"user"`
+	TMF     map[string]any `json:"tmf"`
+
+	// The object after the update and the changed members, only for UPDATE requests
+	TMFNew  map[string]any `json:"tmf_new,omitempty"`
+	Changes []any          `json:"changes,omitempty"`
+}
+
+// LoadDecisionInput reads the 'input' object for a policy from a file, which can be:
+//
+//   - A JSON file with one input object, with the 'request', 'token', 'user' and 'tmf' members,
+//     and optionally 'tmf_new' and 'changes' for UPDATE requests.
+//   - A file with captured inputs, one per line as JSON Lines. The selector is the line number,
+//     starting from 1, and the last one is used by default.
+//   - A policy test fixture file (see [LoadPolicyTestFile]). The selector is the name of the test case,
+//     and the first one is used by default.
+func LoadDecisionInput(fileName string, selector string) (StarTMFMap, error) {
+
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var inputs []map[string]any
+	dec := json.NewDecoder(bytes.NewReader(content))
+	for {
+		var in map[string]any
+		err = dec.Decode(&in)
+		if err != nil {
+			break
+		}
+		inputs = append(inputs, in)
+	}
+
+	// Files which are not JSON can be fixtures in YAML
+	if !errors.Is(err, io.EOF) || len(inputs) == 0 || (len(inputs) == 1 && inputs[0]["tests"] != nil) {
+		return loadFixtureInput(fileName, selector)
+	}
+
+	index, err := selectInput(len(inputs), selector)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid line: %w", fileName, err)
+	}
+
+	var in DecisionInput
+	raw, _ := json.Marshal(inputs[index])
+	if err := json.Unmarshal(raw, &in); err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+
+	return newPolicyInput(in.Request, in.Token, in.User, in.TMF, in.TMFNew, in.Changes), nil
+}
+
+// LoadAuditInput reads the 'input' object of a decision in the audit log of the database, taken for the
+// request with the given identifier. LIST requests take a decision for each object, so the selector is the
+// number of the decision, starting from 1, and the last one is used by default.
+func LoadAuditInput(dbname string, requestID string, selector string) (StarTMFMap, error) {
+
+	auditLog, err := NewAuditLog(dbname, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer auditLog.Close()
+
+	inputs, err := auditLog.Inputs(requestID)
+	if err != nil {
+		return nil, err
+	}
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("no decisions with input in the audit log for request '%s' (the capture of the inputs must be enabled)", requestID)
+	}
+
+	index, err := selectInput(len(inputs), selector)
+	if err != nil {
+		return nil, fmt.Errorf("request '%s': invalid decision: %w", requestID, err)
+	}
+
+	in := inputs[index]
+	return newPolicyInput(in.Request, in.Token, in.User, in.TMF, in.TMFNew, in.Changes), nil
+}
+
+// selectInput returns the index of the input given by the selector, which is its number starting
+// from 1, or the last one if the selector is empty.
+func selectInput(count int, selector string) (int, error) {
+	if selector == "" {
+		return count - 1, nil
+	}
+	n, err := strconv.Atoi(selector)
+	if err != nil || n < 1 || n > count {
+		return 0, fmt.Errorf("'%s', there are %d inputs", selector, count)
+	}
+	return n - 1, nil
+}
+
+func loadFixtureInput(fileName string, name string) (StarTMFMap, error) {
+
+	cases, err := LoadPolicyTestFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("%s: no inputs found", fileName)
+	}
+
+	for _, tc := range cases {
+		if name == "" || tc.Name == name {
+			return newPolicyInput(tc.Request, tc.Token, tc.User, tc.TMF, tc.TMFNew, nil), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s: test case '%s' not found", fileName, name)
+}
+
+// PolicyREPL runs an interactive read, eval, print loop with the globals of the policy and the given
+// 'input' object, so Starlark expressions like 'input.user.country' or 'authorize()' can be evaluated
+// while debugging a policy. Names and the attributes of objects can be completed with the Tab key.
+// Control-C interrupts a long running evaluation, and Control-D exits.
+func (m *PDP) PolicyREPL(input StarTMFMap) error {
+
+	te, err := m.parseAndCompileFile(m.config.PolicyFileName)
+	if err != nil {
+		return fmt.Errorf("compiling %s: %w", m.config.PolicyFileName, err)
+	}
+
+	// Functions of the policy access the input via the predeclared environment of the module
+	te.predeclared["input"] = input
+	te.thread.SetLocal(localPIP, &pipState{source: m.objectSource, remaining: m.pipCallBudget})
+	te.thread.SetLocal(localInput, input)
+	te.thread.Print = func(_ *st.Thread, msg string) {
+		fmt.Println(msg)
+	}
+
+	// The environment of the REPL is a copy, so new variables can be defined
+	env := st.StringDict{}
+	for k, v := range te.predeclared {
+		env[k] = v
+	}
+	for k, v := range te.globals {
+		env[k] = v
+	}
+
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:       ">>> ",
+		AutoComplete: replCompleter{env: env},
+	})
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	defer signal.Stop(interrupted)
+
+	for {
+		err := replStep(rl, te.thread, env, interrupted)
+		if err == readline.ErrInterrupt {
+			fmt.Println(err)
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// replStep reads, evaluates and prints one item. Starlark errors are printed, and an error is returned
+// only if reading failed.
+func replStep(rl *readline.Instance, thread *st.Thread, env st.StringDict, interrupted chan os.Signal) error {
+
+	// Each item can be cancelled by a SIGINT
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-interrupted:
+			thread.Cancel("interrupted")
+		case <-ctx.Done():
+		}
+	}()
+	defer thread.Uncancel()
+
+	eof := false
+
+	rl.SetPrompt(">>> ")
+	readLine := func() ([]byte, error) {
+		line, err := rl.Readline()
+		rl.SetPrompt("... ")
+		if err != nil {
+			if err == io.EOF {
+				eof = true
+			}
+			return nil, err
+		}
+		return []byte(line + "\n"), nil
+	}
+
+	f, err := (&syntax.FileOptions{}).ParseCompoundStmt("<stdin>", readLine)
+	if err != nil {
+		if eof {
+			return io.EOF
+		}
+		if err == readline.ErrInterrupt {
+			return err
+		}
+		repl.PrintError(err)
+		return nil
+	}
+
+	if len(f.Stmts) == 1 {
+		if stmt, ok := f.Stmts[0].(*syntax.ExprStmt); ok {
+			v, err := st.EvalExprOptions(f.Options, thread, stmt.X, env)
+			if err != nil {
+				repl.PrintError(err)
+				return nil
+			}
+			env["_"] = v
+			if v != st.None {
+				fmt.Println(v)
+			}
+			return nil
+		}
+	}
+
+	if err := st.ExecREPLChunk(f, thread, env); err != nil {
+		repl.PrintError(err)
+	}
+
+	return nil
+}
+
+// replCompleter completes names of the environment and attributes of objects in the REPL.
+type replCompleter struct {
+	env st.StringDict
+}
+
+func (c replCompleter) Do(line []rune, pos int) (newLine [][]rune, length int) {
+	candidates, partial := replCompletions(c.env, string(line[:pos]))
+	for _, candidate := range candidates {
+		newLine = append(newLine, []rune(candidate[len(partial):]))
+	}
+	return newLine, len([]rune(partial))
+}
+
+// replCompletions returns the candidates for completing the dotted name at the end of line, like 'input.us',
+// and the partial name being completed. Attributes are resolved without evaluating any code.
+func replCompletions(env st.StringDict, line string) (candidates []string, partial string) {
+
+	start := len(line)
+	for start > 0 && isDottedNameChar(line[start-1]) {
+		start--
+	}
+	names := strings.Split(line[start:], ".")
+	partial = names[len(names)-1]
+
+	var attrNames []string
+	if len(names) == 1 {
+		attrNames = append(env.Keys(), st.Universe.Keys()...)
+	} else {
+		v, ok := env[names[0]]
+		if !ok {
+			v, ok = st.Universe[names[0]]
+		}
+		if !ok {
+			return nil, partial
+		}
+		for _, name := range names[1 : len(names)-1] {
+			hasAttrs, ok := v.(st.HasAttrs)
+			if !ok {
+				return nil, partial
+			}
+			v, _ = hasAttrs.Attr(name)
+			if v == nil {
+				return nil, partial
+			}
+		}
+		hasAttrs, ok := v.(st.HasAttrs)
+		if !ok {
+			return nil, partial
+		}
+		attrNames = hasAttrs.AttrNames()
+	}
+
+	for _, name := range attrNames {
+		if strings.HasPrefix(name, partial) {
+			candidates = append(candidates, name)
+		}
+	}
+	slices.Sort(candidates)
+
+	return slices.Compact(candidates), partial
+}
+
+func isDottedNameChar(c byte) bool {
+	return c == '.' || c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
@@ -0,0 +1,183 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/hesusruiz/domeproxy/internal/jpath"
+	"github.com/hesusruiz/domeproxy/internal/middleware"
+	st "go.starlark.net/starlark"
+)
+
+func TestLoadDecisionInput(t *testing.T) {
+
+	dir := t.TempDir()
+
+	captured := filepath.Join(dir, "inputs.jsonl")
+	content := `{"request": {"action": "READ"}, "user": {"country": "FR"}, "tmf": {"id": "urn:1"}}
+{"request": {"action": "UPDATE"}, "user": {"country": "ES", "isLEAR": true}, "tmf": {"id": "urn:2"}}
+`
+	if err := os.WriteFile(captured, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	single := filepath.Join(dir, "input.json")
+	if err := os.WriteFile(single, []byte("{\n  \"user\": {\"country\": \"IT\"}\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := filepath.Join("testdata", "policies", "auth_policies.yaml")
+
+	tests := []struct {
+		file     string
+		selector string
+		country  string
+		wantErr  bool
+	}{
+		{captured, "", "ES", false},
+		{captured, "1", "FR", false},
+		{captured, "3", "", true},
+		{single, "", "IT", false},
+		{fixture, "user from a forbidden country is rejected", "RU", false},
+		{fixture, "no such test", "", true},
+	}
+
+	for _, tt := range tests {
+		input, err := LoadDecisionInput(tt.file, tt.selector)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s [%s]: expected an error", tt.file, tt.selector)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s [%s]: %v", tt.file, tt.selector, err)
+		}
+
+		// The user always has the default values
+		user := input["user"].(StarTMFMap)
+		if user["country"] != tt.country || user["isOwner"] != false {
+			t.Errorf("%s [%s]: unexpected user %v", tt.file, tt.selector, user)
+		}
+	}
+}
+
+func TestREPLCompletions(t *testing.T) {
+
+	env := st.StringDict{
+		"input": StarTMFMap{
+			"user":    StarTMFMap{"country": "ES", "isLEAR": false, "isOwner": false},
+			"request": StarTMFMap{"action": "READ"},
+		},
+		"isAllowed": st.True,
+	}
+
+	tests := []struct {
+		line    string
+		want    []string
+		partial string
+	}{
+		{"inp", []string{"input"}, "inp"},
+		{"x = input.", []string{"request", "user"}, ""},
+		{"input.user.is", []string{"isLEAR", "isOwner"}, "is"},
+		{"print(input.request.ac", []string{"action"}, "ac"},
+		{"input.nothing.x", nil, "x"},
+		{"is", []string{"isAllowed"}, "is"},
+	}
+
+	for _, tt := range tests {
+		got, partial := replCompletions(env, tt.line)
+		if !slices.Equal(got, tt.want) || partial != tt.partial {
+			t.Errorf("%q: expected %v (%q), got %v (%q)", tt.line, tt.want, tt.partial, got, partial)
+		}
+	}
+}
+
+func TestLoadAuditInput(t *testing.T) {
+
+	dbname := filepath.Join(t.TempDir(), "audit.db")
+	auditLog, err := NewAuditLog(dbname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policyFile := filepath.Join(t.TempDir(), "policy.star")
+	if err := os.WriteFile(policyFile, []byte("def authorize():\n    return input.user.country == \"ES\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetAuditLog(auditLog)
+
+	// The decisions of a LIST request, identified by the request ID set by the middleware
+	token := StarTMFMap{"vc": map[string]any{"credentialSubject": map[string]any{"mandate": map[string]any{
+		"mandatee": map[string]any{"id": "did:key:mandatee", "email": "someone@example.org"},
+	}}}}
+	handler := middleware.RequestLogger(slog.Default(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, id := range []string{"urn:1", "urn:2"} {
+			user := StarTMFMap{"country": "ES"}
+			takeDecision(r.Context(), m, StarTMFMap{"action": "LIST"}, token, StarTMFMap{"id": id}, user, nil)
+		}
+	}))
+	serve := func(requestID string) {
+		r := httptest.NewRequest("GET", "/catalog/productOffering", nil)
+		r.Header.Set(middleware.RequestIDHeaderKey, requestID)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// The inputs are only kept when enabled
+	serve("req-0")
+	auditLog.SetCaptureInputs(true)
+	serve("req-1")
+
+	if err := auditLog.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		requestID string
+		selector  string
+		id        string
+		wantErr   bool
+	}{
+		{"req-0", "", "", true},
+		{"req-1", "", "urn:2", false},
+		{"req-1", "1", "urn:1", false},
+		{"req-1", "3", "", true},
+		{"req-2", "", "", true},
+	}
+
+	for _, tt := range tests {
+		input, err := LoadAuditInput(dbname, tt.requestID, tt.selector)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s [%s]: expected an error", tt.requestID, tt.selector)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s [%s]: %v", tt.requestID, tt.selector, err)
+		}
+
+		if id := input["tmf"].(StarTMFMap)["id"]; id != tt.id {
+			t.Errorf("%s [%s]: expected object %s, got %v", tt.requestID, tt.selector, tt.id, id)
+		}
+
+		// The personal data in the Access Token is not stored
+		mandatee := jpath.GetMap(map[string]any(input["token"].(StarTMFMap)), "vc.credentialSubject.mandate.mandatee")
+		if mandatee["email"] != redacted || mandatee["id"] != "did:key:mandatee" {
+			t.Errorf("%s [%s]: unexpected mandatee %v", tt.requestID, tt.selector, mandatee)
+		}
+	}
+}
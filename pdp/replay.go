@@ -0,0 +1,297 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/greyxor/slogor"
+)
+
+// DecisionRecorder writes the full inputs of the authorization decisions to a file as JSON Lines, so they
+// can be replayed offline against other versions of the policy. The personal data in the Access Token
+// is redacted, but the rest of the claims are kept because the policies may depend on them.
+type DecisionRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// recordedDecision is a line in the file written by the DecisionRecorder.
+type recordedDecision struct {
+	DecisionInput
+	Time  time.Time `json:"time"`
+	Allow bool      `json:"allow"`
+}
+
+// The claims of the Access Token with personal data, which are not recorded.
+var redactedClaims = map[string]bool{
+	"email":        true,
+	"emailAddress": true,
+	"first_name":   true,
+	"firstName":    true,
+	"last_name":    true,
+	"lastName":     true,
+	"mobile_phone": true,
+	"commonName":   true,
+	"serialNumber": true,
+}
+
+// Any string in the claims which looks like a JWT, like an embedded credential
+var jwtPattern = regexp.MustCompile(`^eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*$`)
+
+const redacted = "REDACTED"
+
+// NewDecisionRecorder creates a recorder which appends the decisions to the file.
+func NewDecisionRecorder(fileName string) (*DecisionRecorder, error) {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening decision recording file: %w", err)
+	}
+	return &DecisionRecorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Close closes the recording file.
+func (r *DecisionRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// record writes the input of a decision. The input is encoded before returning, because some
+// of its elements are reused for the next decisions.
+func (r *DecisionRecorder) record(input StarTMFMap, decision *PolicyDecision) {
+
+	rec := recordedDecision{DecisionInput: redactedDecisionInput(input), Time: time.Now(), Allow: decision.Allow}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(rec); err != nil {
+		slog.Warn("PDP: recording decision", slogor.Err(err))
+	}
+}
+
+// redactedDecisionInput returns the members of the input of a decision, with the personal data
+// in the Access Token redacted.
+func redactedDecisionInput(input StarTMFMap) DecisionInput {
+	var in DecisionInput
+	in.Request, _ = input["request"].(StarTMFMap)
+	in.User, _ = input["user"].(StarTMFMap)
+	in.TMF, _ = input["tmf"].(StarTMFMap)
+	in.TMFNew, _ = input["tmf_new"].(StarTMFMap)
+	in.Changes, _ = input["changes"].([]any)
+	token, _ := input["token"].(StarTMFMap)
+	in.Token, _ = redactClaims(map[string]any(token)).(map[string]any)
+	return in
+}
+
+// redactClaims returns a copy of the claims without personal data.
+func redactClaims(v any) any {
+	switch v := v.(type) {
+	case StarTMFMap:
+		return redactClaims(map[string]any(v))
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			if redactedClaims[k] {
+				out[k] = redacted
+				continue
+			}
+			out[k] = redactClaims(e)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = redactClaims(e)
+		}
+		return out
+	case string:
+		if jwtPattern.MatchString(v) {
+			return redacted
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// SetDecisionRecorder sets the recorder of the inputs of the authorization decisions.
+func (m *PDP) SetDecisionRecorder(recorder *DecisionRecorder) {
+	m.recorder = recorder
+}
+
+// ReplayFlips are the decisions for a resource which are different with the compared policy.
+type ReplayFlips struct {
+	Resource    string
+	AllowToDeny int
+	DenyToAllow int
+
+	// Some ids of the objects whose decisions changed
+	Examples []string
+}
+
+// ReplayReport summarizes the decisions of replaying recorded inputs against a policy, and optionally
+// the decisions that change with another policy.
+type ReplayReport struct {
+	PolicyFile  string
+	CompareFile string
+	Inputs      int
+
+	Allow  int
+	Deny   int
+	Errors int
+
+	CompareAllow  int
+	CompareDeny   int
+	CompareErrors int
+
+	// The flipped decisions, sorted by resource
+	Flips []*ReplayFlips
+}
+
+// The maximum number of example ids for each resource in the report.
+const maxReplayExamples = 3
+
+// ReplayDecisions evaluates offline the recorded inputs in the file against the policy, and against
+// the compared policy if compareFile is not empty. Errors evaluating a policy are counted as denials,
+// as in the live PDP.
+func ReplayDecisions(policyFile string, compareFile string, inputsFile string) (*ReplayReport, error) {
+
+	m, err := NewOfflinePDP(policyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var compare *PDP
+	if compareFile != "" {
+		compare, err = NewOfflinePDP(compareFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(inputsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	report := &ReplayReport{PolicyFile: policyFile, CompareFile: compareFile}
+	flips := map[string]*ReplayFlips{}
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var in DecisionInput
+		if err := dec.Decode(&in); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("%s: input %d: %w", inputsFile, report.Inputs+1, err)
+		}
+		report.Inputs++
+
+		input := newPolicyInput(in.Request, in.Token, in.User, in.TMF, in.TMFNew, in.Changes)
+
+		allow, failed := replayDecision(m, input)
+		countReplayDecision(allow, failed, &report.Allow, &report.Deny, &report.Errors)
+
+		if compare == nil {
+			continue
+		}
+
+		compareAllow, compareFailed := replayDecision(compare, input)
+		countReplayDecision(compareAllow, compareFailed, &report.CompareAllow, &report.CompareDeny, &report.CompareErrors)
+
+		if allow == compareAllow {
+			continue
+		}
+
+		resource, _ := in.Request["resource"].(string)
+		flip := flips[resource]
+		if flip == nil {
+			flip = &ReplayFlips{Resource: resource}
+			flips[resource] = flip
+		}
+		if allow {
+			flip.AllowToDeny++
+		} else {
+			flip.DenyToAllow++
+		}
+
+		id, _ := in.TMF["id"].(string)
+		if id == "" {
+			id, _ = in.Request["id"].(string)
+		}
+		if id != "" && len(flip.Examples) < maxReplayExamples && !slices.Contains(flip.Examples, id) {
+			flip.Examples = append(flip.Examples, id)
+		}
+	}
+
+	for _, flip := range flips {
+		report.Flips = append(report.Flips, flip)
+	}
+	slices.SortFunc(report.Flips, func(a, b *ReplayFlips) int {
+		return cmp.Compare(a.Resource, b.Resource)
+	})
+
+	return report, nil
+}
+
+func replayDecision(m *PDP, input StarTMFMap) (allow bool, failed bool) {
+	decision, err := m.TakeAuthnDecision(Authorize, input)
+	if err != nil {
+		return false, true
+	}
+	return decision.Allow, false
+}
+
+func countReplayDecision(allow bool, failed bool, allowCount, denyCount, errorCount *int) {
+	if allow {
+		*allowCount++
+		return
+	}
+	*denyCount++
+	if failed {
+		*errorCount++
+	}
+}
+
+// Print writes the report as a human readable table to w.
+func (r *ReplayReport) Print(w io.Writer) {
+
+	fmt.Fprintf(w, "%d inputs replayed\n", r.Inputs)
+	fmt.Fprintf(w, "%s: %d allow, %d deny (%d errors)\n", r.PolicyFile, r.Allow, r.Deny, r.Errors)
+
+	if r.CompareFile == "" {
+		return
+	}
+	fmt.Fprintf(w, "%s: %d allow, %d deny (%d errors)\n", r.CompareFile, r.CompareAllow, r.CompareDeny, r.CompareErrors)
+
+	if len(r.Flips) == 0 {
+		fmt.Fprintf(w, "no decisions changed\n")
+		return
+	}
+
+	fmt.Fprintf(w, "\n%-28s %12s %12s  %s\n", "RESOURCE", "ALLOW->DENY", "DENY->ALLOW", "EXAMPLES")
+	for _, flip := range r.Flips {
+		resource := flip.Resource
+		if resource == "" {
+			resource = "(unknown)"
+		}
+		fmt.Fprintf(w, "%-28s %12d %12d  %s\n", resource, flip.AllowToDeny, flip.DenyToAllow, strings.Join(flip.Examples, ", "))
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+
+	dir := t.TempDir()
+
+	current := filepath.Join(dir, "current.star")
+	if err := os.WriteFile(current, []byte("def authorize():\n    return input.tmf.lifecycleStatus == \"Launched\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The candidate policy also requires the user to be authenticated for product specifications
+	candidate := filepath.Join(dir, "candidate.star")
+	policy := `
+def authorize():
+    if input.request.resource == "productSpecification" and not input.user.isAuthenticated:
+        return False
+    return input.tmf.lifecycleStatus in ["Launched", "Active"]
+`
+	if err := os.WriteFile(candidate, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewOfflinePDP(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recording := filepath.Join(dir, "inputs.jsonl")
+	recorder, err := NewDecisionRecorder(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetDecisionRecorder(recorder)
+
+	token := StarTMFMap{"vc": map[string]any{"credentialSubject": map[string]any{"mandate": map[string]any{
+		"mandatee": map[string]any{"id": "did:key:mandatee", "email": "jane@example.com", "first_name": "Jane"},
+		"mandator": map[string]any{"organizationIdentifier": "VATES-1", "country": "ES"},
+	}}}, "credential": "eyJhbGciOiJFUzI1NiJ9.eyJzdWIiOiJ4In0.c2ln"}
+
+	inputs := []struct {
+		resource      string
+		id            string
+		status        string
+		authenticated bool
+	}{
+		{"productOffering", "urn:ngsi-ld:product-offering:1", "Launched", false},
+		{"productOffering", "urn:ngsi-ld:product-offering:2", "Active", false},
+		{"productSpecification", "urn:ngsi-ld:product-specification:1", "Launched", false},
+		{"productSpecification", "urn:ngsi-ld:product-specification:2", "Launched", true},
+		{"productSpecification", "urn:ngsi-ld:product-specification:3", "Retired", true},
+	}
+	for _, in := range inputs {
+		request := StarTMFMap{"action": "READ", "resource": in.resource}
+		user := StarTMFMap{"isAuthenticated": in.authenticated}
+		tmfObject := StarTMFMap{"id": in.id, "lifecycleStatus": in.status}
+		takeDecision(context.Background(), m, request, token, tmfObject, user, nil)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(content, []byte("\n")); n != len(inputs) {
+		t.Fatalf("expected %d recorded inputs, got %d", len(inputs), n)
+	}
+	for _, secret := range []string{"jane@example.com", "Jane", "eyJhbGciOiJFUzI1NiJ9"} {
+		if bytes.Contains(content, []byte(secret)) {
+			t.Errorf("the recorded inputs contain %q", secret)
+		}
+	}
+	if !bytes.Contains(content, []byte("did:key:mandatee")) {
+		t.Errorf("the recorded inputs do not contain the claims needed by the policies")
+	}
+
+	report, err := ReplayDecisions(current, candidate, recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Inputs != 5 || report.Allow != 3 || report.Deny != 2 || report.CompareAllow != 3 || report.CompareDeny != 2 {
+		t.Errorf("unexpected counts %+v", report)
+	}
+	if len(report.Flips) != 2 {
+		t.Fatalf("expected flips for 2 resources, got %d", len(report.Flips))
+	}
+
+	offering, specification := report.Flips[0], report.Flips[1]
+	if offering.Resource != "productOffering" || offering.DenyToAllow != 1 || offering.AllowToDeny != 0 ||
+		len(offering.Examples) != 1 || offering.Examples[0] != "urn:ngsi-ld:product-offering:2" {
+		t.Errorf("unexpected flips %+v", offering)
+	}
+	if specification.Resource != "productSpecification" || specification.AllowToDeny != 1 || specification.DenyToAllow != 0 {
+		t.Errorf("unexpected flips %+v", specification)
+	}
+
+	var out strings.Builder
+	report.Print(&out)
+	if !strings.Contains(out.String(), "urn:ngsi-ld:product-specification:1") {
+		t.Errorf("the report does not include the example ids:\n%s", out.String())
+	}
+}
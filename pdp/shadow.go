@@ -0,0 +1,221 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hesusruiz/domeproxy/internal/middleware"
+	"gitlab.com/greyxor/slogor"
+)
+
+// The maximum number of shadow evaluations running at the same time. When reached, new requests
+// are not evaluated with the shadow policy, so it never slows down the real traffic.
+const maxConcurrentShadowEvaluations = 64
+
+// shadowEvaluator runs a candidate policy in parallel with the active one, recording the decisions
+// where both policies disagree. The decisions of the shadow policy never affect the responses.
+type shadowEvaluator struct {
+	// The PDP with the candidate policy
+	pdp *PDP
+
+	// Limits the number of concurrent evaluations
+	slots chan struct{}
+
+	// The evaluations and divergences, stored in the database so they survive restarts
+	store *shadowStore
+
+	// The requests not evaluated are counted only since the process started
+	skipped atomic.Uint64
+}
+
+// ShadowStats summarizes the comparison of the active and shadow policies for a resource and action.
+type ShadowStats struct {
+	Resource    string `json:"resource"`
+	Action      string `json:"action"`
+	Evaluations uint64 `json:"evaluations"`
+
+	// The active policy allowed the request and the shadow one denied it
+	ActiveAllowShadowDeny uint64 `json:"activeAllowShadowDeny"`
+
+	// The active policy denied the request and the shadow one allowed it
+	ActiveDenyShadowAllow uint64 `json:"activeDenyShadowAllow"`
+
+	// The shadow policy failed (and so it denied the request)
+	ShadowErrors uint64 `json:"shadowErrors"`
+}
+
+// Divergences is the total number of decisions where the active and shadow policies disagree.
+func (s ShadowStats) Divergences() uint64 {
+	return s.ActiveAllowShadowDeny + s.ActiveDenyShadowAllow
+}
+
+// newShadowEvaluator creates the evaluator for the shadow policy in fileName, sharing with m the
+// configuration, the file cache and the verification keys. The results are stored in the database
+// of the configuration, with the same retention as the audit log.
+func (m *PDP) newShadowEvaluator(fileName string) (*shadowEvaluator, error) {
+
+	if m.config.Dbname == "" {
+		return nil, fmt.Errorf("a database is required to record the results of the shadow policy %s", fileName)
+	}
+
+	shadow := &PDP{
+		config:            m.config,
+		scriptname:        fileName,
+		verifierKeys:      m.verifierKeys,
+		tokenChecks:       m.tokenChecks,
+		debug:             m.debug,
+		fileCache:         m.fileCache,
+		trustedPolicyKeys: m.trustedPolicyKeys,
+		pipCallBudget:     m.pipCallBudget,
+		policyMaxSteps:    m.policyMaxSteps,
+		policyTimeout:     m.policyTimeout,
+		httpClient:        m.httpClient,
+	}
+	shadow.threadPool = sync.Pool{
+		New: func() any {
+			return shadow.BufferedParseAndCompileFile(shadow.scriptname)
+		},
+	}
+
+	// Compile the policy to detect errors early
+	if _, err := shadow.parseAndCompileFile(fileName); err != nil {
+		return nil, fmt.Errorf("compiling shadow policy %s: %w", fileName, err)
+	}
+
+	store, err := newShadowStore(m.config.Dbname, fileName, m.config.AuditRetention)
+	if err != nil {
+		return nil, fmt.Errorf("opening the store of shadow policy %s: %w", fileName, err)
+	}
+
+	return &shadowEvaluator{
+		pdp:   shadow,
+		slots: make(chan struct{}, maxConcurrentShadowEvaluations),
+		store: store,
+	}, nil
+}
+
+// evaluate takes a decision with the shadow policy asynchronously, comparing it with the decision
+// of the active policy. The input is copied, because the caller may modify it after returning.
+func (s *shadowEvaluator) evaluate(ctx context.Context, input StarTMFMap, active *PolicyDecision) {
+
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.skipped.Add(1)
+		return
+	}
+
+	// The components of the input are the ones modified by the callers (eg, the user for each object in a LIST)
+	snapshot := StarTMFMap{}
+	for k, v := range input {
+		if component, ok := v.(StarTMFMap); ok {
+			v = maps.Clone(component)
+		}
+		snapshot[k] = v
+	}
+
+	// The evaluation must not be cancelled when the request finishes
+	ctx = context.WithoutCancel(ctx)
+
+	go func() {
+		defer func() { <-s.slots }()
+
+		shadowDecision, err := s.pdp.takeAuthnDecision(ctx, Authorize, snapshot, nil)
+		if err != nil {
+			shadowDecision = &PolicyDecision{Allow: false, Reason: "error evaluating the shadow policy"}
+		}
+
+		s.record(ctx, snapshot, active, shadowDecision, err)
+	}()
+}
+
+// record stores the evaluation in the database, with the details of the decision when the policies
+// disagree or the shadow policy failed. The divergences are also logged.
+func (s *shadowEvaluator) record(ctx context.Context, input StarTMFMap, active *PolicyDecision, shadow *PolicyDecision, shadowErr error) {
+
+	request, _ := input["request"].(StarTMFMap)
+	resource, _ := request["resource"].(string)
+	action, _ := request["action"].(string)
+
+	var objectID string
+	if tmf, ok := input["tmf"].(StarTMFMap); ok {
+		objectID, _ = tmf["id"].(string)
+	}
+
+	requestID := middleware.GetRequestIDFromContext(ctx)
+
+	if shadowErr != nil {
+		slog.Warn("PDP: error evaluating the shadow policy", slogor.Err(shadowErr), "resource", resource, "tmfid", objectID)
+	}
+
+	if active.Allow != shadow.Allow {
+		slog.Warn("PDP: SHADOW POLICY DIVERGENCE",
+			slog.String(middleware.RequestIDKey, requestID),
+			"resource", resource,
+			"action", action,
+			"tmfid", objectID,
+			"active", active.Allow,
+			"activeRule", active.RuleID,
+			"shadow", shadow.Allow,
+			"shadowRule", shadow.RuleID,
+			"shadowReason", shadow.Reason,
+		)
+	}
+
+	var divergence *shadowDivergence
+	if active.Allow != shadow.Allow || shadowErr != nil {
+		divergence = &shadowDivergence{
+			RequestID:    requestID,
+			PolicyHash:   shadow.PolicyHash,
+			Resource:     resource,
+			Action:       action,
+			ObjectID:     objectID,
+			Active:       active.Allow,
+			ActiveRule:   active.RuleID,
+			Shadow:       shadow.Allow,
+			ShadowRule:   shadow.RuleID,
+			ShadowReason: shadow.Reason,
+		}
+		if shadowErr != nil {
+			divergence.Error = shadowErr.Error()
+		}
+	}
+
+	if err := s.store.record(resource, action, divergence); err != nil {
+		slog.Error("PDP: storing the result of the shadow policy", slogor.Err(err), "resource", resource, "tmfid", objectID)
+	}
+}
+
+// ShadowStats returns the counters of the comparison between the active and shadow policies,
+// sorted by resource and action, built from the evaluations and divergences stored in the database.
+// It also returns the number of requests which were not evaluated since the process started, because
+// the maximum number of concurrent evaluations was reached.
+// It returns nil if no shadow policy is configured.
+func (m *PDP) ShadowStats() (stats []ShadowStats, skipped uint64, err error) {
+	if m.shadow == nil {
+		return nil, 0, nil
+	}
+
+	stats, err = m.shadow.store.summary()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return stats, m.shadow.skipped.Load(), nil
+}
+
+// ShadowPolicyFileName returns the name of the file with the shadow policy, or an empty string if not configured.
+func (m *PDP) ShadowPolicyFileName() string {
+	if m.shadow == nil {
+		return ""
+	}
+	return m.shadow.pdp.scriptname
+}
@@ -0,0 +1,95 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	conf "github.com/hesusruiz/domeproxy/config"
+)
+
+func TestShadowPolicy(t *testing.T) {
+
+	dir := t.TempDir()
+	activeFile := filepath.Join(dir, "active.star")
+	shadowFile := filepath.Join(dir, "shadow.star")
+
+	// The shadow policy denies the requests from FR, which the active policy allows
+	files := map[string]string{
+		activeFile: "def authorize():\n    return True\n",
+		shadowFile: "def authorize():\n    return struct(allow=input.user.country != \"FR\", rule_id=\"shadow-01\")\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := &conf.Config{
+		PolicyFileName:       activeFile,
+		ShadowPolicyFileName: shadowFile,
+		Dbname:               filepath.Join(dir, "shadow.db"),
+	}
+	noKey := func(config *conf.Config) (*jose.JSONWebKey, error) {
+		return &jose.JSONWebKey{}, nil
+	}
+	m, err := NewPDP(config, nil, noKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := StarTMFMap{"resource": "productOffering", "action": "READ"}
+	tmfObject := StarTMFMap{"id": "urn:ngsi-ld:product-offering:0001"}
+
+	for _, country := range []string{"ES", "FR"} {
+		user := StarTMFMap{"country": country}
+		decision := takeDecision(context.Background(), m, request, StarTMFMap{}, tmfObject, user, nil)
+		if !decision.Allow {
+			t.Fatalf("the shadow policy affected the decision for %s", country)
+		}
+	}
+
+	// The shadow evaluations are asynchronous
+	var stats []ShadowStats
+	for range 100 {
+		stats, _, err = m.ShadowStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats) == 1 && stats[0].Evaluations == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(stats) != 1 {
+		t.Fatalf("expected stats for one resource and action, got %v", stats)
+	}
+	got := stats[0]
+	if got.Resource != "productOffering" || got.Action != "READ" || got.Evaluations != 2 {
+		t.Errorf("unexpected stats %+v", got)
+	}
+	if got.ActiveAllowShadowDeny != 1 || got.ActiveDenyShadowAllow != 0 || got.ShadowErrors != 0 {
+		t.Errorf("unexpected divergences %+v", got)
+	}
+
+	// The results are stored in the database, so they survive a restart
+	m, err = NewPDP(config, nil, noKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, _, err = m.ShadowStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0] != got {
+		t.Errorf("expected the stored stats %+v after a restart, got %v", got, stats)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/hesusruiz/domeproxy/internal/errl"
+	"gitlab.com/greyxor/slogor"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// How often the divergences older than the retention period are deleted
+const shadowPurgeInterval = time.Hour
+
+// shadowevaluation and shadowdivergence Table Schemas
+//
+// The `shadowevaluation` table counts the requests evaluated with each shadow policy, for each resource and action.
+// The `shadowdivergence` table keeps a record of every decision where the active and shadow policies disagree,
+// and of every error evaluating the shadow policy. The summary of the comparison is built from both tables,
+// so it survives restarts.
+//
+// # Columns of shadowevaluation
+//
+// `policy` `TEXT` `NOT NULL`: The name of the file with the shadow policy.
+// `resource` `TEXT` `NOT NULL`: The TMForum resource type of the objects.
+// `action` `TEXT` `NOT NULL`: The action requested (LIST, READ, CREATE, UPDATE or DELETE).
+// `evaluations` `INTEGER` `NOT NULL`: The number of decisions taken with the shadow policy.
+//
+// # Columns of shadowdivergence
+//
+// `created` `INTEGER` `NOT NULL`: The time of the decision, in Unix milliseconds.
+// `reqid` `TEXT`: The identifier of the HTTP request which triggered the decision.
+// `policy` `TEXT` `NOT NULL`: The name of the file with the shadow policy.
+// `policyhash` `TEXT`: The hex encoded SHA256 hash of the shadow policy which took the decision.
+// `resource` `TEXT`: The TMForum resource type of the object.
+// `action` `TEXT`: The action requested.
+// `tmfid` `TEXT`: The id of the TMForum object.
+// `active` `INTEGER` `NOT NULL`: 1 if the active policy allowed the request, 0 otherwise.
+// `activerule` `TEXT`: The identifier of the rule of the active policy which took the decision.
+// `shadow` `INTEGER` `NOT NULL`: 1 if the shadow policy allowed the request, 0 otherwise.
+// `shadowrule` `TEXT`: The identifier of the rule of the shadow policy which took the decision.
+// `shadowreason` `TEXT`: The reason of the decision given by the shadow policy.
+// `error` `TEXT`: The error evaluating the shadow policy, if any.
+const createShadowTablesSQL = `
+CREATE TABLE IF NOT EXISTS shadowevaluation (
+	"policy" TEXT NOT NULL,
+	"resource" TEXT NOT NULL,
+	"action" TEXT NOT NULL,
+	"evaluations" INTEGER NOT NULL,
+
+	PRIMARY KEY ("policy", "resource", "action")
+);
+CREATE TABLE IF NOT EXISTS shadowdivergence (
+	"created" INTEGER NOT NULL,
+	"reqid" TEXT,
+	"policy" TEXT NOT NULL,
+	"policyhash" TEXT,
+	"resource" TEXT,
+	"action" TEXT,
+	"tmfid" TEXT,
+	"active" INTEGER NOT NULL,
+	"activerule" TEXT,
+	"shadow" INTEGER NOT NULL,
+	"shadowrule" TEXT,
+	"shadowreason" TEXT,
+	"error" TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_shadowdivergence_policy ON shadowdivergence (policy, resource, action);
+CREATE INDEX IF NOT EXISTS idx_shadowdivergence_created ON shadowdivergence (created);
+PRAGMA journal_mode = WAL;
+`
+
+const countShadowEvaluationSQL = `INSERT INTO shadowevaluation (policy, resource, action, evaluations) VALUES (:policy, :resource, :action, 1)
+ON CONFLICT (policy, resource, action) DO UPDATE SET evaluations = evaluations + 1;`
+
+const insertShadowDivergenceSQL = `INSERT INTO shadowdivergence (created, reqid, policy, policyhash, resource, action, tmfid, active, activerule, shadow, shadowrule, shadowreason, error) VALUES (:created, :reqid, :policy, :policyhash, :resource, :action, :tmfid, :active, :activerule, :shadow, :shadowrule, :shadowreason, NULLIF(:error, ''));`
+
+// The summary includes the divergences of the resources and actions without evaluations, which were purged
+const selectShadowSummarySQL = `
+SELECT resource, action, SUM(evaluations) AS evaluations, SUM(allowdeny) AS allowdeny, SUM(denyallow) AS denyallow, SUM(errors) AS errors FROM (
+	SELECT resource, action, evaluations, 0 AS allowdeny, 0 AS denyallow, 0 AS errors FROM shadowevaluation WHERE policy = :policy
+	UNION ALL
+	SELECT resource, action, 0, SUM(active = 1 AND shadow = 0), SUM(active = 0 AND shadow = 1), COUNT(error) FROM shadowdivergence WHERE policy = :policy GROUP BY resource, action
+) GROUP BY resource, action ORDER BY resource, action;`
+
+// shadowDivergence is a decision where the active and shadow policies disagree, or the shadow policy failed.
+type shadowDivergence struct {
+	RequestID    string
+	PolicyHash   string
+	Resource     string
+	Action       string
+	ObjectID     string
+	Active       bool
+	ActiveRule   string
+	Shadow       bool
+	ShadowRule   string
+	ShadowReason string
+	Error        string
+}
+
+// shadowStore keeps in SQLite the results of the comparison between the active policy and a shadow policy.
+type shadowStore struct {
+	dbpool    *sqlitex.Pool
+	policy    string
+	retention time.Duration
+
+	// The time of the last purge of old divergences, in Unix milliseconds
+	lastPurge atomic.Int64
+}
+
+// newShadowStore opens the store for the shadow policy in the database file, creating the tables if needed.
+// Divergences older than retention are deleted periodically, unless retention is zero.
+func newShadowStore(dbname string, policy string, retention time.Duration) (*shadowStore, error) {
+
+	dbpool, err := sqlitex.NewPool(dbname, sqlitex.PoolOptions{
+		PoolSize: 4,
+	})
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+
+	conn, err := dbpool.Take(context.Background())
+	if err != nil {
+		dbpool.Close()
+		return nil, errl.Error(err)
+	}
+	defer dbpool.Put(conn)
+
+	if err := sqlitex.ExecuteScript(conn, createShadowTablesSQL, nil); err != nil {
+		dbpool.Close()
+		return nil, errl.Errorf("creating shadow policy tables: %w", err)
+	}
+
+	return &shadowStore{dbpool: dbpool, policy: policy, retention: retention}, nil
+}
+
+// record counts an evaluation of the shadow policy and, if not nil, stores the divergence.
+func (s *shadowStore) record(resource string, action string, divergence *shadowDivergence) (err error) {
+
+	conn, err := s.dbpool.Take(context.Background())
+	if err != nil {
+		return errl.Error(err)
+	}
+	defer s.dbpool.Put(conn)
+
+	s.purge(conn)
+
+	release := sqlitex.Save(conn)
+	defer release(&err)
+
+	err = sqlitex.Execute(conn, countShadowEvaluationSQL, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":policy":   s.policy,
+			":resource": resource,
+			":action":   action,
+		},
+	})
+	if err != nil {
+		return errl.Error(err)
+	}
+
+	if divergence == nil {
+		return nil
+	}
+
+	d := divergence
+	err = sqlitex.Execute(conn, insertShadowDivergenceSQL, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":created":      time.Now().UnixMilli(),
+			":reqid":        d.RequestID,
+			":policy":       s.policy,
+			":policyhash":   d.PolicyHash,
+			":resource":     d.Resource,
+			":action":       d.Action,
+			":tmfid":        d.ObjectID,
+			":active":       d.Active,
+			":activerule":   d.ActiveRule,
+			":shadow":       d.Shadow,
+			":shadowrule":   d.ShadowRule,
+			":shadowreason": d.ShadowReason,
+			":error":        d.Error,
+		},
+	})
+	if err != nil {
+		return errl.Error(err)
+	}
+
+	return nil
+}
+
+// summary returns the counters of the comparison for each resource and action, sorted by resource and action.
+func (s *shadowStore) summary() ([]ShadowStats, error) {
+
+	conn, err := s.dbpool.Take(context.Background())
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+	defer s.dbpool.Put(conn)
+
+	var stats []ShadowStats
+	err = sqlitex.Execute(conn, selectShadowSummarySQL, &sqlitex.ExecOptions{
+		Named: map[string]any{":policy": s.policy},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			stats = append(stats, ShadowStats{
+				Resource:              stmt.GetText("resource"),
+				Action:                stmt.GetText("action"),
+				Evaluations:           uint64(stmt.GetInt64("evaluations")),
+				ActiveAllowShadowDeny: uint64(stmt.GetInt64("allowdeny")),
+				ActiveDenyShadowAllow: uint64(stmt.GetInt64("denyallow")),
+				ShadowErrors:          uint64(stmt.GetInt64("errors")),
+			})
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, errl.Error(err)
+	}
+
+	return stats, nil
+}
+
+// purge deletes the divergences older than the retention period, at most once per purge interval.
+func (s *shadowStore) purge(conn *sqlite.Conn) {
+	if s.retention <= 0 {
+		return
+	}
+
+	now := time.Now()
+	last := s.lastPurge.Load()
+	if now.Sub(time.UnixMilli(last)) < shadowPurgeInterval || !s.lastPurge.CompareAndSwap(last, now.UnixMilli()) {
+		return
+	}
+
+	limit := now.Add(-s.retention).UnixMilli()
+	err := sqlitex.Execute(conn, `DELETE FROM shadowdivergence WHERE created < ?;`, &sqlitex.ExecOptions{
+		Args: []any{limit},
+	})
+	if err != nil {
+		slog.Error("PDP: purging the shadow policy divergences", slogor.Err(err))
+		return
+	}
+
+	if n := conn.Changes(); n > 0 {
+		slog.Info("PDP: old shadow policy divergences deleted", "records", n, "retention", s.retention)
+	}
+}
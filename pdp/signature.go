@@ -0,0 +1,251 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/go-jose/go-jose/v4"
+	conf "github.com/hesusruiz/domeproxy/config"
+)
+
+// The signature of a policy file (or a module loaded by it) is a detached JWS over the content
+// of the file, stored in a companion file with the same name plus this suffix.
+const signatureFileSuffix = ".sig"
+
+// The algorithms accepted for signing policies
+var policySignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.ES256, jose.ES384, jose.EdDSA, jose.RS256, jose.PS256,
+}
+
+var ErrInvalidPolicySignature = errors.New("invalid policy signature")
+
+// LoadTrustedPolicyKeys reads the JWKS file with the public keys trusted to sign the policies.
+func LoadTrustedPolicyKeys(fileName string) (*jose.JSONWebKeySet, error) {
+
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("reading trusted policy keys: %w", err)
+	}
+
+	keySet := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(content, keySet); err != nil {
+		return nil, fmt.Errorf("parsing trusted policy keys %s: %w", fileName, err)
+	}
+	if len(keySet.Keys) == 0 {
+		return nil, fmt.Errorf("no keys in trusted policy keys file %s", fileName)
+	}
+
+	for _, k := range keySet.Keys {
+		if !k.IsPublic() {
+			return nil, fmt.Errorf("trusted policy key %q is not a public key", k.KeyID)
+		}
+	}
+
+	return keySet, nil
+}
+
+// VerifyPolicySignature checks that the detached JWS in signature was created over content by
+// any of the trusted keys. If the JWS has a 'kid' header, only the keys with that identifier are tried.
+func VerifyPolicySignature(content []byte, signature []byte, trustedKeys *jose.JSONWebKeySet) error {
+
+	jws, err := jose.ParseDetached(string(signature), content, policySignatureAlgorithms)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPolicySignature, err)
+	}
+	if len(jws.Signatures) != 1 {
+		return fmt.Errorf("%w: expected one signature, got %d", ErrInvalidPolicySignature, len(jws.Signatures))
+	}
+
+	keys := trustedKeys.Keys
+	if kid := jws.Signatures[0].Header.KeyID; kid != "" {
+		keys = trustedKeys.Key(kid)
+	}
+
+	for _, k := range keys {
+		if err := jws.DetachedVerify(content, k.Key); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: not signed by any trusted key", ErrInvalidPolicySignature)
+}
+
+// getVerifiedFile returns the file from the cache, after checking its signature if the PDP is configured
+// with trusted keys for the policies.
+// If the current version of the file does not have a valid signature, the last version that was verified
+// is returned, so the PDP keeps working with the last good policy.
+func (m *PDP) getVerifiedFile(fileName string) (*conf.FileEntry, error) {
+
+	entry, err := m.fileCache.Get(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Signatures are not required
+	if m.trustedPolicyKeys == nil {
+		return entry, nil
+	}
+
+	var lastGood *conf.FileEntry
+	if lg, ok := m.verifiedFiles.Load(fileName); ok {
+		lastGood = lg.(*conf.FileEntry)
+		if lastGood.FileHash == entry.FileHash {
+			return lastGood, nil
+		}
+	}
+
+	// The signature is read with the cache, from the same place as the file
+	var sigContent []byte
+	var sigHash uint64
+	sigEntry, sigErr := m.fileCache.Get(fileName + signatureFileSuffix)
+	if sigErr == nil {
+		sigContent = sigEntry.Content
+		sigHash = sigEntry.FileHash
+	}
+
+	// Do not verify and report again a version that was already rejected, unless the signature changed
+	current := rejectedVersion{fileHash: entry.FileHash, sigHash: sigHash}
+	if rejected, ok := m.rejectedFiles.Load(fileName); !ok || rejected.(rejectedVersion) != current {
+
+		if sigErr != nil {
+			err = fmt.Errorf("%w: reading signature: %w", ErrInvalidPolicySignature, sigErr)
+		} else {
+			err = VerifyPolicySignature(entry.Content, sigContent, m.trustedPolicyKeys)
+		}
+		if err == nil {
+			m.verifiedFiles.Store(fileName, entry)
+			m.rejectedFiles.Delete(fileName)
+			return entry, nil
+		}
+
+		m.rejectedFiles.Store(fileName, current)
+		slog.Error("POLICY SIGNATURE VERIFICATION FAILED: the new version of the file is ignored",
+			"file", fileName, "keepingLastGood", lastGood != nil, "error", err)
+	}
+
+	if lastGood == nil {
+		return nil, fmt.Errorf("%s: %w", fileName, ErrInvalidPolicySignature)
+	}
+
+	return lastGood, nil
+}
+
+// rejectedVersion identifies a version of a file and its signature that failed verification.
+type rejectedVersion struct {
+	fileHash uint64
+	sigHash  uint64
+}
+
+// SignPolicyFile creates a detached JWS over the contents of the policy file with the private key
+// in keyFile, and writes it to the companion signature file, whose name is returned.
+// The private key can be a JWK in JSON format or a PEM file.
+func SignPolicyFile(policyFileName string, keyFileName string, kid string) (string, error) {
+
+	content, err := os.ReadFile(policyFileName)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := loadSigningKey(keyFileName)
+	if err != nil {
+		return "", err
+	}
+	if kid != "" {
+		key.KeyID = kid
+	}
+
+	alg, err := signatureAlgorithmForKey(key.Key)
+	if err != nil {
+		return "", err
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, nil)
+	if err != nil {
+		return "", fmt.Errorf("creating signer: %w", err)
+	}
+
+	jws, err := signer.Sign(content)
+	if err != nil {
+		return "", fmt.Errorf("signing %s: %w", policyFileName, err)
+	}
+
+	signature, err := jws.DetachedCompactSerialize()
+	if err != nil {
+		return "", err
+	}
+
+	sigFileName := policyFileName + signatureFileSuffix
+	if err := os.WriteFile(sigFileName, []byte(signature), 0o644); err != nil {
+		return "", err
+	}
+
+	return sigFileName, nil
+}
+
+// loadSigningKey reads a private key, either as a JWK in JSON format or as a PEM file.
+func loadSigningKey(fileName string) (*jose.JSONWebKey, error) {
+
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &jose.JSONWebKey{}
+	if err := json.Unmarshal(content, key); err == nil {
+		if key.IsPublic() {
+			return nil, fmt.Errorf("%s does not contain a private key", fileName)
+		}
+		return key, nil
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a JWK or a PEM file", fileName)
+	}
+
+	var privateKey crypto.PrivateKey
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key in %s: %w", fileName, err)
+	}
+
+	return &jose.JSONWebKey{Key: privateKey}, nil
+}
+
+func signatureAlgorithmForKey(key any) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		}
+	case ed25519.PrivateKey:
+		return jose.EdDSA, nil
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	}
+	return "", fmt.Errorf("unsupported key type for signing policies: %T", key)
+}
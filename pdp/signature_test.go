@@ -0,0 +1,227 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	conf "github.com/hesusruiz/domeproxy/config"
+)
+
+// createSigningKeys writes a private key in PEM format and a JWKS with the public key, returning their names.
+func createSigningKeys(t *testing.T, dir string) (keyFile string, jwksFile string) {
+	t.Helper()
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile = filepath.Join(dir, "policy-key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &privateKey.PublicKey, KeyID: "policy-signer"}}}
+	content, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile = filepath.Join(dir, "trusted.jwks")
+	if err := os.WriteFile(jwksFile, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return keyFile, jwksFile
+}
+
+func TestSignedPolicy(t *testing.T) {
+
+	dir := t.TempDir()
+	keyFile, jwksFile := createSigningKeys(t, dir)
+
+	policyFile := filepath.Join(dir, "policy.star")
+	if err := os.WriteFile(policyFile, []byte("def authorize():\n    return True\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := SignPolicyFile(policyFile, keyFile, "policy-signer"); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &conf.Config{
+		PolicyFileName:        policyFile,
+		PolicyTrustedKeysFile: jwksFile,
+	}
+	noKey := func(config *conf.Config) (*jose.JSONWebKey, error) {
+		return &jose.JSONWebKey{}, nil
+	}
+
+	m, err := NewPDP(config, nil, noKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decide := func() bool {
+		t.Helper()
+		decision, err := m.TakeAuthnDecision(Authorize, StarTMFMap{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decision.Allow
+	}
+
+	if !decide() {
+		t.Fatal("the signed policy should allow the request")
+	}
+
+	// A new version of the policy without a valid signature must be ignored
+	if err := m.PutFile(policyFile, []byte("def authorize():\n    return False\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !decide() {
+		t.Fatal("the last good policy should have been kept")
+	}
+}
+
+func TestUploadSignedPolicy(t *testing.T) {
+
+	dir := t.TempDir()
+	keyFile, jwksFile := createSigningKeys(t, dir)
+
+	// sign returns the signature of the content, created like for a file in the disk
+	sign := func(content string) []byte {
+		t.Helper()
+		unsignedFile := filepath.Join(t.TempDir(), "unsigned.star")
+		if err := os.WriteFile(unsignedFile, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sigFile, err := SignPolicyFile(unsignedFile, keyFile, "policy-signer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := os.ReadFile(sigFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+
+	const allowPolicy = "def authorize():\n    return True\n"
+	const denyPolicy = "def authorize():\n    return False\n"
+
+	policyFile := filepath.Join(dir, "policy.star")
+	if err := os.WriteFile(policyFile, []byte(allowPolicy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(policyFile+signatureFileSuffix, sign(allowPolicy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewPolicyStore(filepath.Join(dir, "policies.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	noKey := func(config *conf.Config) (*jose.JSONWebKey, error) {
+		return &jose.JSONWebKey{}, nil
+	}
+	m, err := NewPDP(&conf.Config{PolicyFileName: policyFile, PolicyTrustedKeysFile: jwksFile}, nil, noKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetPolicyStore(store); err != nil {
+		t.Fatal(err)
+	}
+
+	decide := func() bool {
+		t.Helper()
+		decision, err := m.TakeAuthnDecision(Authorize, StarTMFMap{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decision.Allow
+	}
+
+	// Versions without a valid signature are rejected, and not recorded as the active version
+	for _, signature := range [][]byte{nil, sign(allowPolicy)} {
+		if _, err := m.UploadPolicy(policyFile, []byte(denyPolicy), signature, "tester"); !errors.Is(err, ErrInvalidPolicySignature) {
+			t.Fatalf("expected an invalid signature error, got %v", err)
+		}
+	}
+	if versions, err := m.PolicyVersions(policyFile); err != nil || len(versions) != 0 {
+		t.Fatalf("expected no versions, got %v %v", versions, err)
+	}
+
+	// A signed version is used by the PDP
+	if _, err := m.UploadPolicy(policyFile, []byte(denyPolicy), sign(denyPolicy), "tester"); err != nil {
+		t.Fatal(err)
+	}
+	if decide() {
+		t.Fatal("the signed version uploaded should deny the request")
+	}
+	if _, err := m.UploadPolicy(policyFile, []byte(allowPolicy), sign(allowPolicy), "tester"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rollback uses the signature stored with the version
+	if _, err := m.RollbackPolicy(policyFile, 1, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	if decide() {
+		t.Fatal("the version rolled back should deny the request")
+	}
+}
+
+func TestVerifyPolicySignature(t *testing.T) {
+
+	dir := t.TempDir()
+	keyFile, jwksFile := createSigningKeys(t, dir)
+
+	policyFile := filepath.Join(dir, "policy.star")
+	content := []byte("def authorize():\n    return True\n")
+	if err := os.WriteFile(policyFile, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sigFile, err := SignPolicyFile(policyFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := os.ReadFile(sigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := LoadTrustedPolicyKeys(jwksFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := VerifyPolicySignature(content, signature, keys); err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+
+	tampered := append([]byte("# tampered\n"), content...)
+	err = VerifyPolicySignature(tampered, signature, keys)
+	if !errors.Is(err, ErrInvalidPolicySignature) {
+		t.Fatalf("expected ErrInvalidPolicySignature for a tampered policy, got %v", err)
+	}
+}
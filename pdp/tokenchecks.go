@@ -0,0 +1,126 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	conf "github.com/hesusruiz/domeproxy/config"
+)
+
+// DefaultTokenAlgorithms are the signing algorithms accepted for the Access Tokens, if not configured.
+var DefaultTokenAlgorithms = []string{"ES256"}
+
+// The errors of the checks of the Access Tokens, besides the signature. Tokens which are expired or
+// not yet valid fail with jwt.ErrTokenExpired and jwt.ErrTokenNotValidYet.
+var (
+	ErrTokenUntrustedIssuer = fmt.Errorf("access token issuer not trusted")
+	ErrTokenAudience        = fmt.Errorf("access token audience not accepted")
+	ErrTokenAlgorithm       = fmt.Errorf("access token signing algorithm not allowed")
+)
+
+// tokenChecks are the checks of the Access Tokens for the environment, and the key sets of the trusted
+// Verifiers other than the one of the environment, which are retrieved the first time they are needed.
+type tokenChecks struct {
+	issuers    []string
+	audiences  []string
+	algorithms []string
+	clockSkew  time.Duration
+
+	// Creates the key set for an issuer, or nil if all the issuers use the key set of the environment
+	newKeySet  func(issuer string) *verifierKeySet
+	issuerKeys sync.Map
+}
+
+// newTokenChecks builds the checks from the configuration. The Verifier of the environment is the trusted issuer
+// if none is configured, and the issuer is not checked if there is no Verifier either (like in some tests).
+// The audience is not checked if no audience is configured.
+func newTokenChecks(config *conf.Config, keysFromVerifiers bool) *tokenChecks {
+
+	c := &tokenChecks{
+		issuers:    config.TokenIssuers,
+		audiences:  config.TokenAudiences,
+		algorithms: config.TokenAlgorithms,
+		clockSkew:  config.TokenClockSkew,
+	}
+	if len(c.issuers) == 0 && config.VerifierServer != "" {
+		c.issuers = []string{config.VerifierServer}
+	}
+	if len(c.algorithms) == 0 {
+		c.algorithms = DefaultTokenAlgorithms
+	}
+	if c.clockSkew < 0 {
+		c.clockSkew = 0
+	}
+
+	if keysFromVerifiers {
+		client := &http.Client{Timeout: 10 * time.Second}
+		c.newKeySet = func(issuer string) *verifierKeySet {
+			fetch := verifierJWKSFetcher(&conf.Config{VerifierServer: issuer}, client)
+			return newVerifierKeySet(fetch, config.JWKSRefreshInterval, config.JWKSMinRefreshInterval)
+		}
+	}
+
+	return c
+}
+
+// checkAlgorithm returns an error if the signing algorithm of the token is not allowed.
+func (c *tokenChecks) checkAlgorithm(alg string) error {
+	if !slices.Contains(c.algorithms, alg) {
+		return fmt.Errorf("%w: '%s'", ErrTokenAlgorithm, alg)
+	}
+	return nil
+}
+
+// checkIssuer returns an error if the issuer of the token is not one of the trusted Verifiers.
+func (c *tokenChecks) checkIssuer(issuer string) error {
+	if len(c.issuers) == 0 {
+		return nil
+	}
+	if issuer == "" || !slices.ContainsFunc(c.issuers, func(trusted string) bool { return sameURL(trusted, issuer) }) {
+		return fmt.Errorf("%w: '%s'", ErrTokenUntrustedIssuer, issuer)
+	}
+	return nil
+}
+
+// checkAudience returns an error if none of the audiences of the token is an expected audience.
+func (c *tokenChecks) checkAudience(audiences []string) error {
+	if len(c.audiences) == 0 {
+		return nil
+	}
+	for _, aud := range audiences {
+		if slices.Contains(c.audiences, aud) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrTokenAudience, audiences)
+}
+
+// keySet returns the key set to verify the tokens of an issuer, which is the key set of the environment
+// unless the issuer is another trusted Verifier. Keys are never retrieved from issuers which are not trusted.
+func (c *tokenChecks) keySet(issuer string, config *conf.Config, environment *verifierKeySet) *verifierKeySet {
+	if c.newKeySet == nil || issuer == "" || sameURL(issuer, config.VerifierServer) {
+		return environment
+	}
+	if !slices.ContainsFunc(c.issuers, func(trusted string) bool { return sameURL(trusted, issuer) }) {
+		return environment
+	}
+	issuer = strings.TrimSuffix(issuer, "/")
+	if ks, found := c.issuerKeys.Load(issuer); found {
+		return ks.(*verifierKeySet)
+	}
+	ks, _ := c.issuerKeys.LoadOrStore(issuer, c.newKeySet(issuer))
+	return ks.(*verifierKeySet)
+}
+
+// sameURL compares two URLs, ignoring a trailing slash.
+func sameURL(a string, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
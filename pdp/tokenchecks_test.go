@@ -0,0 +1,146 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pdp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/golang-jwt/jwt/v5"
+	conf "github.com/hesusruiz/domeproxy/config"
+)
+
+func TestTokenChecks(t *testing.T) {
+
+	const issuer = "https://verifier.example.org"
+	const audience = "did:key:pdp"
+
+	policyFile := filepath.Join(t.TempDir(), "policy.star")
+	if err := os.WriteFile(policyFile, []byte("def authorize():\n    return True\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	generateKey := func(curve elliptic.Curve) *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	verifierKey := generateKey(elliptic.P256())
+	otherKey := generateKey(elliptic.P256())
+
+	m, err := NewPDP(&conf.Config{
+		PolicyFileName:  policyFile,
+		VerifierServer:  "https://verifier.other.org",
+		TokenIssuers:    []string{issuer, "https://verifier.other.org"},
+		TokenAudiences:  []string{audience},
+		TokenAlgorithms: []string{"ES256"},
+		TokenClockSkew:  time.Minute,
+	}, nil, func(config *conf.Config) (*jose.JSONWebKey, error) {
+		return &jose.JSONWebKey{Key: &verifierKey.PublicKey, Algorithm: "ES256"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	validClaims := func(changes map[string]any) jwt.MapClaims {
+		claims := jwt.MapClaims{"iss": issuer, "aud": audience, "exp": now.Add(time.Hour).Unix(), "iat": now.Unix()}
+		for k, v := range changes {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+	sign := func(method jwt.SigningMethod, key any, claims jwt.MapClaims) string {
+		tokString, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokString
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", sign(jwt.SigningMethodES256, verifierKey, validClaims(nil)), nil},
+		{"issuer with trailing slash", sign(jwt.SigningMethodES256, verifierKey, validClaims(map[string]any{"iss": issuer + "/"})), nil},
+		{"several audiences", sign(jwt.SigningMethodES256, verifierKey, validClaims(map[string]any{"aud": []string{"other", audience}})), nil},
+		{"expired within the clock skew", sign(jwt.SigningMethodES256, verifierKey, validClaims(map[string]any{"exp": now.Add(-30 * time.Second).Unix()})), nil},
+
+		{"untrusted issuer", sign(jwt.SigningMethodES256, verifierKey, validClaims(map[string]any{"iss": "https://evil.example.org"})), ErrTokenUntrustedIssuer},
+		{"missing issuer", sign(jwt.SigningMethodES256, verifierKey, validClaims(map[string]any{"iss": nil})), ErrTokenUntrustedIssuer},
+		{"wrong audience", sign(jwt.SigningMethodES256, verifierKey, validClaims(map[string]any{"aud": "did:key:other"})), ErrTokenAudience},
+		{"missing audience", sign(jwt.SigningMethodES256, verifierKey, validClaims(map[string]any{"aud": nil})), ErrTokenAudience},
+		{"algorithm not allowed", sign(jwt.SigningMethodES384, generateKey(elliptic.P384()), validClaims(nil)), ErrTokenAlgorithm},
+		{"symmetric algorithm", sign(jwt.SigningMethodHS256, []byte("secret"), validClaims(nil)), ErrTokenAlgorithm},
+		{"expired", sign(jwt.SigningMethodES256, verifierKey, validClaims(map[string]any{"exp": now.Add(-2 * time.Minute).Unix()})), jwt.ErrTokenExpired},
+		{"not yet valid", sign(jwt.SigningMethodES256, verifierKey, validClaims(map[string]any{"nbf": now.Add(2 * time.Minute).Unix()})), jwt.ErrTokenNotValidYet},
+		{"wrong signature", sign(jwt.SigningMethodES256, otherKey, validClaims(nil)), jwt.ErrTokenSignatureInvalid},
+	}
+
+	for _, tt := range tests {
+		_, found, err := m.getClaimsFromToken(tt.token)
+		if tt.want == nil {
+			if err != nil || !found {
+				t.Errorf("%s: expected a valid token, got %v", tt.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected error '%v', got '%v'", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestTokenChecksSeveralVerifiers(t *testing.T) {
+
+	environment := newFakeVerifier(t, "k1")
+	other := newFakeVerifier(t, "k2")
+	untrusted := newFakeVerifier(t, "k3")
+
+	policyFile := filepath.Join(t.TempDir(), "policy.star")
+	if err := os.WriteFile(policyFile, []byte("def authorize():\n    return True\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewPDP(&conf.Config{
+		PolicyFileName: policyFile,
+		VerifierServer: environment.URL,
+		TokenIssuers:   []string{environment.URL, other.URL},
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each trusted Verifier signs with its own keys
+	if _, _, err := m.getClaimsFromToken(environment.token(t, "k1", environment.key("k1"))); err != nil {
+		t.Errorf("token of the Verifier of the environment: %v", err)
+	}
+	if _, _, err := m.getClaimsFromToken(other.token(t, "k2", other.key("k2"))); err != nil {
+		t.Errorf("token of another trusted Verifier: %v", err)
+	}
+
+	// The keys of an untrusted issuer are never retrieved
+	_, _, err = m.getClaimsFromToken(untrusted.token(t, "k3", untrusted.key("k3")))
+	if !errors.Is(err, ErrTokenUntrustedIssuer) {
+		t.Errorf("expected an untrusted issuer error, got %v", err)
+	}
+	if requests, _ := untrusted.counters(); requests != 0 {
+		t.Errorf("the keys of the untrusted issuer were retrieved")
+	}
+}
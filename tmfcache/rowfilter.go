@@ -0,0 +1,153 @@
+// Copyright 2023 Jesus Ruiz. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package tmfcache
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	sqlb "github.com/huandu/go-sqlbuilder"
+)
+
+// The operators of a RowFilter
+const (
+	FilterEqual       = "=="
+	FilterNotEqual    = "!="
+	FilterIn          = "in"
+	FilterNotIn       = "not in"
+	FilterContains    = "contains"
+	FilterNotContains = "not contains"
+)
+
+// RowFilter is an additional condition for the objects retrieved from the database in a list,
+// which the PDP derives from the row-level constraints declared in the policies.
+//
+// The field can be one of the columns of the table (like 'lifecycleStatus' or 'seller'), one of the
+// restriction lists derived from the terms of use of the object ('permittedCountries', 'prohibitedCountries',
+// 'permittedOperators' and 'prohibitedOperators'), or a dotted path into the JSON content of the object.
+// The restriction lists accept only the 'contains' and 'not contains' operators, with one or more values
+// which are alternatives (like a country and the groups of countries which include it), and the rest of
+// fields only the comparison and 'in' operators. Country codes in the restriction lists are compared
+// without regards to case, so the values must be in upper case.
+type RowFilter struct {
+	Field  string
+	Op     string
+	Values []string
+}
+
+func (f RowFilter) String() string {
+	return fmt.Sprintf("%s %s %v", f.Field, f.Op, f.Values)
+}
+
+// The fields of the table which can be used directly in a filter
+var rowFilterColumns = map[string]bool{
+	"id":                     true,
+	"organizationIdentifier": true,
+	"organization":           true,
+	"seller":                 true,
+	"buyer":                  true,
+	"sellerOperator":         true,
+	"buyerOperator":          true,
+	"name":                   true,
+	"description":            true,
+	"lifecycleStatus":        true,
+	"lastUpdate":             true,
+}
+
+// The restriction lists, with the name of the list inside the 'OperatorRestriction' terms of the object.
+// They are built in the same way as the PDP does for the 'tmf' object passed to the policies.
+var rowFilterRestrictions = map[string]string{
+	"permittedCountries":  "permittedLegalRegion",
+	"prohibitedCountries": "prohibitedLegalRegion",
+	"permittedOperators":  "permittedOperator",
+	"prohibitedOperators": "prohibitedOperator",
+}
+
+// The paths into the JSON content are embedded in the SQL statement, so only simple names are accepted
+var rowFilterPath = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// Validate checks that the filter can be translated into SQL.
+func (f RowFilter) Validate() error {
+
+	if _, restriction := rowFilterRestrictions[f.Field]; restriction {
+		if f.Op != FilterContains && f.Op != FilterNotContains {
+			return fmt.Errorf("filter on '%s': operator '%s' not supported, use '%s' or '%s'", f.Field, f.Op, FilterContains, FilterNotContains)
+		}
+		if len(f.Values) == 0 {
+			return fmt.Errorf("filter on '%s': expected at least one value", f.Field)
+		}
+		return nil
+	}
+
+	if !rowFilterColumns[f.Field] && !rowFilterPath.MatchString(f.Field) {
+		return fmt.Errorf("filter on '%s': invalid field name", f.Field)
+	}
+
+	switch f.Op {
+	case FilterEqual, FilterNotEqual:
+		if len(f.Values) != 1 {
+			return fmt.Errorf("filter on '%s': expected one value, got %d", f.Field, len(f.Values))
+		}
+	case FilterIn, FilterNotIn:
+	default:
+		return fmt.Errorf("filter on '%s': operator '%s' not supported", f.Field, f.Op)
+	}
+
+	return nil
+}
+
+// sqlExpr returns the SQL expression for the filter, with the values added to the arguments of cond.
+// The semantics are the same as in the policies, so a missing field is different from any value.
+func (f RowFilter) sqlExpr(cond *sqlb.Cond) (string, error) {
+	if err := f.Validate(); err != nil {
+		return "", err
+	}
+
+	if concept, restriction := rowFilterRestrictions[f.Field]; restriction {
+		element := "region.value->>'$.country'"
+		if strings.HasSuffix(concept, "LegalRegion") {
+			element = "upper(" + element + ")"
+		}
+		exists := "EXISTS (SELECT 1 FROM json_each(content, '$.productOfferingTerm') AS term, " +
+			"json_each(term.value, '$." + concept + "') AS region " +
+			"WHERE term.value->>'$.\"@type\"' = 'OperatorRestriction' " +
+			"AND " + element + " IN (" + f.sqlList(cond) + "))"
+		if f.Op == FilterNotContains {
+			return "NOT " + exists, nil
+		}
+		return exists, nil
+	}
+
+	field := f.Field
+	if !rowFilterColumns[field] {
+		field = "content->>'$." + field + "'"
+	}
+
+	switch f.Op {
+	case FilterEqual:
+		return field + " = " + cond.Var(f.Values[0]), nil
+	case FilterNotEqual:
+		return field + " IS NOT " + cond.Var(f.Values[0]), nil
+	case FilterIn:
+		if len(f.Values) == 0 {
+			return "0", nil
+		}
+		return field + " IN (" + f.sqlList(cond) + ")", nil
+	default: // FilterNotIn
+		if len(f.Values) == 0 {
+			return "1", nil
+		}
+		return "(" + field + " IS NULL OR " + field + " NOT IN (" + f.sqlList(cond) + "))", nil
+	}
+}
+
+func (f RowFilter) sqlList(cond *sqlb.Cond) string {
+	vars := make([]string, len(f.Values))
+	for i, v := range f.Values {
+		vars[i] = cond.Var(v)
+	}
+	return strings.Join(vars, ", ")
+}
@@ -279,12 +279,19 @@ const (
 )
 
 func LocalRetrieveListTMFObject(dbconn *sqlite.Conn, resourceType string, queryValues url.Values, perObject func(tmfObject TMFObject) LoopControl) error {
+	return LocalRetrieveFilteredListTMFObject(dbconn, resourceType, queryValues, nil, perObject)
+}
+
+// LocalRetrieveFilteredListTMFObject is like LocalRetrieveListTMFObject, but only retrieves the objects
+// which also satisfy the filters.
+func LocalRetrieveFilteredListTMFObject(dbconn *sqlite.Conn, resourceType string, queryValues url.Values, filters []RowFilter, perObject func(tmfObject TMFObject) LoopControl) error {
 	if dbconn == nil {
 		return errl.Errorf("dbconn is nil")
 	}
 
-	// Build the SQL SELECT based on the query passed on the HTTP request, as specified in TMForum
-	sql, args := BuildSelectFromParms(resourceType, queryValues)
+	// Build the SQL SELECT based on the query passed on the HTTP request, as specified in TMForum,
+	// and the filters set by the caller
+	sql, args := BuildSelectFromParms(resourceType, queryValues, filters...)
 
 	err := sqlitex.Execute(dbconn, sql, &sqlitex.ExecOptions{
 		Args: args,
@@ -664,7 +671,9 @@ func BuildSelectFromParmsClassic(tmfResource string, queryValues url.Values) (st
 
 // BuildSelectFromParms creates a SELECT statement based on the query values.
 // For objects with same id, selects the one with the latest version.
-func BuildSelectFromParms(tmfResource string, queryValues url.Values) (string, []any) {
+// The filters, if any, are added to the conditions specified in the query values.
+// Filters which can not be translated into SQL are ignored.
+func BuildSelectFromParms(tmfResource string, queryValues url.Values, filters ...RowFilter) (string, []any) {
 
 	// Default values if the user did not specify them. -1 is equivalent to no values provided.
 	var limit = -1
@@ -799,6 +808,24 @@ func BuildSelectFromParms(tmfResource string, queryValues url.Values) (string, [
 		}
 	}
 
+	// Add the filters derived from the policies. They must be applied to the latest version of each object,
+	// because the WHERE is evaluated before the GROUP BY, and otherwise an older version satisfying the filters
+	// would be returned when the latest one does not.
+	if len(filters) > 0 {
+		whereClause.AddWhereExpr(
+			cond.Args,
+			"version = (SELECT max(latest.version) FROM tmfobject AS latest WHERE latest.id = tmfobject.id AND latest.resource = tmfobject.resource)",
+		)
+	}
+	for _, filter := range filters {
+		expr, err := filter.sqlExpr(cond)
+		if err != nil {
+			slog.Warn("ignoring row filter", slogor.Err(err))
+			continue
+		}
+		whereClause.AddWhereExpr(cond.Args, expr)
+	}
+
 	// Add the WHERE to the SELECT
 	bu.AddWhereClause(whereClause)
 
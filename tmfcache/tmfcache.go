@@ -114,6 +114,22 @@ func (tmf *TMFCache) Close() {
 	tmf.dbpool.Close()
 }
 
+// TakeConn takes a connection from the pool of database connections, waiting until one is available
+// or ctx is done. Queries using the connection are interrupted when ctx is done.
+// The connection must be returned with PutConn.
+func (tmf *TMFCache) TakeConn(ctx context.Context) (*sqlite.Conn, error) {
+	dbconn, err := tmf.dbpool.Take(ctx)
+	if err != nil {
+		return nil, errl.Errorf("taking db connection: %w", err)
+	}
+	return dbconn, nil
+}
+
+// PutConn returns to the pool a connection taken with TakeConn.
+func (tmf *TMFCache) PutConn(dbconn *sqlite.Conn) {
+	tmf.dbpool.Put(dbconn)
+}
+
 func indentStr(indent int) string {
 	return strings.Repeat(" ", indent)
 }
@@ -1693,6 +1709,22 @@ func (tmf *TMFCache) LocalRetrieveListTMFObject(dbconn *sqlite.Conn, tmfResource
 
 }
 
+// LocalRetrieveFilteredListTMFObject is like LocalRetrieveListTMFObject, but only retrieves the objects
+// which also satisfy the filters, which are translated into SQL conditions.
+func (tmf *TMFCache) LocalRetrieveFilteredListTMFObject(dbconn *sqlite.Conn, tmfResource string, queryValues url.Values, filters []RowFilter, perObject func(tmfObject TMFObject) LoopControl) error {
+	if dbconn == nil {
+		var err error
+		dbconn, err = tmf.dbpool.Take(context.Background())
+		if err != nil {
+			return errl.Errorf("taking db connection: %w", err)
+		}
+		defer tmf.dbpool.Put(dbconn)
+	}
+
+	return LocalRetrieveFilteredListTMFObject(dbconn, tmfResource, queryValues, filters, perObject)
+
+}
+
 // ProcessRelatedParties inspects and fixes the "relatedParty" entries of a TMFObject.
 // It performs several consistency checks and corrections, such as ensuring required fields
 // ("id", "href", "@referredType", "did", "role") are present and valid. If missing or invalid
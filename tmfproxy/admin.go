@@ -100,10 +100,15 @@ func addAdminRoutes(
 				return
 			}
 
-			err = rulesEngine.PutFile(filename, incomingRequestBody)
+			author, err := rulesEngine.PolicyAuthor(r)
 			if err != nil {
-				middleware.ErrorTMF(w, http.StatusInternalServerError, "error writing file", err.Error())
-				slog.Error("writing file", slogor.Err(err))
+				replyPolicyError(w, "error identifying the author", err)
+				return
+			}
+
+			_, err = rulesEngine.UploadPolicy(filename, incomingRequestBody, policySignature(r), author)
+			if err != nil {
+				replyPolicyError(w, "error writing file", err)
 				return
 			}
 
@@ -111,6 +116,39 @@ func addAdminRoutes(
 
 		})
 
+	mux.HandleFunc("GET /admin/decisioncache",
+		func(w http.ResponseWriter, r *http.Request) {
+
+			b, err := json.Marshal(rulesEngine.DecisionCacheStats())
+			if err != nil {
+				middleware.ErrorTMF(w, http.StatusInternalServerError, "error marshalling stats", err.Error())
+				slog.Error("marshalling decision cache stats", slogor.Err(err))
+				return
+			}
+
+			middleware.ReplyTMF(w, http.StatusOK, b, nil)
+
+		})
+
+	mux.HandleFunc("GET /admin/page/shadow",
+		func(w http.ResponseWriter, r *http.Request) {
+
+			stats, skipped, err := rulesEngine.ShadowStats()
+			if err != nil {
+				middleware.ErrorTMF(w, http.StatusInternalServerError, "error reading shadow policy stats", err.Error())
+				slog.Error("reading shadow policy stats", slogor.Err(err))
+				return
+			}
+
+			middleware.RenderHTML(engine, w, "shadow", map[string]any{
+				"Title":        "Shadow policy",
+				"ShadowPolicy": rulesEngine.ShadowPolicyFileName(),
+				"Stats":        stats,
+				"Skipped":      skipped,
+			}, "layouts/main")
+
+		})
+
 	mux.HandleFunc("GET /admin/page/logs",
 		func(w http.ResponseWriter, r *http.Request) {
 
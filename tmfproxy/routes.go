@@ -5,6 +5,7 @@
 package tmfproxy
 
 import (
+	"errors"
 	"io"
 	"log"
 	"log/slog"
@@ -13,6 +14,8 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/goccy/go-json"
 
@@ -42,6 +45,17 @@ func PrefixInRequest(uri string) bool {
 	return slices.Contains(RoutePrefixes, uri)
 }
 
+// errorAuthorization replies with a TMF error when the PDP did not authorize the request.
+// If the request was denied by the policy, the reason and rule given by the policy are included.
+func errorAuthorization(w http.ResponseWriter, code string, err error) {
+	var denied *pdp.DeniedError
+	if errors.As(err, &denied) {
+		mdl.ErrorTMFWithMessage(w, http.StatusForbidden, code, denied.Error(), denied.Decision.String())
+		return
+	}
+	mdl.ErrorTMF(w, http.StatusForbidden, code, err.Error())
+}
+
 func addHttpRoutes(
 	cc *config.Config,
 	mux *http.ServeMux,
@@ -77,8 +91,45 @@ func addHttpRoutes(
 	// Set the route needed for acting as a pure PDP.
 	// In this mode, an external PIP will call us.
 	// This route can also be used by any application or service asking for authorization info
-	// TODO: fix this, as it is not working properly
-	mux.HandleFunc("GET /authorize/v1/policies/authz", pdp.HandleGETAuthorization(logger, tmf, rulesEngine))
+	// The NGINX auth_request subrequest keeps the method of the original request, so all methods are accepted.
+	mux.HandleFunc("/authorize/v1/policies/authz", pdp.HandleGETAuthorization(logger, tmf, rulesEngine))
+
+	// The same for Envoy/Istio, with the HTTP service contract of the ext_authz filter.
+	// Envoy appends the path of the original request to the prefix, and keeps its method.
+	mux.HandleFunc(pdp.EnvoyPathPrefix+"/", pdp.HandleEnvoyAuthorization(logger, tmf, rulesEngine))
+
+	// Authorization decisions of a caller on several TMF objects in a single round trip,
+	// for applications which render lists of objects and other services.
+	mux.HandleFunc("POST /authorize/v1/decisions", func(w http.ResponseWriter, r *http.Request) {
+
+		var batch pdp.BatchRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&batch); err != nil {
+			mdl.ErrorTMF(w, http.StatusBadRequest, "invalid batch request", err.Error())
+			return
+		}
+
+		if len(batch.Items) > pdp.MaxBatchItems {
+			mdl.ErrorTMF(w, http.StatusBadRequest, "too many items in the batch", strconv.Itoa(len(batch.Items)))
+			return
+		}
+
+		logger.Info("POST batch authorization", mdl.RequestID(r), "items", len(batch.Items))
+
+		decisions, err := pdp.AuthorizeBatch(logger, tmf, rulesEngine, r, batch)
+		if err != nil {
+			errorAuthorization(w, "error in batch authorization", err)
+			slog.Error("batch authorization", slogor.Err(err))
+			return
+		}
+
+		out, err := json.Marshal(map[string]any{"decisions": decisions})
+		if err != nil {
+			mdl.ErrorTMF(w, http.StatusInternalServerError, "error marshalling decisions", err.Error())
+			return
+		}
+
+		mdl.ReplyTMF(w, http.StatusOK, out, nil)
+	})
 
 	// This is for the Access Node requests, which are only for reads
 	mux.HandleFunc("GET /api/v1/entities", func(w http.ResponseWriter, r *http.Request) {
@@ -121,7 +172,7 @@ func addHttpRoutes(
 
 		tmfObjectList, err := pdp.AuthorizeLIST(logger, tmf, rulesEngine, r, tmfManagementSystem, tmfResource)
 		if err != nil {
-			mdl.ErrorTMF(w, http.StatusForbidden, "error retrieving list", err.Error())
+			errorAuthorization(w, "error retrieving list", err)
 			logger.Error("retrieving", slogor.Err(err))
 			return
 		}
@@ -181,12 +232,13 @@ func addHttpRoutes(
 
 		tmfObject, err := pdp.AuthorizeREAD(logger, tmf, rulesEngine, r, tmfManagementSystem, tmfResource, tmfID)
 		if err != nil {
-			mdl.ErrorTMF(w, http.StatusForbidden, "error retrieving", err.Error())
+			errorAuthorization(w, "error retrieving", err)
 			slog.Error("retrieving", slogor.Err(err))
 			return
 		}
 
-		// Add the ETag header with the hash of the TMFObject
+		// Add the ETag header with the hash of the TMFObject.
+		// The object may have been redacted by the PDP, so the hash is of the view returned to the caller.
 		additionalHeaders := map[string]string{
 			"ETag": tmfObject.ETag(),
 		}
@@ -225,7 +277,7 @@ func addHttpRoutes(
 
 		tmfObject, err := pdp.AuthorizeCREATE(logger, tmf, rulesEngine, r, tmfManagementSystem, tmfResource)
 		if err != nil {
-			mdl.ErrorTMF(w, http.StatusForbidden, "error creating", err.Error())
+			errorAuthorization(w, "error creating", err)
 			slog.Error("creating", slogor.Err(err))
 			return
 		}
@@ -270,7 +322,7 @@ func addHttpRoutes(
 
 		tmfObject, err := pdp.AuthorizeUPDATE(logger, tmf, rulesEngine, r, tmfManagementSystem, tmfResource, tmfID)
 		if err != nil {
-			mdl.ErrorTMF(w, http.StatusForbidden, "error retrieving", err.Error())
+			errorAuthorization(w, "error retrieving", err)
 			slog.Error("retrieving", slogor.Err(err))
 			return
 		}
@@ -326,15 +378,314 @@ func addHttpRoutes(
 				return
 			}
 
-			err = rulesEngine.PutFile(filename, incomingRequestBody)
+			author, err := rulesEngine.PolicyAuthor(r)
+			if err != nil {
+				replyPolicyError(w, "error identifying the author", err)
+				return
+			}
+
+			pv, err := rulesEngine.UploadPolicy(filename, incomingRequestBody, policySignature(r), author)
+			if err != nil {
+				replyPolicyError(w, "error storing file", err)
+				return
+			}
+
+			if pv == nil {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			b, _ := json.Marshal(pv)
+			mdl.ReplyTMF(w, http.StatusOK, b, nil)
+
+		})
+
+	// The history of the versions of a policy file
+	mux.HandleFunc("GET /adminapi/v1/policy/{name}/versions",
+		func(w http.ResponseWriter, r *http.Request) {
+
+			versions, err := rulesEngine.PolicyVersions(r.PathValue("name"))
+			if err != nil {
+				replyPolicyError(w, "error retrieving versions", err)
+				return
+			}
+			if versions == nil {
+				versions = []pdp.PolicyVersion{}
+			}
+
+			b, _ := json.Marshal(versions)
+			mdl.ReplyTMF(w, http.StatusOK, b, nil)
+
+		})
+
+	// The content of a given version of a policy file
+	mux.HandleFunc("GET /adminapi/v1/policy/{name}/versions/{version}",
+		func(w http.ResponseWriter, r *http.Request) {
+
+			version, err := strconv.Atoi(r.PathValue("version"))
+			if err != nil {
+				mdl.ErrorTMF(w, http.StatusBadRequest, "invalid version", r.PathValue("version"))
+				return
+			}
+
+			pv, err := rulesEngine.PolicyVersion(r.PathValue("name"), version)
+			if err != nil {
+				replyPolicyError(w, "error retrieving version", err)
+				return
+			}
+
+			w.Header().Set("X-Policy-Version", strconv.Itoa(pv.Version))
+			w.Header().Set("X-Policy-Hash", pv.Hash)
+			w.Write(pv.Content)
+
+		})
+
+	// The differences between two versions of a policy file, in unified diff format
+	mux.HandleFunc("GET /adminapi/v1/policy/{name}/diff",
+		func(w http.ResponseWriter, r *http.Request) {
+
+			from, err := strconv.Atoi(r.URL.Query().Get("from"))
+			if err != nil {
+				mdl.ErrorTMF(w, http.StatusBadRequest, "invalid 'from' version", r.URL.Query().Get("from"))
+				return
+			}
+			to, err := strconv.Atoi(r.URL.Query().Get("to"))
+			if err != nil {
+				mdl.ErrorTMF(w, http.StatusBadRequest, "invalid 'to' version", r.URL.Query().Get("to"))
+				return
+			}
+
+			diff, err := rulesEngine.DiffPolicyVersions(r.PathValue("name"), from, to)
+			if err != nil {
+				replyPolicyError(w, "error comparing versions", err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+			w.Write([]byte(diff))
+
+		})
+
+	// Activates again a previous version of a policy file, creating a new version with its content
+	mux.HandleFunc("POST /adminapi/v1/policy/{name}/rollback/{version}",
+		func(w http.ResponseWriter, r *http.Request) {
+
+			version, err := strconv.Atoi(r.PathValue("version"))
+			if err != nil {
+				mdl.ErrorTMF(w, http.StatusBadRequest, "invalid version", r.PathValue("version"))
+				return
+			}
+
+			logger.Info("Admin API rollback policy", "filename", r.PathValue("name"), "version", version)
+
+			author, err := rulesEngine.PolicyAuthor(r)
+			if err != nil {
+				replyPolicyError(w, "error identifying the author", err)
+				return
+			}
+
+			pv, err := rulesEngine.RollbackPolicy(r.PathValue("name"), version, author)
 			if err != nil {
-				mdl.ErrorTMF(w, http.StatusInternalServerError, "error storing file", err.Error())
-				slog.Error("storing", slogor.Err(err))
+				replyPolicyError(w, "error rolling back", err)
 				return
 			}
 
-			w.WriteHeader(http.StatusOK)
+			b, _ := json.Marshal(pv)
+			mdl.ReplyTMF(w, http.StatusOK, b, nil)
 
 		})
 
+	// The authorization decisions recorded in the audit log, filtered by organization, object, time range and outcome.
+	// Times are in RFC3339 format, for example: /adminapi/v1/audit?organization=VATES-B60645900&outcome=deny&from=2025-01-01T00:00:00Z
+	mux.HandleFunc("GET /adminapi/v1/audit",
+		func(w http.ResponseWriter, r *http.Request) {
+
+			auditLog := rulesEngine.AuditLog()
+			if auditLog == nil {
+				mdl.ErrorTMF(w, http.StatusNotImplemented, "audit log not configured", "")
+				return
+			}
+
+			q, err := auditQueryFromRequest(r)
+			if err != nil {
+				mdl.ErrorTMF(w, http.StatusBadRequest, "invalid query", err.Error())
+				return
+			}
+
+			// Include the decisions taken until now
+			auditLog.Flush()
+
+			records, err := auditLog.Query(q)
+			if err != nil {
+				mdl.ErrorTMF(w, http.StatusBadRequest, "error querying the audit log", err.Error())
+				slog.Error("querying the audit log", slogor.Err(err))
+				return
+			}
+			if records == nil {
+				records = []pdp.AuditRecord{}
+			}
+
+			b, _ := json.Marshal(records)
+			mdl.ReplyTMF(w, http.StatusOK, b, nil)
+
+		})
+
+}
+
+// addAuthZENRoutes adds the routes of the OpenID AuthZEN Access Evaluation API, for other DOME components.
+//
+// The trust model is that of a PEP delegating the decisions to the PDP: the subject (the DID of the organization,
+// its country and the powers of the LEARCredential) is not authenticated by the PDP, but sent by the caller, which
+// must have already authenticated the user. So only the components configured with the shared secret can call the
+// API, presenting it as a Bearer token, and the routes are not added if no secret is configured.
+func addAuthZENRoutes(
+	mux *http.ServeMux,
+	tmf *tmfcache.TMFCache,
+	rulesEngine *pdp.PDP,
+	secret string,
+) {
+
+	logger := slog.Default()
+
+	// Reject the callers which do not present the shared secret, before reading the request
+	authenticated := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := pdp.AuthenticateAuthZENCaller(r, secret); err != nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				mdl.ErrorTMF(w, http.StatusUnauthorized, "unauthorized", err.Error())
+				logger.Warn("AuthZEN caller rejected", mdl.RequestID(r), "remote_addr", r.RemoteAddr)
+				return
+			}
+			next(w, r)
+		}
+	}
+
+	// Access evaluation of a single subject, action and resource
+	mux.HandleFunc("POST "+pdp.AuthZENEvaluationPath, authenticated(func(w http.ResponseWriter, r *http.Request) {
+
+		var evaluation pdp.AuthZENEvaluation
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&evaluation); err != nil {
+			mdl.ErrorTMF(w, http.StatusBadRequest, "invalid evaluation request", err.Error())
+			return
+		}
+
+		decision := pdp.EvaluateAccess(r.Context(), tmf, rulesEngine, evaluation)
+
+		out, err := json.Marshal(decision)
+		if err != nil {
+			mdl.ErrorTMF(w, http.StatusInternalServerError, "error marshalling decision", err.Error())
+			return
+		}
+
+		mdl.ReplyTMF(w, http.StatusOK, out, nil)
+	}))
+
+	// Several access evaluations in a single round trip
+	mux.HandleFunc("POST "+pdp.AuthZENEvaluationsPath, authenticated(func(w http.ResponseWriter, r *http.Request) {
+
+		var evaluations pdp.AuthZENEvaluations
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&evaluations); err != nil {
+			mdl.ErrorTMF(w, http.StatusBadRequest, "invalid evaluations request", err.Error())
+			return
+		}
+
+		logger.Info("POST AuthZEN evaluations", mdl.RequestID(r), "items", len(evaluations.Evaluations))
+
+		decisions, err := pdp.EvaluateAccessBatch(r.Context(), tmf, rulesEngine, evaluations)
+		if err != nil {
+			mdl.ErrorTMF(w, http.StatusBadRequest, "invalid evaluations request", err.Error())
+			return
+		}
+
+		out, err := json.Marshal(map[string]any{"evaluations": decisions})
+		if err != nil {
+			mdl.ErrorTMF(w, http.StatusInternalServerError, "error marshalling decisions", err.Error())
+			return
+		}
+
+		mdl.ReplyTMF(w, http.StatusOK, out, nil)
+	}))
+
+	// The AuthZEN PDP metadata document
+	mux.HandleFunc("GET "+pdp.AuthZENMetadataPath, func(w http.ResponseWriter, r *http.Request) {
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		} else if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			scheme = proto
+		}
+
+		out, err := json.Marshal(pdp.AuthZENMetadata(scheme + "://" + r.Host))
+		if err != nil {
+			mdl.ErrorTMF(w, http.StatusInternalServerError, "error marshalling metadata", err.Error())
+			return
+		}
+
+		mdl.ReplyTMF(w, http.StatusOK, out, nil)
+	})
+}
+
+// The query parameters of the audit log endpoint
+func auditQueryFromRequest(r *http.Request) (q pdp.AuditQuery, err error) {
+
+	values := r.URL.Query()
+
+	q.Organization = values.Get("organization")
+	q.ObjectID = values.Get("tmfid")
+	q.Outcome = values.Get("outcome")
+
+	if from := values.Get("from"); from != "" {
+		if q.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return q, err
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if q.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return q, err
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			return q, err
+		}
+	}
+	if offset := values.Get("offset"); offset != "" {
+		if q.Offset, err = strconv.Atoi(offset); err != nil {
+			return q, err
+		}
+	}
+
+	return q, nil
+}
+
+// policySignature returns the detached JWS over the uploaded policy, sent in the X-Policy-Signature header,
+// or nil if there is none. It is required if the PDP is configured with keys trusted to sign the policies.
+func policySignature(r *http.Request) []byte {
+	if signature := strings.TrimSpace(r.Header.Get("X-Policy-Signature")); signature != "" {
+		return []byte(signature)
+	}
+	return nil
+}
+
+// replyPolicyError sends the error of an operation with the policy store, with the proper status code.
+func replyPolicyError(w http.ResponseWriter, code string, err error) {
+
+	var validationErr *pdp.PolicyValidationError
+
+	switch {
+	case errors.As(err, &validationErr):
+		mdl.ErrorTMF(w, http.StatusBadRequest, "invalid policy", validationErr.Error())
+	case errors.Is(err, pdp.ErrPolicyVersionNotFound):
+		mdl.ErrorTMF(w, http.StatusNotFound, code, err.Error())
+	case errors.Is(err, pdp.ErrInvalidPolicySignature):
+		mdl.ErrorTMF(w, http.StatusBadRequest, "invalid policy signature", err.Error())
+	case errors.Is(err, pdp.ErrPolicyAuthor):
+		mdl.ErrorTMF(w, http.StatusUnauthorized, code, err.Error())
+	case errors.Is(err, pdp.ErrNoPolicyStore):
+		mdl.ErrorTMF(w, http.StatusNotImplemented, code, err.Error())
+	default:
+		mdl.ErrorTMF(w, http.StatusInternalServerError, code, err.Error())
+	}
+
+	slog.Error(code, slogor.Err(err))
 }
@@ -45,11 +45,53 @@ func TMFServerHandler(
 		return nil, nil, errl.Error(err)
 	}
 
+	// The policies can look up other objects in the local cache
+	rulesEngine.SetObjectSource(tmfDb)
+
+	// The uploaded policies are versioned in the same database, and the active versions replace the ones in the disk
+	policyStore, err := pdp.NewPolicyStore(cfg.Dbname)
+	if err != nil {
+		return nil, nil, errl.Error(err)
+	}
+	if err := rulesEngine.SetPolicyStore(policyStore); err != nil {
+		return nil, nil, errl.Error(err)
+	}
+
+	// The authorization decisions can be recorded in the same database, for compliance
+	if cfg.AuditLog {
+		auditLog, err := pdp.NewAuditLog(cfg.Dbname, cfg.AuditRetention)
+		if err != nil {
+			return nil, nil, errl.Error(err)
+		}
+		auditLog.SetCaptureInputs(cfg.AuditInputs)
+		rulesEngine.SetAuditLog(auditLog)
+	}
+
+	// The inputs of the decisions can be recorded, to evaluate the effect of changes to the policies
+	if cfg.RecordDecisionsFile != "" {
+		recorder, err := pdp.NewDecisionRecorder(cfg.RecordDecisionsFile)
+		if err != nil {
+			return nil, nil, errl.Error(err)
+		}
+		rulesEngine.SetDecisionRecorder(recorder)
+	}
+
 	addAdminRoutes(cfg, mux, tmfDb, rulesEngine)
 
 	// Add the TMForum API routes
 	addHttpRoutes(cfg, mux, tmfDb, rulesEngine)
 
+	// The AuthZEN API is only available to the components configured with the shared secret
+	if cfg.AuthZENSecretFile != "" {
+		secret, err := pdp.ReadAuthZENSecret(cfg.AuthZENSecretFile)
+		if err != nil {
+			return nil, nil, errl.Error(err)
+		}
+		addAuthZENRoutes(mux, tmfDb, rulesEngine, secret)
+	} else {
+		slog.Info("AuthZEN API disabled, no shared secret configured for its callers")
+	}
+
 	// Enable CORS with permissive options.
 	handler := cors.AllowAll().Handler(mux)
 